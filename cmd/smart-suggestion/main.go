@@ -2,16 +2,18 @@ package main
 
 import (
 	"archive/tar"
-	"bufio"
 	"bytes"
 	"compress/gzip"
+	"context"
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"os/signal"
@@ -19,7 +21,10 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
+	"text/tabwriter"
 	"time"
 
 	"github.com/creack/pty"
@@ -253,6 +258,119 @@ Examples:
 </reasoning>
 =kubectl describe node node-bbb`
 
+// fixSystemPrompt replaces the default system prompt in fix mode
+const fixSystemPrompt = `You are a professional SRE engineer with decades of experience, proficient in all shell commands.
+
+The user's last command failed. Your task is to return the corrected command that does what the user intended.
+    - First, you must reason about why the command failed in <reasoning> tags, using its exit code and output. This reasoning will not be shown to the user.
+    - After reasoning, respond with the corrected command, prefixed with an equal sign (=).
+
+RULES for the final output (after the reasoning):
+    - Keep the user's intent and as much of the original command as possible. Only change what caused the failure.
+    - If the command itself is right but something is missing (a tool, a directory, a login), return the command that fixes the cause.
+    - Your response MAY NOT contain any newlines!
+    - Do NOT add any additional text, comments, or explanations to your response.
+    - Your response will be run in the user's shell.
+
+Example of your full response format:
+<reasoning>
+1. 'tar xf backup.tgz -C /srv/restore' failed with "Cannot open: No such file or directory".
+2. The target directory /srv/restore does not exist.
+3. Creating the directory first lets the extraction succeed.
+</reasoning>
+=mkdir -p /srv/restore && tar xf backup.tgz -C /srv/restore`
+
+// naturalLanguageSystemPrompt replaces the default system prompt for natural
+// language input
+const naturalLanguageSystemPrompt = `You are a professional SRE engineer with decades of experience, proficient in all shell commands.
+
+The user describes in natural language what they want to do. Your task is to turn this intent into shell commands.
+    - First, you must reason about the user's intent in <reasoning> tags, using the context. This reasoning will not be shown to the user.
+    - After reasoning, respond with the command, prefixed with an equal sign (=).
+    - If the intent needs several steps, respond with one line per step instead, each prefixed with an equal sign (=), in the order they must run.
+
+RULES for the final output (after the reasoning):
+    - Prefer a single command, possibly a pipeline, when it does the job. Use at most 8 steps.
+    - Every line must start with an equal sign and contain exactly one command.
+    - Do NOT add any additional text, comments, explanations or code fences to your response.
+    - Use the tools, paths and names visible in the context instead of placeholders where possible.
+    - Your response will be run in the user's shell.
+
+Example of your full response format:
+<reasoning>
+1. The user wants to build the container image of the current project and publish it.
+2. The Dockerfile is in the current directory and the history shows the registry registry.example.com.
+3. This takes a build and a push.
+</reasoning>
+=docker build -t registry.example.com/app:latest .
+=docker push registry.example.com/app:latest`
+
+// explainSystemPrompt replaces the default system prompt in explain mode
+const explainSystemPrompt = `You are a professional SRE engineer with decades of experience, proficient in all shell commands.
+
+Your task is to explain the user's shell command to a colleague who is new to it, before they run it.
+
+Respond ONLY with a JSON object of this form, without code fences or any other text:
+{
+  "summary": "One or two sentences on what the command does as a whole",
+  "parts": [
+    {"text": "The command, subcommand, flag with its value, or argument exactly as written", "explanation": "What it does in this command"}
+  ],
+  "side_effects": ["Each change to files, processes, the network, remote systems or other state. Empty if there are none"],
+  "risk": {"level": "low, medium or high", "summary": "What could go wrong and whether it can be undone"}
+}
+
+RULES:
+    - Explain every flag and argument in the order they appear. Explain combined short flags (e.g. -xzf) one by one.
+    - Split pipelines, redirections and command lists into their commands and explain each.
+    - When a man page or --help snippet is given in the context, base the explanation on it, as it is the installed version.
+    - Read-only commands are low risk. Commands that delete or overwrite data, change permissions, or affect remote or production systems are high risk.
+    - Do not suggest other commands.`
+
+// diagnoseSystemPrompt replaces the default system prompt in diagnose mode
+const diagnoseSystemPrompt = `You are a professional SRE engineer with decades of experience, proficient in all shell commands.
+
+The user's terminal shows an error, such as a stack trace, compiler errors or a failed HTTP request. Your task is to find its root cause and the next command that helps to confirm or fix it.
+    - First, you must reason about the error in <reasoning> tags. This reasoning will not be shown to the user.
+    - After reasoning, respond with a short diagnosis on a line starting with "Diagnosis:", then the next command, prefixed with an equal sign (=).
+
+RULES for the final output (after the reasoning):
+    - The diagnosis is at most two sentences. Name the root cause, not the symptoms: the first error usually causes the ones after it.
+    - Prefer a command that gathers the missing information (logs, status, versions, configuration) over one that changes things.
+    - The command MAY NOT contain any newlines. If no command helps, respond with a single equal sign (=).
+    - Do NOT add any additional text, comments, or code fences to your response.
+
+Example of your full response format:
+<reasoning>
+1. 'kubectl apply' failed with "error: unable to recognize "deploy.yaml": no matches for kind "Ingress" in version "extensions/v1beta1"".
+2. extensions/v1beta1 Ingress was removed in Kubernetes 1.22.
+3. Checking the API versions the cluster serves confirms which one the manifest should use.
+</reasoning>
+Diagnosis: The manifest uses the Ingress API extensions/v1beta1, which the cluster no longer serves.
+=kubectl api-versions | grep networking`
+
+// diagnoseErrorPrompt describes the error found in the terminal
+const diagnoseErrorPrompt = `# Error output (most recent error in the terminal):
+%s`
+
+// fixFailurePrompt describes the failed command
+const fixFailurePrompt = `# Failed command:
+%s
+# Exit code: %d
+# Output (last lines):
+%s`
+
+// refineFeedbackPrompt asks for a revision of the last suggestion
+const refineFeedbackPrompt = `Your suggestion is close but not right. The user's feedback:
+%s
+
+Revise the suggestion accordingly. Reason about it in <reasoning> tags again, then respond in the same format as before.`
+
+// autosuggestPrompt is appended to the system prompt for as-you-type requests
+const autosuggestPrompt = `The user is still typing and your response is shown as inline ghost text after the cursor:
+    - Only return a completion of the user's input, prefixed with a plus sign (+). Never return a new command.
+    - If you can't complete the input, respond with a single plus sign (+).`
+
 var (
 	// These will be set during build time using ldflags
 	Version   = "dev"
@@ -273,10 +391,42 @@ var (
 	proxyLogFile string
 	sessionID    string
 
+	localFallback bool
+	noCache       bool
+	noDaemon      bool
+
+	autosuggest         bool
+	autosuggestDebounce time.Duration
+	naturalLanguage     bool
+
+	// conversationSession is the key the conversation of a suggestion is
+	// kept under
+	conversationSession string
+
+	proxyBufferSize  string
+	noDiskLog        bool
+	proxyNoTTY       bool
+	proxyCast        bool
+	proxyCastMaxSize string
+
 	// Global log rotator instance
 	logRotator *pkg.LogRotator
 )
 
+// httpClient is shared by the provider requests, so a daemon reuses its
+// connections (HTTP/2 where the API supports it) across suggestions
+var httpClient = newHTTPClient()
+
+func newHTTPClient() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ForceAttemptHTTP2 = true
+	transport.MaxIdleConnsPerHost = 4
+	transport.IdleConnTimeout = 10 * time.Minute
+	// The daemon sends each request through its caller's proxy
+	transport.Proxy = pkg.ProxyFromContext
+	return &http.Client{Timeout: 30 * time.Second, Transport: transport}
+}
+
 // Initialize log rotator
 func init() {
 	config := pkg.DefaultLogRotateConfig()
@@ -298,9 +448,14 @@ func main() {
 
 	// Add proxy command
 	var proxyCmd = &cobra.Command{
-		Use:   "proxy",
+		Use:   "proxy [-- command [args...]]",
 		Short: "Start shell proxy mode to record commands and output",
-		Run:   runProxy,
+		Long: `Start shell proxy mode to record commands and output.
+
+Without arguments the proxy runs $SHELL. Arguments after -- are run instead,
+e.g. "smart-suggestion proxy -- ./deploy.sh prod", and recorded as a single
+command in the session log.`,
+		Run: runProxy,
 	}
 
 	// Add rotate-logs command
@@ -323,6 +478,226 @@ func main() {
 		},
 	}
 
+	// Add cache command
+	var cacheCmd = &cobra.Command{
+		Use:   "cache",
+		Short: "Manage the suggestion cache",
+	}
+	cacheCmd.AddCommand(&cobra.Command{
+		Use:   "clear",
+		Short: "Remove all cached suggestions",
+		Run:   runCacheClear,
+	})
+	cacheCmd.AddCommand(&cobra.Command{
+		Use:   "stats",
+		Short: "Show suggestion cache statistics",
+		Run:   runCacheStats,
+	})
+
+	// Add pause and resume commands
+	var pauseCmd = &cobra.Command{
+		Use:   "pause",
+		Short: "Pause recording of the current proxy session",
+		Run:   runPause,
+	}
+	pauseCmd.Flags().BoolP("toggle", "t", false, "Resume instead if recording is already paused")
+	var resumeCmd = &cobra.Command{
+		Use:   "resume",
+		Short: "Resume recording of the current proxy session",
+		Run:   runResume,
+	}
+
+	// Add sessions command
+	var sessionsCmd = &cobra.Command{
+		Use:   "sessions",
+		Short: "List, inspect and prune proxy sessions",
+	}
+	sessionsCmd.PersistentFlags().StringVarP(&proxyLogFile, "log-file", "l", "/tmp/smart_suggestion_proxy.log", "Proxy log file path")
+	sessionsCmd.PersistentFlags().BoolVarP(&debug, "debug", "d", false, "Enable debug logging")
+	sessionsCmd.AddCommand(&cobra.Command{
+		Use:   "list",
+		Short: "List active and ended proxy sessions",
+		Args:  cobra.NoArgs,
+		Run:   runSessionsList,
+	})
+	sessionsCmd.AddCommand(&cobra.Command{
+		Use:   "show [session-id]",
+		Short: "Show a session's details, recent commands and output (default: current session)",
+		Args:  cobra.MaximumNArgs(1),
+		Run:   runSessionsShow,
+	})
+	sessionsTailCmd := &cobra.Command{
+		Use:   "tail [session-id]",
+		Short: "Print the rendered end of a session's output (default: current session)",
+		Args:  cobra.MaximumNArgs(1),
+		Run:   runSessionsTail,
+	}
+	sessionsTailCmd.Flags().IntP("lines", "n", 50, "Number of lines to print")
+	sessionsTailCmd.Flags().BoolP("follow", "f", false, "Keep printing new output until the session ends")
+	sessionsCmd.AddCommand(sessionsTailCmd)
+	sessionsPruneCmd := &cobra.Command{
+		Use:   "prune",
+		Short: "Remove the files of ended sessions by age and total size",
+		Args:  cobra.NoArgs,
+		Run:   runSessionsPrune,
+	}
+	sessionsPruneCmd.Flags().String("max-age", "", "Remove sessions idle for longer than this (default: $SMART_SUGGESTION_SESSION_MAX_AGE or 24h)")
+	sessionsPruneCmd.Flags().String("max-size", "", "Remove the oldest sessions until all use at most this much (default: $SMART_SUGGESTION_SESSION_MAX_SIZE or 100MB)")
+	sessionsPruneCmd.Flags().Bool("dry-run", false, "Only print what would be removed")
+	sessionsCmd.AddCommand(sessionsPruneCmd)
+	sessionsExportCmd := &cobra.Command{
+		Use:   "export [session-id]",
+		Short: "Export a session as an asciicast recording, plain text or HTML (default: current session)",
+		Args:  cobra.MaximumNArgs(1),
+		Run:   runSessionsExport,
+	}
+	sessionsExportCmd.Flags().StringP("format", "f", "asciicast", "Export format (asciicast, text, html)")
+	sessionsExportCmd.Flags().StringP("output", "o", "", "Output file (default: stdout)")
+	sessionsCmd.AddCommand(sessionsExportCmd)
+
+	// Add replay command
+	var replayCmd = &cobra.Command{
+		Use:   "replay [session-id | file.cast]",
+		Short: "Play a recorded session back in the terminal (default: current session)",
+		Args:  cobra.MaximumNArgs(1),
+		Run:   runReplay,
+	}
+	replayCmd.Flags().StringVarP(&proxyLogFile, "log-file", "l", "/tmp/smart_suggestion_proxy.log", "Proxy log file path")
+	replayCmd.Flags().Float64P("speed", "s", 1, "Playback speed multiplier")
+	replayCmd.Flags().Duration("max-idle", 2*time.Second, "Longest pause between outputs during playback (0 for no limit)")
+
+	// Add daemon command
+	var daemonCmd = &cobra.Command{
+		Use:   "daemon",
+		Short: "Serve suggestions from a long-running process with warm connections and indexes",
+		Long: `Serve suggestions from a long-running process with warm connections and indexes.
+
+The daemon listens on a per-user Unix socket ($SMART_SUGGESTION_DAEMON_SOCKET,
+$XDG_RUNTIME_DIR/smart-suggestion.sock or /tmp/smart-suggestion-<uid>.sock).
+While it runs, suggestion requests are sent to it automatically.`,
+		Args: cobra.NoArgs,
+		Run:  runDaemon,
+	}
+	daemonCmd.Flags().StringVarP(&proxyLogFile, "log-file", "l", "/tmp/smart_suggestion_proxy.log", "Proxy log file path, used to index session commands")
+	daemonCmd.Flags().BoolVarP(&debug, "debug", "d", false, "Enable debug logging")
+	daemonCmd.AddCommand(&cobra.Command{
+		Use:   "status",
+		Short: "Show whether the daemon is running",
+		Args:  cobra.NoArgs,
+		Run:   runDaemonStatus,
+	})
+	daemonCmd.AddCommand(&cobra.Command{
+		Use:   "stop",
+		Short: "Stop the running daemon",
+		Args:  cobra.NoArgs,
+		Run:   runDaemonStop,
+	})
+
+	// Add predict command
+	var predictCmd = &cobra.Command{
+		Use:   "predict",
+		Short: "Predict the next command right after one finished",
+		Long: `Predict the next command right after one finished, from the command, its exit
+code and output, and print it. The plugin runs this in the background from a
+precmd hook.`,
+		Args: cobra.NoArgs,
+		Run:  runPredict,
+	}
+	predictCmd.Flags().StringVarP(&provider, "provider", "p", "", "AI provider (openai, azure_openai, anthropic, gemini, deepseek, or local)")
+	predictCmd.Flags().StringP("command", "", "", "Command that just finished")
+	predictCmd.Flags().IntP("exit-code", "", 0, "Exit code of the command")
+	predictCmd.Flags().StringVarP(&systemPrompt, "system", "s", "", "System prompt (optional, uses default if not provided)")
+	predictCmd.Flags().BoolVarP(&debug, "debug", "d", false, "Enable debug logging")
+	predictCmd.Flags().BoolVarP(&sendContext, "context", "c", false, "Include context information")
+	predictCmd.Flags().BoolVarP(&localFallback, "local-fallback", "", false, "Use the local suggestion engine when the AI provider fails")
+	predictCmd.Flags().BoolVarP(&noDaemon, "no-daemon", "", false, "Predict in-process even if the daemon is running")
+	predictCmd.Flags().StringVarP(&proxyLogFile, "log-file", "l", "/tmp/smart_suggestion_proxy.log", "Proxy log file path, used to find the command's output")
+	predictCmd.MarkFlagRequired("provider")
+	predictCmd.MarkFlagRequired("command")
+
+	// Add fix command
+	var fixCmd = &cobra.Command{
+		Use:   "fix",
+		Short: "Propose a corrected command for the last failed one",
+		Long: `Propose a corrected command for the last failed one and write it to the output
+file. Common failures (typos, missing sudo, git push without upstream) are
+fixed by local rules without an API request. The output is taken from --stderr,
+the proxy session record or the terminal buffer.`,
+		Args: cobra.NoArgs,
+		Run:  runFix,
+	}
+	fixCmd.Flags().StringVarP(&provider, "provider", "p", "", "AI provider (openai, azure_openai, anthropic, gemini, deepseek, or local)")
+	fixCmd.Flags().StringP("command", "", "", "Command that failed")
+	fixCmd.Flags().IntP("exit-code", "", 1, "Exit code of the command")
+	fixCmd.Flags().StringP("stderr", "", "", "Error output of the command (default: from the proxy session or terminal buffer)")
+	fixCmd.Flags().StringVarP(&systemPrompt, "system", "s", "", "System prompt (optional, uses a fix prompt if not provided)")
+	fixCmd.Flags().StringVarP(&outputFile, "output", "o", "/tmp/smart_suggestion", "Output file path")
+	fixCmd.Flags().BoolVarP(&debug, "debug", "d", false, "Enable debug logging")
+	fixCmd.Flags().BoolVarP(&sendContext, "context", "c", false, "Include context information")
+	fixCmd.Flags().BoolVarP(&noDaemon, "no-daemon", "", false, "Fetch in-process even if the daemon is running")
+	fixCmd.Flags().StringVarP(&proxyLogFile, "log-file", "l", "/tmp/smart_suggestion_proxy.log", "Proxy log file path, used to find the command's output")
+	fixCmd.MarkFlagRequired("provider")
+	fixCmd.MarkFlagRequired("command")
+
+	// Add explain command
+	var explainCmd = &cobra.Command{
+		Use:   "explain [flags] <command>",
+		Short: "Explain a command flag by flag, with its side effects and risk",
+		Args:  cobra.MinimumNArgs(1),
+		Run:   runExplain,
+	}
+	explainCmd.Flags().StringVarP(&provider, "provider", "p", "", "AI provider (openai, azure_openai, anthropic, gemini, or deepseek; default: $SMART_SUGGESTION_AI_PROVIDER)")
+	explainCmd.Flags().StringP("format", "f", "text", "Output format (text, json)")
+	explainCmd.Flags().StringVarP(&systemPrompt, "system", "s", "", "System prompt (optional, uses an explain prompt if not provided)")
+	explainCmd.Flags().BoolVarP(&debug, "debug", "d", false, "Enable debug logging")
+	explainCmd.Flags().BoolVarP(&sendContext, "context", "c", false, "Include context information")
+	explainCmd.Flags().BoolVarP(&noCache, "no-cache", "", false, "Don't read or write the suggestion cache")
+	explainCmd.Flags().BoolVarP(&noDaemon, "no-daemon", "", false, "Fetch in-process even if the daemon is running")
+	// Flags after the command belong to it, so it doesn't have to be quoted
+	explainCmd.Flags().SetInterspersed(false)
+
+	// Add diagnose command
+	var diagnoseCmd = &cobra.Command{
+		Use:   "diagnose",
+		Short: "Diagnose the most recent error in the terminal",
+		Long: `Find the most recent error in the terminal buffer (a stack trace, compiler
+errors, a failed HTTP request), and write a short diagnosis of its root cause
+and the next diagnostic command to the output file. The first line of the
+output is the command, prefixed with "=", and the rest is the diagnosis.`,
+		Args: cobra.NoArgs,
+		Run:  runDiagnose,
+	}
+	diagnoseCmd.Flags().StringVarP(&provider, "provider", "p", "", "AI provider (openai, azure_openai, anthropic, gemini, or deepseek)")
+	diagnoseCmd.Flags().StringP("file", "f", "", "Read the output to diagnose from this file, or - for stdin (default: the terminal buffer)")
+	diagnoseCmd.Flags().StringVarP(&systemPrompt, "system", "s", "", "System prompt (optional, uses a diagnose prompt if not provided)")
+	diagnoseCmd.Flags().StringVarP(&outputFile, "output", "o", "/tmp/smart_suggestion", "Output file path")
+	diagnoseCmd.Flags().BoolVarP(&debug, "debug", "d", false, "Enable debug logging")
+	diagnoseCmd.Flags().BoolVarP(&sendContext, "context", "c", false, "Include context information")
+	diagnoseCmd.Flags().BoolVarP(&noCache, "no-cache", "", false, "Don't read or write the suggestion cache")
+	diagnoseCmd.Flags().BoolVarP(&noDaemon, "no-daemon", "", false, "Fetch in-process even if the daemon is running")
+	diagnoseCmd.Flags().StringVarP(&proxyLogFile, "log-file", "l", "/tmp/smart_suggestion_proxy.log", "Proxy log file path, used to read the terminal buffer")
+	diagnoseCmd.MarkFlagRequired("provider")
+
+	// Add refine command
+	var refineCmd = &cobra.Command{
+		Use:   "refine [flags] <feedback>",
+		Short: "Revise the last suggestion with follow-up feedback",
+		Long: `Revise the last suggestion of the session with follow-up feedback, e.g.
+"use jq instead" or "only for namespace prod", and write the revised command
+to the output file. The request and answer of each suggestion are kept per
+session, and the feedback is sent as a follow-up turn of that conversation.`,
+		Args: cobra.MinimumNArgs(1),
+		Run:  runRefine,
+	}
+	refineCmd.Flags().StringVarP(&provider, "provider", "p", "", "AI provider (openai, azure_openai, anthropic, gemini, or deepseek; default: the one that made the suggestion)")
+	refineCmd.Flags().StringVarP(&systemPrompt, "system", "s", "", "System prompt (optional, uses the one of the suggestion if not provided)")
+	refineCmd.Flags().StringVarP(&outputFile, "output", "o", "/tmp/smart_suggestion", "Output file path")
+	refineCmd.Flags().BoolVarP(&debug, "debug", "d", false, "Enable debug logging")
+	refineCmd.Flags().BoolVarP(&sendContext, "context", "c", false, "Include context information (default: as for the suggestion)")
+	refineCmd.Flags().BoolVarP(&noDaemon, "no-daemon", "", false, "Fetch in-process even if the daemon is running")
+	refineCmd.Flags().StringVarP(&conversationSession, "conversation", "", "", "Key of the conversation to continue (default: the proxy session or terminal)")
+	refineCmd.Flags().StringVarP(&proxyLogFile, "log-file", "l", "/tmp/smart_suggestion_proxy.log", "Proxy log file path, used to find session output and records")
+
 	// Add update command
 	var updateCmd = &cobra.Command{
 		Use:   "update",
@@ -331,17 +706,30 @@ func main() {
 	}
 
 	// Root command flags
-	rootCmd.Flags().StringVarP(&provider, "provider", "p", "", "AI provider (openai, azure_openai, anthropic, gemini, or deepseek)")
+	rootCmd.Flags().StringVarP(&provider, "provider", "p", "", "AI provider (openai, azure_openai, anthropic, gemini, deepseek, or local)")
 	rootCmd.Flags().StringVarP(&input, "input", "i", "", "User input")
 	rootCmd.Flags().StringVarP(&systemPrompt, "system", "s", "", "System prompt (optional, uses default if not provided)")
 	rootCmd.Flags().BoolVarP(&debug, "debug", "d", false, "Enable debug logging")
 	rootCmd.Flags().StringVarP(&outputFile, "output", "o", "/tmp/smart_suggestion", "Output file path")
 	rootCmd.Flags().BoolVarP(&sendContext, "context", "c", false, "Include context information")
+	rootCmd.Flags().BoolVarP(&noCache, "no-cache", "", false, "Don't read or write the suggestion cache")
+	rootCmd.Flags().BoolVarP(&localFallback, "local-fallback", "", false, "Use the local suggestion engine when the AI provider fails")
+	rootCmd.Flags().BoolVarP(&noDaemon, "no-daemon", "", false, "Fetch in-process even if the daemon is running")
+	rootCmd.Flags().BoolVarP(&naturalLanguage, "nl", "", false, "Treat the input as a natural language intent (implied by a leading #)")
+	rootCmd.Flags().BoolVarP(&autosuggest, "autosuggest", "", false, "Print only a completion of the input to stdout, for as-you-type suggestions")
+	rootCmd.Flags().DurationVarP(&autosuggestDebounce, "debounce", "", 0, "Wait this long before fetching an as-you-type suggestion")
+	rootCmd.Flags().StringVarP(&conversationSession, "conversation", "", "", "Key to keep the conversation under for refine (default: the proxy session or terminal)")
+	rootCmd.Flags().StringVarP(&proxyLogFile, "log-file", "l", "/tmp/smart_suggestion_proxy.log", "Proxy log file path, used to find session output and records")
 
 	// Proxy command flags
 	proxyCmd.Flags().StringVarP(&proxyLogFile, "log-file", "l", "/tmp/smart_suggestion_proxy.log", "Proxy log file path")
 	proxyCmd.Flags().StringVarP(&sessionID, "session-id", "", "", "Session ID for log isolation (auto-generated if not provided)")
 	proxyCmd.Flags().BoolVarP(&debug, "debug", "d", false, "Enable debug logging")
+	proxyCmd.Flags().StringVarP(&proxyBufferSize, "buffer-size", "", "256KB", "Size of the in-memory output buffer served over the session socket")
+	proxyCmd.Flags().BoolVarP(&noDiskLog, "no-disk-log", "", false, "Keep session output only in memory instead of also writing it to the log file")
+	proxyCmd.Flags().BoolVarP(&proxyNoTTY, "no-tty", "", false, "Run the command with pipes instead of a PTY (default when neither stdin nor stdout is a terminal)")
+	proxyCmd.Flags().BoolVarP(&proxyCast, "cast", "", false, "Also keep an asciicast recording of the session for export and replay")
+	proxyCmd.Flags().StringVarP(&proxyCastMaxSize, "cast-max-size", "", "20MB", "Stop the asciicast recording at this size (0 for no limit)")
 
 	// Rotate-logs command flags
 	rotateCmd.Flags().StringVarP(&proxyLogFile, "log-file", "l", "/tmp/smart_suggestion_proxy.log", "Log file path to rotate (required)")
@@ -354,6 +742,17 @@ func main() {
 	rootCmd.AddCommand(rotateCmd)
 	rootCmd.AddCommand(versionCmd)
 	rootCmd.AddCommand(updateCmd)
+	rootCmd.AddCommand(cacheCmd)
+	rootCmd.AddCommand(daemonCmd)
+	rootCmd.AddCommand(predictCmd)
+	rootCmd.AddCommand(fixCmd)
+	rootCmd.AddCommand(explainCmd)
+	rootCmd.AddCommand(diagnoseCmd)
+	rootCmd.AddCommand(refineCmd)
+	rootCmd.AddCommand(pauseCmd)
+	rootCmd.AddCommand(sessionsCmd)
+	rootCmd.AddCommand(replayCmd)
+	rootCmd.AddCommand(resumeCmd)
 
 	// Only require provider and input for the main fetch command
 	if len(os.Args) > 1 && os.Args[1] != "proxy" && os.Args[1] != "rotate-logs" {
@@ -373,45 +772,39 @@ func main() {
 }
 
 func runFetch(cmd *cobra.Command, args []string) {
-	if systemPrompt == "" {
-		systemPrompt = defaultSystemPrompt
+	if autosuggest {
+		runAutosuggest()
+		return
 	}
 
-	// Build the complete prompt with context if requested
-	completePrompt := systemPrompt
-	if sendContext {
-		contextInfo, err := buildContextInfo()
-		if err != nil {
-			if debug {
-				logDebug("Failed to build context info", map[string]any{
-					"error": err.Error(),
-				})
-			}
-			// Continue without context if there's an error
-		} else {
-			completePrompt = systemPrompt + "\n\n" + contextInfo
+	// Natural language input is an intent, answered with a command or a plan
+	// that replaces the input
+	if strings.HasPrefix(strings.TrimSpace(input), "#") {
+		naturalLanguage = true
+	}
+	if naturalLanguage {
+		input = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(input), "#"))
+		if systemPrompt == "" {
+			systemPrompt = naturalLanguageSystemPrompt
 		}
+		// The local engine completes commands and can't follow intents
+		localFallback = false
 	}
+	basePrompt := systemPrompt
 
-	// Update the global systemPrompt for API calls
-	systemPrompt = completePrompt
-
-	var suggestion string
-	var err error
-
-	switch strings.ToLower(provider) {
-	case "openai":
-		suggestion, err = fetchOpenAI()
-	case "azure_openai":
-		suggestion, err = fetchAzureOpenAI()
-	case "anthropic":
-		suggestion, err = fetchAnthropic()
-	case "gemini":
-		suggestion, err = fetchGemini()
-	case "deepseek":
-		suggestion, err = fetchDeepSeek()
-	default:
-		err = fmt.Errorf("unsupported provider: %s", provider)
+	// Let a running daemon answer, and fetch in-process otherwise
+	suggestion, err := newFetchRequest().fetch()
+	if err == nil {
+		saveConversation(&pkg.Conversation{
+			Provider:        provider,
+			SystemPrompt:    basePrompt,
+			Context:         sendContext,
+			Input:           input,
+			NaturalLanguage: naturalLanguage,
+		}, input, suggestion)
+	}
+	if err == nil && naturalLanguage {
+		suggestion, err = pkg.FormatPlan(suggestion)
 	}
 
 	if err != nil {
@@ -430,537 +823,1144 @@ func runFetch(cmd *cobra.Command, args []string) {
 		os.Exit(1)
 	}
 
-	// Parse the suggestion to extract only the command part
-	finalSuggestion := parseAndExtractCommand(suggestion)
-
-	if debug {
-		logDebug("Successfully fetched suggestion", map[string]any{
-			"provider":          provider,
-			"input":             input,
-			"original_response": suggestion,
-			"parsed_suggestion": finalSuggestion,
-		})
-	}
-
-	if err := os.WriteFile(outputFile, []byte(finalSuggestion), 0644); err != nil {
+	if err := os.WriteFile(outputFile, []byte(suggestion), 0644); err != nil {
 		fmt.Fprintf(os.Stderr, "Failed to write suggestion to file: %v\n", err)
 		os.Exit(1)
 	}
 }
 
-func fetchOpenAI() (string, error) {
-	apiKey := os.Getenv("OPENAI_API_KEY")
-	if apiKey == "" {
-		return "", fmt.Errorf("OPENAI_API_KEY environment variable is not set")
-	}
+// runRefine handles the refine command. It sends the feedback as a follow-up
+// to the last suggestion of the session and writes the revised command to the
+// output file, or the error to the error file.
+func runRefine(cmd *cobra.Command, args []string) {
+	feedback := strings.TrimSpace(strings.Join(args, " "))
 
-	baseURL := os.Getenv("OPENAI_BASE_URL")
-	if baseURL == "" {
-		baseURL = "https://api.openai.com"
-	}
+	suggestion, err := fetchRefinement(cmd, feedback)
+	if err != nil {
+		if debug {
+			logDebug("Error refining suggestion", map[string]any{
+				"error":    err.Error(),
+				"provider": provider,
+				"feedback": feedback,
+			})
+		}
 
-	// Handle different base URL formats
-	var url string
-	if strings.HasPrefix(baseURL, "http://") || strings.HasPrefix(baseURL, "https://") {
-		// Base URL already includes protocol
-		baseURL = strings.TrimSuffix(baseURL, "/")
-		url = fmt.Sprintf("%s/v1/chat/completions", baseURL)
-	} else {
-		// Base URL is just hostname, add https protocol
-		url = fmt.Sprintf("https://%s/v1/chat/completions", baseURL)
+		errorMsg := fmt.Sprintf("Error refining suggestion: %v", err)
+		if err := os.WriteFile("/tmp/.smart_suggestion_error", []byte(errorMsg), 0644); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to write error file: %v\n", err)
+		}
+		os.Exit(1)
 	}
 
-	request := OpenAIRequest{
-		Model: "gpt-4o-mini",
-		Messages: []OpenAIMessage{
-			{Role: "system", Content: systemPrompt},
-			{Role: "user", Content: input},
-		},
+	if err := os.WriteFile(outputFile, []byte(suggestion), 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write suggestion to file: %v\n", err)
+		os.Exit(1)
 	}
+}
 
-	jsonData, err := json.Marshal(request)
+// fetchRefinement continues the conversation of the session with the
+// feedback and returns the revised command, prefixed with an equal sign
+func fetchRefinement(cmd *cobra.Command, feedback string) (string, error) {
+	conversation, err := pkg.LoadConversation(getConversationSession())
 	if err != nil {
-		return "", fmt.Errorf("failed to marshal request: %w", err)
+		return "", err
 	}
 
-	if debug {
-		logDebug("Sending OpenAI request", map[string]any{
-			"url":     url,
-			"request": string(jsonData),
-		})
+	// Ask the same way as for the suggestion being refined
+	if provider == "" {
+		provider = conversation.Provider
 	}
-
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
-	if err != nil {
-		return "", fmt.Errorf("failed to create request: %w", err)
+	if strings.ToLower(provider) == "local" {
+		return "", fmt.Errorf("the local provider can't refine suggestions")
 	}
-
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+apiKey)
-
-	client := &http.Client{Timeout: 30 * time.Second}
-	resp, err := client.Do(req)
-	if err != nil {
-		return "", fmt.Errorf("failed to send request: %w", err)
+	if systemPrompt == "" {
+		systemPrompt = conversation.SystemPrompt
 	}
-	defer resp.Body.Close()
+	if !cmd.Flags().Changed("context") {
+		sendContext = conversation.Context
+	}
+	input = fmt.Sprintf(refineFeedbackPrompt, feedback)
 
-	body, err := io.ReadAll(resp.Body)
+	request := newFetchRequest()
+	request.history = conversation.Turns
+	suggestion, err := request.fetch()
 	if err != nil {
-		return "", fmt.Errorf("failed to read response: %w", err)
+		return "", err
 	}
+	saveConversation(conversation, input, suggestion)
 
-	if debug {
-		logDebug("Received OpenAI response", map[string]any{
-			"status":   resp.Status,
-			"response": string(body),
-		})
+	if conversation.NaturalLanguage {
+		return pkg.FormatPlan(suggestion)
 	}
-
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("API request failed with status %d: %s", resp.StatusCode, string(body))
+	// A completion of the original input replaces it as a whole
+	if completion, ok := strings.CutPrefix(suggestion, "+"); ok {
+		return "=" + conversation.Input + completion, nil
 	}
-
-	var response OpenAIResponse
-	if err := json.Unmarshal(body, &response); err != nil {
-		return "", fmt.Errorf("failed to unmarshal response: %w", err)
+	if !strings.HasPrefix(suggestion, "=") || strings.ContainsAny(suggestion, "\n\r") {
+		return "", fmt.Errorf("invalid suggestion: %q", suggestion)
 	}
+	return suggestion, nil
+}
 
-	if response.Error != nil {
-		return "", fmt.Errorf("OpenAI API error: %s", response.Error.Message)
+// saveConversation adds a request and its answer to the conversation and
+// keeps it for the session, so the answer can be refined
+func saveConversation(conversation *pkg.Conversation, request, answer string) {
+	session := getConversationSession()
+	if session == "" || strings.ToLower(provider) == "local" {
+		return
 	}
-
-	if len(response.Choices) == 0 {
-		return "", fmt.Errorf("no choices returned from OpenAI API")
+	conversation.Append(request, answer)
+	if err := conversation.Save(session); err != nil && debug {
+		logDebug("Failed to save conversation", map[string]any{
+			"error":   err.Error(),
+			"session": session,
+		})
 	}
-
-	return response.Choices[0].Message.Content, nil
 }
 
-func fetchAzureOpenAI() (string, error) {
-	apiKey := os.Getenv("AZURE_OPENAI_API_KEY")
-	if apiKey == "" {
-		return "", fmt.Errorf("AZURE_OPENAI_API_KEY environment variable is not set")
+// getConversationSession returns the key the conversation is kept under: the
+// --conversation flag, the proxy session or the terminal. Without any of them
+// there is no conversation to refine.
+func getConversationSession() string {
+	if conversationSession != "" {
+		return conversationSession
 	}
-
-	// Get deployment name - required for both custom and standard URLs
-	deploymentName := os.Getenv("AZURE_OPENAI_DEPLOYMENT_NAME")
-	if deploymentName == "" {
-		return "", fmt.Errorf("AZURE_OPENAI_DEPLOYMENT_NAME environment variable is not set")
+	if id := os.Getenv("SMART_SUGGESTION_SESSION_ID"); id != "" {
+		return id
 	}
+	return getTTYName()
+}
 
-	// Check if custom base URL is provided
-	baseURL := os.Getenv("AZURE_OPENAI_BASE_URL")
-	var url string
+// runAutosuggest answers an as-you-type request from the zsh-autosuggestions
+// strategy. After the debounce delay it prints the input followed by the
+// suggested completion, or nothing if the suggestion is a new command.
+func runAutosuggest() {
+	// zsh-autosuggestions kills its worker when the buffer changes, which
+	// makes this request stale
+	go exitWithParent()
+	time.Sleep(autosuggestDebounce)
 
-	if baseURL != "" {
-		// Custom base URL provided - use it directly
-		apiVersion := os.Getenv("AZURE_OPENAI_API_VERSION")
-		if apiVersion == "" {
-			apiVersion = "2024-10-21" // Default to latest stable version
+	suggestion, err := newFetchRequest().fetch()
+	if err != nil {
+		if debug {
+			logDebug("Error fetching autosuggestion", map[string]any{
+				"error":    err.Error(),
+				"provider": provider,
+				"input":    input,
+			})
 		}
+		os.Exit(1)
+	}
 
-		// Handle different base URL formats
-		if strings.HasPrefix(baseURL, "http://") || strings.HasPrefix(baseURL, "https://") {
-			// Base URL already includes protocol
-			baseURL = strings.TrimSuffix(baseURL, "/")
-			url = fmt.Sprintf("%s/openai/deployments/%s/chat/completions?api-version=%s", baseURL, deploymentName, apiVersion)
-		} else {
-			// Base URL is just hostname, add https protocol
-			url = fmt.Sprintf("https://%s/openai/deployments/%s/chat/completions?api-version=%s", baseURL, deploymentName, apiVersion)
-		}
-	} else {
-		// Standard Azure OpenAI format - requires resource name and deployment name
-		resourceName := os.Getenv("AZURE_OPENAI_RESOURCE_NAME")
-		if resourceName == "" {
-			return "", fmt.Errorf("AZURE_OPENAI_RESOURCE_NAME environment variable is not set")
-		}
+	completion, ok := strings.CutPrefix(suggestion, "+")
+	if !ok || strings.TrimSpace(completion) == "" || strings.ContainsAny(completion, "\n\r") {
+		return
+	}
+	fmt.Print(input + completion)
+}
 
-		// API version for Azure OpenAI
-		apiVersion := os.Getenv("AZURE_OPENAI_API_VERSION")
-		if apiVersion == "" {
-			apiVersion = "2024-10-21" // Default to latest stable version
+// exitWithParent exits as soon as the parent process is gone
+func exitWithParent() {
+	parent := os.Getppid()
+	for range time.Tick(50 * time.Millisecond) {
+		if os.Getppid() != parent {
+			os.Exit(1)
 		}
-
-		// Azure OpenAI endpoint format
-		url = fmt.Sprintf("https://%s.openai.azure.com/openai/deployments/%s/chat/completions?api-version=%s",
-			resourceName, deploymentName, apiVersion)
 	}
+}
 
-	request := AzureOpenAIRequest{
-		Model: deploymentName, // In Azure OpenAI, this should match the deployment name
-		Messages: []OpenAIMessage{
-			{Role: "system", Content: systemPrompt},
-			{Role: "user", Content: input},
-		},
+// runPredict handles the predict command. It predicts the next command right
+// after one finished and prints it, or nothing if there is no prediction.
+func runPredict(cmd *cobra.Command, args []string) {
+	command, _ := cmd.Flags().GetString("command")
+	exitCode, _ := cmd.Flags().GetInt("exit-code")
+
+	if systemPrompt == "" {
+		systemPrompt = defaultSystemPrompt
+	}
+	// Outside a proxy session the output is only known from the shell buffer context
+	var output string
+	if record := findCommandRecord(command, 10*time.Second, time.Second); record != nil {
+		output, _ = readLatestLines(record.Output, 50)
 	}
+	systemPrompt += "\n\n" + buildPredictPrompt(command, exitCode, output)
+	input = ""
 
-	jsonData, err := json.Marshal(request)
+	suggestion, err := newFetchRequest().fetch()
 	if err != nil {
-		return "", fmt.Errorf("failed to marshal request: %w", err)
+		if debug {
+			logDebug("Error predicting next command", map[string]any{
+				"error":    err.Error(),
+				"provider": provider,
+				"command":  command,
+			})
+		}
+		fmt.Fprintf(os.Stderr, "Error predicting next command: %v\n", err)
+		os.Exit(1)
 	}
 
+	// Without input a completion is a new command as well
+	prediction := suggestion
+	if strings.HasPrefix(prediction, "=") || strings.HasPrefix(prediction, "+") {
+		prediction = prediction[1:]
+	}
+	prediction = strings.TrimSpace(prediction)
 	if debug {
-		logDebug("Sending Azure OpenAI request", map[string]any{
-			"url":        url,
-			"deployment": deploymentName,
-			"request":    string(jsonData),
+		logDebug("Predicted next command", map[string]any{
+			"command":    command,
+			"exit_code":  exitCode,
+			"prediction": prediction,
 		})
 	}
-
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
-	if err != nil {
-		return "", fmt.Errorf("failed to create request: %w", err)
+	if prediction == "" || strings.ContainsAny(prediction, "\n\r") {
+		return
 	}
+	fmt.Println(prediction)
+}
 
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("api-key", apiKey) // Azure OpenAI uses "api-key" header
+// predictPrompt is appended to the system prompt for predictions made right
+// after a command finished
+const predictPrompt = `The user has not typed anything yet. The command below just finished. Predict the command they will most likely run next, based on its exit code and output, and respond with it as a new command (=).
 
-	client := &http.Client{Timeout: 30 * time.Second}
-	resp, err := client.Do(req)
-	if err != nil {
-		return "", fmt.Errorf("failed to send request: %w", err)
-	}
-	defer resp.Body.Close()
+# Command that just finished:
+%s
+# Exit code: %d
+`
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return "", fmt.Errorf("failed to read response: %w", err)
+// buildPredictPrompt describes the command that just finished
+func buildPredictPrompt(command string, exitCode int, output string) string {
+	prompt := fmt.Sprintf(predictPrompt, command, exitCode)
+	if output != "" {
+		prompt += "# Its output (last lines):\n" + output + "\n"
 	}
+	return prompt
+}
 
-	if debug {
-		logDebug("Received Azure OpenAI response", map[string]any{
-			"status":   resp.Status,
-			"response": string(body),
-		})
+// findCommandRecord returns the proxy's record of the last command in this
+// session if it is command, waiting up to wait for the proxy to write it.
+// Records older than maxAge, if set, belong to an earlier run and are ignored.
+func findCommandRecord(command string, maxAge, wait time.Duration) *pkg.CommandRecord {
+	currentSessionID := os.Getenv("SMART_SUGGESTION_SESSION_ID")
+	if currentSessionID == "" || proxyLogFile == "" {
+		return nil
 	}
+	recordFile := pkg.GetSessionRecordFile(getSessionBasedLogFile(proxyLogFile, currentSessionID))
 
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("API request failed with status %d: %s", resp.StatusCode, string(body))
+	deadline := time.Now().Add(wait)
+	for {
+		records, _ := pkg.ReadCommandRecords(recordFile)
+		if n := len(records); n > 0 {
+			last := records[n-1]
+			if strings.TrimSpace(last.Command) == strings.TrimSpace(command) && (maxAge == 0 || time.Since(last.EndTime) < maxAge) {
+				return &last
+			}
+		}
+		if time.Now().After(deadline) {
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
 	}
+}
 
-	var response AzureOpenAIResponse
-	if err := json.Unmarshal(body, &response); err != nil {
-		return "", fmt.Errorf("failed to unmarshal response: %w", err)
-	}
-
-	if response.Error != nil {
-		return "", fmt.Errorf("Azure OpenAI API error: %s", response.Error.Message)
+// runFix handles the fix command. It writes the corrected command to the
+// output file like a suggestion, or the error to the error file.
+func runFix(cmd *cobra.Command, args []string) {
+	command, _ := cmd.Flags().GetString("command")
+	exitCode, _ := cmd.Flags().GetInt("exit-code")
+	output, _ := cmd.Flags().GetString("stderr")
+
+	// Prefer what the proxy recorded, then whatever the terminal still shows
+	if record := findCommandRecord(command, 0, 0); record != nil {
+		if output == "" {
+			output = record.Output
+		}
+		if !cmd.Flags().Changed("exit-code") && record.ExitCode != nil {
+			exitCode = *record.ExitCode
+		}
 	}
-
-	if len(response.Choices) == 0 {
-		return "", fmt.Errorf("no choices returned from Azure OpenAI API")
+	if output == "" {
+		output, _ = newFetchRequest().getShellBuffer()
 	}
+	output, _ = readLatestLines(output, 30)
 
-	return response.Choices[0].Message.Content, nil
-}
+	fix, err := fetchFix(command, exitCode, output)
+	if err != nil {
+		if debug {
+			logDebug("Error fixing command", map[string]any{
+				"error":    err.Error(),
+				"provider": provider,
+				"command":  command,
+			})
+		}
 
-func fetchAnthropic() (string, error) {
-	apiKey := os.Getenv("ANTHROPIC_API_KEY")
-	if apiKey == "" {
-		return "", fmt.Errorf("ANTHROPIC_API_KEY environment variable is not set")
+		errorMsg := fmt.Sprintf("Error fixing command with %s: %v", provider, err)
+		if err := os.WriteFile("/tmp/.smart_suggestion_error", []byte(errorMsg), 0644); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to write error file: %v\n", err)
+		}
+		os.Exit(1)
 	}
 
-	baseURL := os.Getenv("ANTHROPIC_BASE_URL")
-	if baseURL == "" {
-		baseURL = "https://api.anthropic.com"
+	if err := os.WriteFile(outputFile, []byte("="+fix), 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write suggestion to file: %v\n", err)
+		os.Exit(1)
 	}
+}
 
-	// Handle different base URL formats
-	var url string
-	if strings.HasPrefix(baseURL, "http://") || strings.HasPrefix(baseURL, "https://") {
-		// Base URL already includes protocol
-		baseURL = strings.TrimSuffix(baseURL, "/")
-		url = fmt.Sprintf("%s/v1/messages", baseURL)
-	} else {
-		// Base URL is just hostname, add https protocol
-		url = fmt.Sprintf("https://%s/v1/messages", baseURL)
+// fetchFix returns the corrected command, from the local rules if one matches
+// and from the provider otherwise
+func fetchFix(command string, exitCode int, output string) (string, error) {
+	rules := &pkg.FixRules{Commands: pkg.PathCommands()}
+	if fix, ok := rules.Fix(command, exitCode, output); ok {
+		if debug {
+			logDebug("Fixed command with local rule", map[string]any{
+				"command": command,
+				"rule":    fix.Rule,
+				"fix":     fix.Command,
+			})
+		}
+		return fix.Command, nil
+	}
+	if strings.ToLower(provider) == "local" {
+		return "", fmt.Errorf("no local rule matches this failure")
 	}
 
-	request := AnthropicRequest{
-		Model:     "claude-3-5-sonnet-20241022",
-		MaxTokens: 1000,
-		System:    systemPrompt,
-		Messages: []AnthropicMessage{
-			{Role: "user", Content: input},
-		},
+	if systemPrompt == "" {
+		systemPrompt = fixSystemPrompt
 	}
+	systemPrompt += "\n\n" + fmt.Sprintf(fixFailurePrompt, command, exitCode, output)
+	input = command
 
-	jsonData, err := json.Marshal(request)
+	suggestion, err := newFetchRequest().fetch()
 	if err != nil {
-		return "", fmt.Errorf("failed to marshal request: %w", err)
+		return "", err
 	}
 
+	// A completion continues the failed command rather than replacing it
+	var fix string
+	if completion, ok := strings.CutPrefix(suggestion, "+"); ok {
+		fix = strings.TrimSpace(command + completion)
+	} else {
+		fix = strings.TrimSpace(strings.TrimPrefix(suggestion, "="))
+	}
+	if fix == "" || strings.ContainsAny(fix, "\n\r") {
+		return "", fmt.Errorf("invalid fix: %q", suggestion)
+	}
 	if debug {
-		logDebug("Sending Anthropic request", map[string]any{
-			"url":     url,
-			"request": string(jsonData),
+		logDebug("Fixed command with provider", map[string]any{
+			"command": command,
+			"fix":     fix,
 		})
 	}
+	return fix, nil
+}
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
-	if err != nil {
-		return "", fmt.Errorf("failed to create request: %w", err)
+// runExplain handles the explain command
+func runExplain(cmd *cobra.Command, args []string) {
+	format, _ := cmd.Flags().GetString("format")
+	if format != "text" && format != "json" {
+		fmt.Fprintf(os.Stderr, "Error: unknown format %q (use text or json)\n", format)
+		os.Exit(1)
+	}
+	command := strings.TrimSpace(strings.Join(args, " "))
+	if provider == "" {
+		provider = os.Getenv("SMART_SUGGESTION_AI_PROVIDER")
+	}
+	if provider == "" {
+		fmt.Fprintf(os.Stderr, "Error: no provider, pass --provider or set SMART_SUGGESTION_AI_PROVIDER\n")
+		os.Exit(1)
+	}
+	if strings.ToLower(provider) == "local" {
+		fmt.Fprintf(os.Stderr, "Error: the local provider can't explain commands\n")
+		os.Exit(1)
 	}
 
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("x-api-key", apiKey)
-	req.Header.Set("anthropic-version", "2023-06-01")
+	if systemPrompt == "" {
+		systemPrompt = explainSystemPrompt
+	}
+	input = command
 
-	client := &http.Client{Timeout: 30 * time.Second}
-	resp, err := client.Do(req)
+	response, err := newFetchRequest().fetch()
 	if err != nil {
-		return "", fmt.Errorf("failed to send request: %w", err)
+		fmt.Fprintf(os.Stderr, "Error explaining command with %s: %v\n", provider, err)
+		os.Exit(1)
 	}
-	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
+	explanation, err := pkg.ParseCommandExplanation(command, response)
 	if err != nil {
-		return "", fmt.Errorf("failed to read response: %w", err)
+		if debug {
+			logDebug("Failed to parse explanation", map[string]any{
+				"error":    err.Error(),
+				"response": response,
+			})
+		}
+		fmt.Fprintf(os.Stderr, "Error parsing explanation: %v\n", err)
+		os.Exit(1)
 	}
 
-	if debug {
-		logDebug("Received Anthropic response", map[string]any{
-			"status":   resp.Status,
-			"response": string(body),
-		})
+	if format == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(explanation)
+	} else {
+		err = explanation.WriteText(os.Stdout)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing explanation: %v\n", err)
+		os.Exit(1)
 	}
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("API request failed with status %d: %s", resp.StatusCode, string(body))
+// runDiagnose handles the diagnose command. It writes the diagnosis to the
+// output file, or the error to the error file.
+func runDiagnose(cmd *cobra.Command, args []string) {
+	file, _ := cmd.Flags().GetString("file")
+
+	diagnosis, err := fetchDiagnosis(file)
+	if err != nil {
+		if debug {
+			logDebug("Error diagnosing output", map[string]any{
+				"error":    err.Error(),
+				"provider": provider,
+			})
+		}
+
+		errorMsg := fmt.Sprintf("Error diagnosing output with %s: %v", provider, err)
+		if err := os.WriteFile("/tmp/.smart_suggestion_error", []byte(errorMsg), 0644); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to write error file: %v\n", err)
+		}
+		os.Exit(1)
 	}
 
-	var response AnthropicResponse
-	if err := json.Unmarshal(body, &response); err != nil {
-		return "", fmt.Errorf("failed to unmarshal response: %w", err)
+	if err := os.WriteFile(outputFile, []byte(diagnosis.String()), 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write diagnosis to file: %v\n", err)
+		os.Exit(1)
 	}
+}
 
-	if response.Type == "error" || response.Error != nil {
-		errorMsg := "unknown error"
-		if response.Error != nil {
-			errorMsg = response.Error.Message
+// fetchDiagnosis finds the most recent error in the output read from file, or
+// in the terminal buffer, and asks the provider for its root cause
+func fetchDiagnosis(file string) (*pkg.Diagnosis, error) {
+	if strings.ToLower(provider) == "local" {
+		return nil, fmt.Errorf("the local provider can't diagnose errors")
+	}
+
+	var output string
+	switch file {
+	case "":
+		// Errors often scroll further than the usual context
+		content, err := newFetchRequest().doGetShellBuffer()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read terminal buffer: %w", err)
 		}
-		return "", fmt.Errorf("Anthropic API error: %s", errorMsg)
+		output = content
+	case "-":
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read stdin: %w", err)
+		}
+		output = string(data)
+	default:
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", file, err)
+		}
+		output = string(data)
 	}
 
-	if len(response.Content) == 0 {
-		return "", fmt.Errorf("no content returned from Anthropic API")
+	region := pkg.LatestErrorRegion(output)
+	if region == "" {
+		return nil, fmt.Errorf("no error found in the output")
+	}
+	if debug {
+		logDebug("Found error region", map[string]any{
+			"region": region,
+		})
 	}
 
-	return response.Content[0].Text, nil
-}
+	if systemPrompt == "" {
+		systemPrompt = diagnoseSystemPrompt
+	}
+	systemPrompt += "\n\n" + fmt.Sprintf(diagnoseErrorPrompt, region)
+	input = "Diagnose the error above."
 
-// writeToLogFile writes content to a log file with automatic rotation
-func writeToLogFile(logFilePath, content string) error {
-	// Check and rotate log file if necessary
-	if err := logRotator.CheckAndRotate(logFilePath); err != nil {
-		log.Printf("Failed to rotate log file: %v", err)
-		// Continue with logging even if rotation fails
+	response, err := newFetchRequest().fetch()
+	if err != nil {
+		return nil, err
 	}
 
-	file, err := os.OpenFile(logFilePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	diagnosis, err := pkg.ParseDiagnosis(response)
 	if err != nil {
-		return fmt.Errorf("failed to open log file: %w", err)
+		return nil, err
 	}
-	defer file.Close()
+	if strings.ContainsAny(diagnosis.Command, "\n\r") {
+		return nil, fmt.Errorf("invalid command: %q", diagnosis.Command)
+	}
+	return diagnosis, nil
+}
 
-	_, err = file.WriteString(content + "\n")
-	return err
+// fetchRequest is everything a suggestion is fetched with: the flags, and the
+// working directory, environment and terminal of the shell asking for it.
+// Commands fill it from their flags and the process; the daemon from each
+// caller's request, so that requests don't share state and run concurrently.
+type fetchRequest struct {
+	// ctx cancels the provider request, e.g. when the daemon's client goes away
+	ctx           context.Context
+	provider      string
+	input         string
+	systemPrompt  string
+	sendContext   bool
+	noCache       bool
+	localFallback bool
+	debug         bool
+	autosuggest   bool
+	logFile       string
+	// history holds the earlier turns of a refined suggestion, sent before
+	// the input
+	history []pkg.ConversationTurn
+
+	cwd string
+	// env is nil for the process's own environment
+	env map[string]string
+	tty string
 }
 
-func logDebug(message string, data map[string]any) {
-	logFilePath := "/tmp/smart-suggestion.log"
+// newFetchRequest returns a request with the flags, in the process's own
+// working directory and environment
+func newFetchRequest() *fetchRequest {
+	cwd, _ := os.Getwd()
+	return &fetchRequest{
+		ctx:           context.Background(),
+		provider:      provider,
+		input:         input,
+		systemPrompt:  systemPrompt,
+		sendContext:   sendContext,
+		noCache:       noCache,
+		localFallback: localFallback,
+		debug:         debug,
+		autosuggest:   autosuggest,
+		logFile:       proxyLogFile,
+		cwd:           cwd,
+	}
+}
 
-	logEntry := map[string]any{
-		"date": time.Now().Format(time.RFC3339),
-		"log":  message,
+// newDaemonFetchRequest returns the request a daemon client sent, in the
+// client's working directory and environment
+func newDaemonFetchRequest(ctx context.Context, request *pkg.SuggestionRequest) (*fetchRequest, error) {
+	if info, err := os.Stat(request.Cwd); err != nil || !info.IsDir() {
+		return nil, fmt.Errorf("no such directory: %s", request.Cwd)
+	}
+	env := make(map[string]string)
+	for _, entry := range request.Env {
+		if key, value, ok := strings.Cut(entry, "="); ok && key != "" {
+			env[key] = value
+		}
 	}
 
-	for k, v := range data {
-		logEntry[k] = v
+	r := &fetchRequest{
+		provider:      request.Provider,
+		input:         request.Input,
+		systemPrompt:  request.SystemPrompt,
+		sendContext:   request.Context,
+		noCache:       request.NoCache,
+		localFallback: request.LocalFallback,
+		debug:         debug || request.Debug,
+		autosuggest:   request.Autosuggest,
+		logFile:       proxyLogFile,
+		history:       request.History,
+		cwd:           request.Cwd,
+		env:           env,
+		tty:           request.TTY,
+	}
+	if request.LogFile != "" {
+		r.logFile = r.path(request.LogFile)
+	}
+	r.ctx = pkg.WithProxyEnv(ctx, r.getenv)
+	return r, nil
+}
+
+// getenv returns the value of an environment variable of the caller
+func (r *fetchRequest) getenv(key string) string {
+	if r.env == nil {
+		return os.Getenv(key)
 	}
+	return r.env[key]
+}
 
-	jsonData, err := json.Marshal(logEntry)
+// envInt returns the integer value of the environment variable key, or def
+// if it is not set
+func (r *fetchRequest) envInt(key string, def int) (int, error) {
+	value := r.getenv(key)
+	if value == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(value)
 	if err != nil {
-		log.Printf("Failed to marshal debug log: %v", err)
-		return
+		return 0, fmt.Errorf("invalid %s: %w", key, err)
 	}
+	return n, nil
+}
 
-	if err := writeToLogFile(logFilePath, string(jsonData)); err != nil {
-		log.Printf("Failed to write debug log: %v", err)
+// command returns a command running in the caller's working directory and
+// environment
+func (r *fetchRequest) command(name string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(r.ctx, name, args...)
+	cmd.Dir = r.cwd
+	if r.env != nil {
+		cmd.Env = r.environ()
 	}
+	return cmd
 }
 
-// buildContextInfo builds context information similar to the zsh plugin
-func buildContextInfo() (string, error) {
-	var contextParts []string
+// environ returns the caller's environment as key=value pairs
+func (r *fetchRequest) environ() []string {
+	if r.env == nil {
+		return os.Environ()
+	}
+	env := make([]string, 0, len(r.env))
+	for key, value := range r.env {
+		env = append(env, key+"="+value)
+	}
+	return env
+}
 
-	// Get user information
-	currentUser := os.Getenv("USER")
-	if currentUser == "" {
-		currentUser = "unknown"
+// path resolves a path relative to the caller's working directory
+func (r *fetchRequest) path(path string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
 	}
+	return filepath.Join(r.cwd, path)
+}
 
-	// Get current directory
-	currentDir, err := os.Getwd()
-	if err != nil {
-		currentDir = "unknown"
+// ttyName returns the name of the caller's terminal
+func (r *fetchRequest) ttyName() string {
+	if r.env == nil {
+		return getTTYName()
 	}
+	return r.tty
+}
 
-	// Get shell information
-	shell := os.Getenv("SHELL")
-	if shell == "" {
-		shell = "unknown"
+// terminalSize returns the size of the caller's terminal. The daemon only
+// knows it from $COLUMNS and $LINES.
+func (r *fetchRequest) terminalSize() (int, int) {
+	if r.env == nil {
+		return getTerminalSize()
 	}
+	return terminalSizeFromEnv(r.getenv)
+}
 
-	// Get terminal information
-	term := os.Getenv("TERM")
-	if term == "" {
-		term = "unknown"
+// historyFiles returns the caller's shell history files
+func (r *fetchRequest) historyFiles() []string {
+	return pkg.DefaultHistoryFiles(r.path(r.getenv("HISTFILE")))
+}
+
+// fetch asks a running daemon for the suggestion, and fetches it in-process
+// if none could be reached
+func (r *fetchRequest) fetch() (string, error) {
+	suggestion, served, err := r.fetchFromDaemon()
+	if !served {
+		suggestion, err = r.fetchSuggestion()
 	}
+	return suggestion, err
+}
 
-	// Get system information
-	systemInfo, err := getSystemInfo()
-	if err != nil {
-		if debug {
-			logDebug("Failed to get system info", map[string]any{
-				"error": err.Error(),
-			})
-		}
-		systemInfo = "unknown system"
+// fetchSuggestion builds the prompt, asks the provider and returns the parsed
+// suggestion, using the suggestion cache unless disabled
+func (r *fetchRequest) fetchSuggestion() (string, error) {
+	if r.systemPrompt == "" {
+		r.systemPrompt = defaultSystemPrompt
+	}
+	if r.autosuggest {
+		r.systemPrompt += "\n\n" + autosuggestPrompt
 	}
 
-	// Get user ID information
-	userID, err := getUserID()
-	if err != nil {
-		if debug {
-			logDebug("Failed to get user ID", map[string]any{
-				"error": err.Error(),
-			})
+	// Build the complete prompt with context if requested
+	completePrompt := r.systemPrompt
+	if r.sendContext && strings.ToLower(r.provider) != "local" {
+		contextInfo, err := r.buildContextInfo()
+		if err != nil {
+			if r.debug {
+				logDebug("Failed to build context info", map[string]any{
+					"error": err.Error(),
+				})
+			}
+			// Continue without context if there's an error
+		} else {
+			completePrompt = r.systemPrompt + "\n\n" + contextInfo
 		}
-		userID = "unknown"
 	}
 
-	// Get uname information
-	unameInfo, err := getUnameInfo()
-	if err != nil {
-		if debug {
-			logDebug("Failed to get uname info", map[string]any{
-				"error": err.Error(),
-			})
+	// Update the global systemPrompt for API calls
+	basePrompt := r.systemPrompt
+	r.systemPrompt = completePrompt
+
+	// Serve identical requests from the suggestion cache
+	var cache *pkg.SuggestionCache
+	var cacheKey string
+	// Follow-up turns are never repeated exactly, so they aren't cached
+	if !r.noCache && len(r.history) == 0 && strings.ToLower(r.provider) != "local" {
+		cache, cacheKey = r.openSuggestionCache(basePrompt, strings.TrimPrefix(completePrompt, basePrompt))
+		if cache != nil {
+			if cached, ok := cache.Get(cacheKey); ok {
+				if r.debug {
+					stats := cache.Stats()
+					logDebug("Using cached suggestion", map[string]any{
+						"provider":     r.provider,
+						"input":        r.input,
+						"suggestion":   cached,
+						"cache_hits":   stats.Hits,
+						"cache_misses": stats.Misses,
+					})
+				}
+				return cached, nil
+			}
 		}
-		unameInfo = "unknown"
 	}
 
-	// Build the basic context
-	basicContext := fmt.Sprintf("# Context:\nYou are user %s with id %s in directory %s. Your shell is %s and your terminal is %s running on %s. %s",
-		currentUser, userID, currentDir, shell, term, unameInfo, systemInfo)
-	contextParts = append(contextParts, basicContext)
+	var suggestion string
+	var err error
+	usedFallback := false
 
-	// Get aliases
-	aliases, err := getAliases()
-	if err != nil {
-		if debug {
-			logDebug("Failed to get aliases", map[string]any{
-				"error": err.Error(),
-			})
-		}
-	} else {
-		contextParts = append(contextParts, "\n# This is the alias defined in your shell:\n", aliases)
+	switch strings.ToLower(r.provider) {
+	case "openai":
+		suggestion, err = r.fetchOpenAI()
+	case "azure_openai":
+		suggestion, err = r.fetchAzureOpenAI()
+	case "anthropic":
+		suggestion, err = r.fetchAnthropic()
+	case "gemini":
+		suggestion, err = r.fetchGemini()
+	case "deepseek":
+		suggestion, err = r.fetchDeepSeek()
+	case "local":
+		suggestion, err = r.fetchLocal()
+	default:
+		err = fmt.Errorf("unsupported provider: %s", r.provider)
 	}
 
-	shellHistory, err := getShellHistory()
-	if err != nil {
-		if debug {
-			logDebug("Failed to get shell history", map[string]any{
-				"error": err.Error(),
+	// Fall back to the local engine when the AI provider fails
+	if err != nil && r.localFallback && strings.ToLower(r.provider) != "local" {
+		localSuggestion, localErr := r.fetchLocal()
+		if r.debug {
+			logDebug("Falling back to local suggestion engine", map[string]any{
+				"error":       err.Error(),
+				"provider":    r.provider,
+				"local_error": fmt.Sprint(localErr),
 			})
 		}
-	} else {
-		contextParts = append(contextParts, "\n# Shell history:\n", shellHistory)
+		if localErr == nil {
+			suggestion, err = localSuggestion, nil
+			usedFallback = true
+		}
 	}
 
-	// Get tmux buffer content if available
-	shellBuffer, err := getShellBuffer()
 	if err != nil {
-		if debug {
-			logDebug("Failed to get shell buffer", map[string]any{
+		return "", err
+	}
+
+	// Parse the suggestion to extract only the command part
+	finalSuggestion := parseAndExtractCommand(suggestion)
+
+	if r.debug {
+		logDebug("Successfully fetched suggestion", map[string]any{
+			"provider":          r.provider,
+			"input":             r.input,
+			"original_response": suggestion,
+			"parsed_suggestion": finalSuggestion,
+		})
+	}
+
+	if cache != nil && !usedFallback {
+		if err := cache.Put(cacheKey, finalSuggestion); err != nil && r.debug {
+			logDebug("Failed to cache suggestion", map[string]any{
 				"error": err.Error(),
 			})
 		}
-	} else {
-		contextParts = append(contextParts, "\n# Shell buffer:\n", shellBuffer)
+		if r.debug {
+			stats := cache.Stats()
+			logDebug("Cached suggestion", map[string]any{
+				"cache_hits":    stats.Hits,
+				"cache_misses":  stats.Misses,
+				"cache_entries": stats.Entries,
+				"cache_bytes":   stats.Bytes,
+			})
+		}
 	}
 
-	return strings.Join(contextParts, ""), nil
+	return finalSuggestion, nil
 }
 
-// getSystemInfo gets system information similar to the zsh plugin
-func getSystemInfo() (string, error) {
-	switch runtime.GOOS {
-	case "darwin":
-		// macOS: use sw_vers command
-		cmd := exec.Command("sw_vers")
-		output, err := cmd.Output()
+// openSuggestionCache opens the suggestion cache and computes the key for the
+// current request from the provider, model, prompt, exact input and a
+// normalized fingerprint of the context
+func (r *fetchRequest) openSuggestionCache(prompt, contextInfo string) (*pkg.SuggestionCache, string) {
+	ttl := 10 * time.Minute
+	if ttlStr := r.getenv("SMART_SUGGESTION_CACHE_TTL"); ttlStr != "" {
+		parsed, err := time.ParseDuration(ttlStr)
 		if err != nil {
-			return "", fmt.Errorf("failed to run sw_vers: %w", err)
+			if r.debug {
+				logDebug("Invalid SMART_SUGGESTION_CACHE_TTL, using default", map[string]any{
+					"error": err.Error(),
+					"ttl":   ttl.String(),
+				})
+			}
+		} else {
+			ttl = parsed
 		}
+	}
+	if ttl <= 0 {
+		return nil, ""
+	}
 
-		// Process output similar to: $(sw_vers | xargs | sed 's/ /./g')
-		lines := strings.Split(strings.TrimSpace(string(output)), "\n")
-		var parts []string
-		for _, line := range lines {
-			parts = append(parts, strings.ReplaceAll(line, " ", "."))
+	cache, err := pkg.NewSuggestionCache(ttl)
+	if err != nil {
+		if r.debug {
+			logDebug("Failed to open suggestion cache", map[string]any{
+				"error": err.Error(),
+			})
 		}
-		return fmt.Sprintf("Your system is %s.", strings.Join(parts, ".")), nil
+		return nil, ""
+	}
+
+	key := pkg.SuggestionCacheKey(
+		strings.ToLower(r.provider),
+		r.modelName(strings.ToLower(r.provider)),
+		prompt,
+		// Completions are appended to the input as typed, so it is not normalized
+		r.input,
+		pkg.NormalizeContext(contextInfo),
+	)
+	return cache, key
+}
 
+// modelName returns the model used for the provider, from the environment
+// or the provider's default
+func (r *fetchRequest) modelName(provider string) string {
+	switch provider {
+	case "openai":
+		return "gpt-4o-mini"
+	case "azure_openai":
+		return r.getenv("AZURE_OPENAI_DEPLOYMENT_NAME")
+	case "anthropic":
+		return "claude-3-5-sonnet-20241022"
+	case "gemini":
+		if model := r.getenv("GEMINI_MODEL"); model != "" {
+			return model
+		}
+		return "gemini-2.5-flash"
+	case "deepseek":
+		if model := r.getenv("DEEPSEEK_MODEL"); model != "" {
+			return model
+		}
+		return "deepseek-chat" // Default to deepseek-chat which points to DeepSeek-V3-0324
 	default:
-		// Linux and others: read /etc/*-release files
-		releaseFiles := []string{"/etc/os-release", "/etc/lsb-release", "/etc/redhat-release"}
-		var content []string
+		return ""
+	}
+}
 
-		for _, file := range releaseFiles {
-			data, err := os.ReadFile(file)
-			if err == nil {
-				content = append(content, string(data))
+// runCacheClear handles the cache clear command
+func runCacheClear(cmd *cobra.Command, args []string) {
+	cache, err := pkg.NewSuggestionCache(0)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error opening suggestion cache: %v\n", err)
+		os.Exit(1)
+	}
+
+	removed, err := cache.Clear()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error clearing suggestion cache: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Removed %d cached suggestions\n", removed)
+}
+
+// runCacheStats handles the cache stats command
+func runCacheStats(cmd *cobra.Command, args []string) {
+	cache, err := pkg.NewSuggestionCache(0)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error opening suggestion cache: %v\n", err)
+		os.Exit(1)
+	}
+
+	stats := cache.Stats()
+	fmt.Printf("Entries: %d (%d bytes)\n", stats.Entries, stats.Bytes)
+	fmt.Printf("Hits: %d\n", stats.Hits)
+	fmt.Printf("Misses: %d\n", stats.Misses)
+}
+
+// daemonRequestTimeout bounds how long the daemon may take to answer a request
+const daemonRequestTimeout = 2 * time.Minute
+
+// fetchFromDaemon asks a running daemon for the suggestion. served is false
+// when no daemon could be reached, so the caller fetches in-process.
+func (r *fetchRequest) fetchFromDaemon() (suggestion string, served bool, err error) {
+	if noDaemon {
+		return "", false, nil
+	}
+
+	socketPath := pkg.DaemonSocketPath()
+	// The daemon runs elsewhere, relative paths are resolved here
+	logFile := r.logFile
+	if logFile != "" {
+		logFile, _ = filepath.Abs(logFile)
+	}
+	suggestion, err = pkg.QueryDaemon(socketPath, pkg.DaemonRequest{
+		Command: "suggest",
+		Suggest: &pkg.SuggestionRequest{
+			Provider:      r.provider,
+			Input:         r.input,
+			SystemPrompt:  r.systemPrompt,
+			Context:       r.sendContext,
+			NoCache:       r.noCache,
+			LocalFallback: r.localFallback,
+			Debug:         r.debug,
+			LogFile:       logFile,
+			Autosuggest:   r.autosuggest,
+			History:       r.history,
+			Cwd:           r.cwd,
+			Env:           r.environ(),
+			TTY:           r.ttyName(),
+		},
+	}, daemonRequestTimeout)
+
+	var daemonErr *pkg.DaemonError
+	switch {
+	case err == nil:
+		if r.debug {
+			logDebug("Fetched suggestion from daemon", map[string]any{
+				"socket":     socketPath,
+				"suggestion": suggestion,
+			})
+		}
+		return suggestion, true, nil
+	case errors.As(err, &daemonErr):
+		return "", true, err
+	default:
+		if r.debug && !errors.Is(err, pkg.ErrDaemonNotRunning) {
+			logDebug("Failed to query daemon, fetching in-process", map[string]any{
+				"socket": socketPath,
+				"error":  err.Error(),
+			})
+		}
+		return "", false, nil
+	}
+}
+
+// runDaemon handles the daemon command
+func runDaemon(cmd *cobra.Command, args []string) {
+	socketPath := pkg.DaemonSocketPath()
+	started := time.Now()
+	var suggestions atomic.Int64
+
+	var server *pkg.DaemonServer
+	server, err := pkg.NewDaemonServer(socketPath, daemonRequestTimeout, func(ctx context.Context, request pkg.DaemonRequest) (string, error) {
+		switch request.Command {
+		case "suggest":
+			if request.Suggest == nil {
+				return "", fmt.Errorf("suggest request without parameters")
 			}
+			suggestions.Add(1)
+			return serveDaemonSuggestion(ctx, request.Suggest)
+		case "status":
+			return fmt.Sprintf("pid %d, up %s, %d suggestions served", os.Getpid(),
+				pkg.FormatAge(time.Since(started)), suggestions.Load()), nil
+		case "stop":
+			// Answer before the socket goes away
+			time.AfterFunc(100*time.Millisecond, func() { server.Close() })
+			return "stopping", nil
+		default:
+			return "", fmt.Errorf("unknown command: %s", request.Command)
 		}
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error starting daemon: %v\n", err)
+		os.Exit(1)
+	}
 
-		if len(content) == 0 {
-			return "", fmt.Errorf("no release files found")
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	go func() {
+		<-sigChan
+		server.Close()
+	}()
+
+	go warmDaemonCaches()
+
+	if debug {
+		logDebug("Daemon started", map[string]any{
+			"socket": socketPath,
+			"pid":    os.Getpid(),
+		})
+	}
+	fmt.Printf("Smart Suggestion daemon listening on %s\n", socketPath)
+	server.Serve()
+}
+
+// warmDaemonCaches collects the static context and loads the indexes of the
+// shell history before the first request needs them. The proxy logs differ
+// between callers, the first request of each adds its own.
+func warmDaemonCaches() {
+	cachedStaticContext("system", getSystemInfo)
+	cachedStaticContext("id", getUserID)
+	cachedStaticContext("uname", getUnameInfo)
+	historyFiles := pkg.DefaultHistoryFiles(os.Getenv("HISTFILE"))
+	if _, err := pkg.LoadHistoryIndex(historyFiles, nil); err != nil && debug {
+		logDebug("Failed to load history index", map[string]any{
+			"error": err.Error(),
+		})
+	}
+	pkg.LoadLocalEngine(historyFiles, nil, nil, nil)
+}
+
+// serveDaemonSuggestion fetches a suggestion in the daemon as the calling
+// shell would have. Requests carry all their state, so they are served
+// concurrently.
+func serveDaemonSuggestion(ctx context.Context, request *pkg.SuggestionRequest) (string, error) {
+	r, err := newDaemonFetchRequest(ctx, request)
+	if err != nil {
+		return "", err
+	}
+	return r.fetchSuggestion()
+}
+
+// runDaemonStatus handles the daemon status command
+func runDaemonStatus(cmd *cobra.Command, args []string) {
+	status, err := pkg.QueryDaemon(pkg.DaemonSocketPath(), pkg.DaemonRequest{Command: "status"}, 5*time.Second)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error querying daemon: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Println(status)
+}
+
+// runDaemonStop handles the daemon stop command
+func runDaemonStop(cmd *cobra.Command, args []string) {
+	if _, err := pkg.QueryDaemon(pkg.DaemonSocketPath(), pkg.DaemonRequest{Command: "stop"}, 5*time.Second); err != nil {
+		fmt.Fprintf(os.Stderr, "Error stopping daemon: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Println("Daemon stopped")
+}
+
+// runPause handles the pause command
+func runPause(cmd *cobra.Command, args []string) {
+	toggle, _ := cmd.Flags().GetBool("toggle")
+	pause := true
+	if toggle {
+		if status, err := setProxyRecording("status"); err == nil && status != "recording" {
+			pause = false
 		}
+	}
+	if !pause {
+		runResume(cmd, args)
+		return
+	}
 
-		// Process similar to: $(cat /etc/*-release | xargs | sed 's/ /,/g')
-		allContent := strings.Join(content, " ")
-		processedContent := strings.ReplaceAll(strings.TrimSpace(allContent), " ", ",")
-		return fmt.Sprintf("Your system is %s.", processedContent), nil
+	status, err := setProxyRecording("pause")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error pausing recording: %v\n", err)
+		os.Exit(1)
 	}
+	fmt.Printf("Recording %s\n", status)
 }
 
-// getUserID gets user ID information
-func getUserID() (string, error) {
-	cmd := exec.Command("id")
-	output, err := cmd.Output()
+// runResume handles the resume command
+func runResume(cmd *cobra.Command, args []string) {
+	status, err := setProxyRecording("resume")
 	if err != nil {
-		return "", fmt.Errorf("failed to run id command: %w", err)
+		fmt.Fprintf(os.Stderr, "Error resuming recording: %v\n", err)
+		os.Exit(1)
 	}
-	return strings.TrimSpace(string(output)), nil
+	if status == "recording" {
+		status = "resumed"
+	}
+	fmt.Printf("Recording %s\n", status)
 }
 
-func fetchGemini() (string, error) {
-	apiKey := os.Getenv("GEMINI_API_KEY")
-	if apiKey == "" {
-		return "", fmt.Errorf("GEMINI_API_KEY environment variable is not set")
+// setProxyRecording sends a pause, resume or status command to the proxy of
+// the current session. It uses the session socket and falls back to signaling
+// the proxy process, in which case the resulting status is not known.
+func setProxyRecording(command string) (string, error) {
+	currentSessionID := os.Getenv("SMART_SUGGESTION_SESSION_ID")
+	proxyPID := os.Getenv("SMART_SUGGESTION_PROXY_ACTIVE")
+	if currentSessionID == "" && proxyPID == "" {
+		return "", fmt.Errorf("not inside a proxy session")
 	}
 
-	baseURL := os.Getenv("GEMINI_BASE_URL")
-	if baseURL == "" {
-		baseURL = "https://generativelanguage.googleapis.com"
+	if currentSessionID != "" {
+		status, err := pkg.QuerySession(getSessionSocketFile(currentSessionID), command, nil, time.Second)
+		if err == nil {
+			return status, nil
+		}
+		if debug {
+			logDebug("Failed to query session socket", map[string]any{
+				"error":      err.Error(),
+				"command":    command,
+				"session_id": currentSessionID,
+			})
+		}
+	}
+
+	signals := map[string]syscall.Signal{"pause": syscall.SIGUSR1, "resume": syscall.SIGUSR2}
+	sig, ok := signals[command]
+	if !ok {
+		return "", fmt.Errorf("session socket is not available")
+	}
+	pid, err := strconv.Atoi(proxyPID)
+	if err != nil {
+		return "", fmt.Errorf("invalid proxy PID %q", proxyPID)
+	}
+	// The environment outlives the proxy, e.g. in a tmux server or a nohup'd
+	// job, and SIGUSR1 would kill whatever process reused its PID
+	if !proxyHoldsSessionLock(currentSessionID, pid) {
+		return "", fmt.Errorf("proxy %d is no longer running", pid)
+	}
+	if err := syscall.Kill(pid, sig); err != nil {
+		return "", fmt.Errorf("failed to signal proxy: %w", err)
+	}
+	if command == "pause" {
+		return "paused", nil
+	}
+	return "resumed", nil
+}
+
+// proxyHoldsSessionLock reports whether the proxy with pid still runs the
+// session: its lock file names pid and is locked
+func proxyHoldsSessionLock(sessionID string, pid int) bool {
+	if sessionID == "" {
+		return false
+	}
+	file, err := os.Open(getSessionBasedLockFile("/tmp/smart-suggestion-proxy.lock", sessionID))
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return false
+	}
+	line, _, _ := strings.Cut(string(data), "\n")
+	if lockPID, err := strconv.Atoi(strings.TrimSpace(line)); err != nil || lockPID != pid {
+		return false
+	}
+
+	// Getting the lock means nobody holds it anymore
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_SH|syscall.LOCK_NB); err == nil {
+		syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+		return false
+	}
+	return true
+}
+
+func (r *fetchRequest) fetchOpenAI() (string, error) {
+	apiKey := r.getenv("OPENAI_API_KEY")
+	if apiKey == "" {
+		return "", fmt.Errorf("OPENAI_API_KEY environment variable is not set")
 	}
 
-	model := os.Getenv("GEMINI_MODEL")
-	if model == "" {
-		model = "gemini-2.5-flash"
+	baseURL := r.getenv("OPENAI_BASE_URL")
+	if baseURL == "" {
+		baseURL = "https://api.openai.com"
 	}
 
 	// Handle different base URL formats
@@ -968,35 +1968,15 @@ func fetchGemini() (string, error) {
 	if strings.HasPrefix(baseURL, "http://") || strings.HasPrefix(baseURL, "https://") {
 		// Base URL already includes protocol
 		baseURL = strings.TrimSuffix(baseURL, "/")
-		url = fmt.Sprintf("%s/v1beta/models/%s:generateContent?key=%s", baseURL, model, apiKey)
+		url = fmt.Sprintf("%s/v1/chat/completions", baseURL)
 	} else {
 		// Base URL is just hostname, add https protocol
-		url = fmt.Sprintf("https://%s/v1beta/models/%s:generateContent?key=%s", baseURL, model, apiKey)
-	}
-
-	// Gemini API expects a different format - system prompt and user input are combined
-	var contents []GeminiContent
-
-	// Add system prompt as user message (Gemini doesn't have separate system role)
-	if systemPrompt != "" {
-		contents = append(contents, GeminiContent{
-			Parts: []GeminiPart{{Text: systemPrompt}},
-			Role:  "user",
-		})
-		contents = append(contents, GeminiContent{
-			Parts: []GeminiPart{{Text: "I understand. I'll follow these instructions."}},
-			Role:  "model",
-		})
+		url = fmt.Sprintf("https://%s/v1/chat/completions", baseURL)
 	}
 
-	// Add user input
-	contents = append(contents, GeminiContent{
-		Parts: []GeminiPart{{Text: input}},
-		Role:  "user",
-	})
-
-	request := GeminiRequest{
-		Contents: contents,
+	request := OpenAIRequest{
+		Model:    r.modelName("openai"),
+		Messages: r.openAIMessages(),
 	}
 
 	jsonData, err := json.Marshal(request)
@@ -1004,22 +1984,22 @@ func fetchGemini() (string, error) {
 		return "", fmt.Errorf("failed to marshal request: %w", err)
 	}
 
-	if debug {
-		logDebug("Sending Gemini request", map[string]any{
+	if r.debug {
+		logDebug("Sending OpenAI request", map[string]any{
 			"url":     url,
 			"request": string(jsonData),
 		})
 	}
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
+	req, err := http.NewRequestWithContext(r.ctx, "POST", url, bytes.NewBuffer(jsonData))
 	if err != nil {
 		return "", fmt.Errorf("failed to create request: %w", err)
 	}
 
 	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+apiKey)
 
-	client := &http.Client{Timeout: 30 * time.Second}
-	resp, err := client.Do(req)
+	resp, err := httpClient.Do(req)
 	if err != nil {
 		return "", fmt.Errorf("failed to send request: %w", err)
 	}
@@ -1030,8 +2010,8 @@ func fetchGemini() (string, error) {
 		return "", fmt.Errorf("failed to read response: %w", err)
 	}
 
-	if debug {
-		logDebug("Received Gemini response", map[string]any{
+	if r.debug {
+		logDebug("Received OpenAI response", map[string]any{
 			"status":   resp.Status,
 			"response": string(body),
 		})
@@ -1041,574 +2021,2224 @@ func fetchGemini() (string, error) {
 		return "", fmt.Errorf("API request failed with status %d: %s", resp.StatusCode, string(body))
 	}
 
-	var response GeminiResponse
+	var response OpenAIResponse
 	if err := json.Unmarshal(body, &response); err != nil {
 		return "", fmt.Errorf("failed to unmarshal response: %w", err)
 	}
 
 	if response.Error != nil {
-		return "", fmt.Errorf("Gemini API error: %s", response.Error.Message)
-	}
-
-	if len(response.Candidates) == 0 {
-		return "", fmt.Errorf("no candidates returned from Gemini API")
+		return "", fmt.Errorf("OpenAI API error: %s", response.Error.Message)
 	}
 
-	if len(response.Candidates[0].Content.Parts) == 0 {
-		return "", fmt.Errorf("no content parts returned from Gemini API")
+	if len(response.Choices) == 0 {
+		return "", fmt.Errorf("no choices returned from OpenAI API")
 	}
 
-	return response.Candidates[0].Content.Parts[0].Text, nil
+	return response.Choices[0].Message.Content, nil
 }
 
-// getUnameInfo gets uname information
-func getUnameInfo() (string, error) {
-	cmd := exec.Command("uname", "-a")
-	output, err := cmd.Output()
-	if err != nil {
-		return "", fmt.Errorf("failed to run uname command: %w", err)
+func (r *fetchRequest) fetchAzureOpenAI() (string, error) {
+	apiKey := r.getenv("AZURE_OPENAI_API_KEY")
+	if apiKey == "" {
+		return "", fmt.Errorf("AZURE_OPENAI_API_KEY environment variable is not set")
 	}
-	return strings.TrimSpace(string(output)), nil
-}
 
-// getAliases gets shell aliases
-func getAliases() (string, error) {
-	// Try to get aliases using the alias command
-	cmd := exec.Command("alias")
-	output, err := cmd.Output()
-	if err != nil {
-		return "", fmt.Errorf("failed to get aliases: %w", err)
+	// Get deployment name - required for both custom and standard URLs
+	deploymentName := r.getenv("AZURE_OPENAI_DEPLOYMENT_NAME")
+	if deploymentName == "" {
+		return "", fmt.Errorf("AZURE_OPENAI_DEPLOYMENT_NAME environment variable is not set")
 	}
 
-	// No need to escape quotes here as Go handles JSON encoding properly
-	return strings.TrimSpace(string(output)), nil
-}
+	// Check if custom base URL is provided
+	baseURL := r.getenv("AZURE_OPENAI_BASE_URL")
+	var url string
 
-func getShellHistory() (string, error) {
-	// Get the number of lines to fetch
-	numLinesStr := os.Getenv("SMART_SUGGESTION_HISTORY_LINES")
-	if numLinesStr == "" {
-		numLinesStr = "10"
-	}
+	if baseURL != "" {
+		// Custom base URL provided - use it directly
+		apiVersion := r.getenv("AZURE_OPENAI_API_VERSION")
+		if apiVersion == "" {
+			apiVersion = "2024-10-21" // Default to latest stable version
+		}
 
-	cmd := exec.Command("fc", "-ln", fmt.Sprintf("-%s", numLinesStr))
-	output, err := cmd.Output()
-	if err != nil {
-		return "", fmt.Errorf("failed to run history command: %w", err)
-	}
-	return strings.TrimSpace(string(output)), nil
-}
+		// Handle different base URL formats
+		if strings.HasPrefix(baseURL, "http://") || strings.HasPrefix(baseURL, "https://") {
+			// Base URL already includes protocol
+			baseURL = strings.TrimSuffix(baseURL, "/")
+			url = fmt.Sprintf("%s/openai/deployments/%s/chat/completions?api-version=%s", baseURL, deploymentName, apiVersion)
+		} else {
+			// Base URL is just hostname, add https protocol
+			url = fmt.Sprintf("https://%s/openai/deployments/%s/chat/completions?api-version=%s", baseURL, deploymentName, apiVersion)
+		}
+	} else {
+		// Standard Azure OpenAI format - requires resource name and deployment name
+		resourceName := r.getenv("AZURE_OPENAI_RESOURCE_NAME")
+		if resourceName == "" {
+			return "", fmt.Errorf("AZURE_OPENAI_RESOURCE_NAME environment variable is not set")
+		}
 
-// createProcessLock creates a lock file to prevent duplicate processes
-func createProcessLock(lockPath string) (*os.File, error) {
-	// Create directory if it doesn't exist
-	dir := filepath.Dir(lockPath)
-	if err := os.MkdirAll(dir, 0755); err != nil {
-		return nil, fmt.Errorf("failed to create lock directory: %w", err)
+		// API version for Azure OpenAI
+		apiVersion := r.getenv("AZURE_OPENAI_API_VERSION")
+		if apiVersion == "" {
+			apiVersion = "2024-10-21" // Default to latest stable version
+		}
+
+		// Azure OpenAI endpoint format
+		url = fmt.Sprintf("https://%s.openai.azure.com/openai/deployments/%s/chat/completions?api-version=%s",
+			resourceName, deploymentName, apiVersion)
 	}
 
-	// Try to create and lock the file
-	file, err := os.OpenFile(lockPath, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0644)
-	if err != nil {
-		if os.IsExist(err) {
-			// Check if the process is still running
-			if isProcessRunning(lockPath) {
-				return nil, fmt.Errorf("another instance is already running")
-			}
-			// Remove stale lock file
-			os.Remove(lockPath)
-			// Try again
-			file, err = os.OpenFile(lockPath, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0644)
-			if err != nil {
-				return nil, fmt.Errorf("failed to create lock file: %w", err)
-			}
-		} else {
-			return nil, fmt.Errorf("failed to create lock file: %w", err)
-		}
+	request := AzureOpenAIRequest{
+		Model:    deploymentName, // In Azure OpenAI, this should match the deployment name
+		Messages: r.openAIMessages(),
 	}
 
-	// Try to acquire an exclusive lock
-	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
-		file.Close()
-		os.Remove(lockPath)
-		return nil, fmt.Errorf("failed to acquire lock: %w", err)
+	jsonData, err := json.Marshal(request)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal request: %w", err)
 	}
 
-	// Write PID to the lock file
-	pid := os.Getpid()
-	if _, err := file.WriteString(fmt.Sprintf("%d\n", pid)); err != nil {
-		file.Close()
-		os.Remove(lockPath)
-		return nil, fmt.Errorf("failed to write PID to lock file: %w", err)
+	if r.debug {
+		logDebug("Sending Azure OpenAI request", map[string]any{
+			"url":        url,
+			"deployment": deploymentName,
+			"request":    string(jsonData),
+		})
 	}
 
-	if err := file.Sync(); err != nil {
-		file.Close()
-		os.Remove(lockPath)
-		return nil, fmt.Errorf("failed to sync lock file: %w", err)
+	req, err := http.NewRequestWithContext(r.ctx, "POST", url, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return "", fmt.Errorf("failed to create request: %w", err)
 	}
 
-	return file, nil
-}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("api-key", apiKey) // Azure OpenAI uses "api-key" header
 
-// isProcessRunning checks if the process in the lock file is still running
-func isProcessRunning(lockPath string) bool {
-	data, err := os.ReadFile(lockPath)
+	resp, err := httpClient.Do(req)
 	if err != nil {
-		return false
+		return "", fmt.Errorf("failed to send request: %w", err)
 	}
+	defer resp.Body.Close()
 
-	pidStr := strings.TrimSpace(string(data))
-	pid, err := strconv.Atoi(pidStr)
+	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return false
+		return "", fmt.Errorf("failed to read response: %w", err)
 	}
 
-	// Check if process is running by sending signal 0
-	process, err := os.FindProcess(pid)
-	if err != nil {
-		return false
+	if r.debug {
+		logDebug("Received Azure OpenAI response", map[string]any{
+			"status":   resp.Status,
+			"response": string(body),
+		})
 	}
 
-	err = process.Signal(syscall.Signal(0))
-	return err == nil
-}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("API request failed with status %d: %s", resp.StatusCode, string(body))
+	}
 
-// cleanupProcessLock removes the lock file and closes the file handle
-func cleanupProcessLock(file *os.File, lockPath string) {
-	if file != nil {
-		syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
-		file.Close()
+	var response AzureOpenAIResponse
+	if err := json.Unmarshal(body, &response); err != nil {
+		return "", fmt.Errorf("failed to unmarshal response: %w", err)
 	}
-	os.Remove(lockPath)
-}
 
-// generateSessionID generates a unique session ID
-func generateSessionID() (string, error) {
-	// Generate random bytes
-	randomBytes := make([]byte, 8)
-	if _, err := rand.Read(randomBytes); err != nil {
-		return "", fmt.Errorf("failed to generate random bytes: %w", err)
+	if response.Error != nil {
+		return "", fmt.Errorf("Azure OpenAI API error: %s", response.Error.Message)
 	}
 
-	// Create session ID with PID and timestamp for uniqueness
-	pid := os.Getpid()
-	timestamp := time.Now().Unix()
-	randomHex := hex.EncodeToString(randomBytes)
+	if len(response.Choices) == 0 {
+		return "", fmt.Errorf("no choices returned from Azure OpenAI API")
+	}
 
-	sessionID := fmt.Sprintf("%d_%d_%s", pid, timestamp, randomHex)
-	return sessionID, nil
+	return response.Choices[0].Message.Content, nil
 }
 
-// getSessionBasedLogFile returns the session-specific log file path
-func getSessionBasedLogFile(baseLogFile, sessionID string) string {
-	if sessionID == "" {
-		return baseLogFile
+// openAIMessages returns the system prompt, the conversation so far and the
+// user input as OpenAI messages
+func (r *fetchRequest) openAIMessages() []OpenAIMessage {
+	messages := []OpenAIMessage{{Role: "system", Content: r.systemPrompt}}
+	for _, turn := range r.history {
+		messages = append(messages, OpenAIMessage{Role: turn.Role, Content: turn.Content})
 	}
+	return append(messages, OpenAIMessage{Role: "user", Content: r.input})
+}
 
-	// Extract directory and base filename
-	dir := filepath.Dir(baseLogFile)
-	base := filepath.Base(baseLogFile)
-
-	// Remove extension if present
-	ext := filepath.Ext(base)
-	if ext != "" {
-		base = strings.TrimSuffix(base, ext)
+// anthropicMessages returns the conversation so far and the user input as
+// Anthropic messages
+func (r *fetchRequest) anthropicMessages() []AnthropicMessage {
+	var messages []AnthropicMessage
+	for _, turn := range r.history {
+		messages = append(messages, AnthropicMessage{Role: turn.Role, Content: turn.Content})
 	}
-
-	// Create session-specific filename
-	sessionLogFile := fmt.Sprintf("%s.%s%s", base, sessionID, ext)
-	return filepath.Join(dir, sessionLogFile)
+	return append(messages, AnthropicMessage{Role: "user", Content: r.input})
 }
 
-// getSessionBasedLockFile returns the session-specific lock file path
-func getSessionBasedLockFile(baseLockFile, sessionID string) string {
-	if sessionID == "" {
-		return baseLockFile
+func (r *fetchRequest) fetchAnthropic() (string, error) {
+	apiKey := r.getenv("ANTHROPIC_API_KEY")
+	if apiKey == "" {
+		return "", fmt.Errorf("ANTHROPIC_API_KEY environment variable is not set")
 	}
 
-	dir := filepath.Dir(baseLockFile)
-	base := filepath.Base(baseLockFile)
-	ext := filepath.Ext(base)
-	if ext != "" {
-		base = strings.TrimSuffix(base, ext)
+	baseURL := r.getenv("ANTHROPIC_BASE_URL")
+	if baseURL == "" {
+		baseURL = "https://api.anthropic.com"
 	}
 
-	sessionLockFile := fmt.Sprintf("%s.%s%s", base, sessionID, ext)
-	return filepath.Join(dir, sessionLockFile)
-}
-
-// getCurrentSessionID gets the current session ID from environment or generates one
-func getCurrentSessionID() string {
-	// Try to get from environment variable first
-	if sessionID := os.Getenv("SMART_SUGGESTION_SESSION_ID"); sessionID != "" {
-		return sessionID
+	// Handle different base URL formats
+	var url string
+	if strings.HasPrefix(baseURL, "http://") || strings.HasPrefix(baseURL, "https://") {
+		// Base URL already includes protocol
+		baseURL = strings.TrimSuffix(baseURL, "/")
+		url = fmt.Sprintf("%s/v1/messages", baseURL)
+	} else {
+		// Base URL is just hostname, add https protocol
+		url = fmt.Sprintf("https://%s/v1/messages", baseURL)
 	}
 
-	// Try to get from TTY device name
-	if ttyName := getTTYName(); ttyName != "" {
-		return ttyName
+	request := AnthropicRequest{
+		Model:     r.modelName("anthropic"),
+		MaxTokens: 1000,
+		System:    r.systemPrompt,
+		Messages:  r.anthropicMessages(),
 	}
 
-	// Generate a new one based on PID
-	return fmt.Sprintf("pid_%d", os.Getpid())
-}
+	jsonData, err := json.Marshal(request)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal request: %w", err)
+	}
 
-// getTTYName gets the current TTY device name for session identification
-func getTTYName() string {
-	// Try to get TTY name from various sources
-	if tty := os.Getenv("TTY"); tty != "" {
-		// Extract just the device name
-		if parts := strings.Split(tty, "/"); len(parts) > 0 {
-			return strings.ReplaceAll(parts[len(parts)-1], ".", "_")
-		}
+	if r.debug {
+		logDebug("Sending Anthropic request", map[string]any{
+			"url":     url,
+			"request": string(jsonData),
+		})
 	}
 
-	// Try to get from tty command
-	cmd := exec.Command("tty")
-	output, err := cmd.Output()
-	if err == nil {
-		ttyPath := strings.TrimSpace(string(output))
-		if parts := strings.Split(ttyPath, "/"); len(parts) > 0 {
-			deviceName := parts[len(parts)-1]
-			// Replace special characters to make it filesystem-safe
-			deviceName = strings.ReplaceAll(deviceName, ".", "_")
-			deviceName = strings.ReplaceAll(deviceName, ":", "_")
-			return deviceName
-		}
+	req, err := http.NewRequestWithContext(r.ctx, "POST", url, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return "", fmt.Errorf("failed to create request: %w", err)
 	}
 
-	return ""
-}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("x-api-key", apiKey)
+	req.Header.Set("anthropic-version", "2023-06-01")
 
-// cleanupOldSessionLogs removes old session log files
-func cleanupOldSessionLogs(baseLogPath string, maxAge time.Duration) error {
-	dir := filepath.Dir(baseLogPath)
-	base := filepath.Base(baseLogPath)
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
 
-	// Remove extension for pattern matching
-	ext := filepath.Ext(base)
-	if ext != "" {
-		base = strings.TrimSuffix(base, ext)
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed to read response: %w", err)
 	}
 
-	// Pattern to match session log files
-	pattern := fmt.Sprintf("%s.*%s", base, ext)
+	if r.debug {
+		logDebug("Received Anthropic response", map[string]any{
+			"status":   resp.Status,
+			"response": string(body),
+		})
+	}
 
-	entries, err := os.ReadDir(dir)
-	if err != nil {
-		return fmt.Errorf("failed to read directory %s: %w", dir, err)
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("API request failed with status %d: %s", resp.StatusCode, string(body))
 	}
 
-	cutoff := time.Now().Add(-maxAge)
-	var removedFiles []string
+	var response AnthropicResponse
+	if err := json.Unmarshal(body, &response); err != nil {
+		return "", fmt.Errorf("failed to unmarshal response: %w", err)
+	}
 
-	for _, entry := range entries {
-		if entry.IsDir() {
-			continue
+	if response.Type == "error" || response.Error != nil {
+		errorMsg := "unknown error"
+		if response.Error != nil {
+			errorMsg = response.Error.Message
 		}
+		return "", fmt.Errorf("Anthropic API error: %s", errorMsg)
+	}
 
-		filename := entry.Name()
-		// Check if this looks like a session log file
-		if matched, _ := filepath.Match(pattern, filename); !matched {
-			continue
-		}
+	if len(response.Content) == 0 {
+		return "", fmt.Errorf("no content returned from Anthropic API")
+	}
 
-		// Skip the base file itself
-		if filename == filepath.Base(baseLogPath) {
-			continue
-		}
+	return response.Content[0].Text, nil
+}
 
-		fullPath := filepath.Join(dir, filename)
-		info, err := os.Stat(fullPath)
+// writeToLogFile writes content to a log file with automatic rotation
+func writeToLogFile(logFilePath, content string) error {
+	// Check and rotate log file if necessary
+	if err := logRotator.CheckAndRotate(logFilePath); err != nil {
+		log.Printf("Failed to rotate log file: %v", err)
+		// Continue with logging even if rotation fails
+	}
+
+	file, err := os.OpenFile(logFilePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open log file: %w", err)
+	}
+	defer file.Close()
+
+	_, err = file.WriteString(content + "\n")
+	return err
+}
+
+func logDebug(message string, data map[string]any) {
+	logFilePath := "/tmp/smart-suggestion.log"
+
+	logEntry := map[string]any{
+		"date": time.Now().Format(time.RFC3339),
+		"log":  message,
+	}
+
+	for k, v := range data {
+		logEntry[k] = v
+	}
+
+	jsonData, err := json.Marshal(logEntry)
+	if err != nil {
+		log.Printf("Failed to marshal debug log: %v", err)
+		return
+	}
+
+	if err := writeToLogFile(logFilePath, string(jsonData)); err != nil {
+		log.Printf("Failed to write debug log: %v", err)
+	}
+}
+
+// buildContextInfo builds context information similar to the zsh plugin
+func (r *fetchRequest) buildContextInfo() (string, error) {
+	var contextParts []string
+
+	// Get user information
+	currentUser := r.getenv("USER")
+	if currentUser == "" {
+		currentUser = "unknown"
+	}
+
+	// Get current directory
+	currentDir := r.cwd
+	if currentDir == "" {
+		currentDir = "unknown"
+	}
+
+	// Get shell information
+	shell := r.getenv("SHELL")
+	if shell == "" {
+		shell = "unknown"
+	}
+
+	// Get terminal information
+	term := r.getenv("TERM")
+	if term == "" {
+		term = "unknown"
+	}
+
+	// Get system information
+	systemInfo, err := cachedStaticContext("system", getSystemInfo)
+	if err != nil {
+		if r.debug {
+			logDebug("Failed to get system info", map[string]any{
+				"error": err.Error(),
+			})
+		}
+		systemInfo = "unknown system"
+	}
+
+	// Get user ID information
+	userID, err := cachedStaticContext("id", getUserID)
+	if err != nil {
+		if r.debug {
+			logDebug("Failed to get user ID", map[string]any{
+				"error": err.Error(),
+			})
+		}
+		userID = "unknown"
+	}
+
+	// Get uname information
+	unameInfo, err := cachedStaticContext("uname", getUnameInfo)
+	if err != nil {
+		if r.debug {
+			logDebug("Failed to get uname info", map[string]any{
+				"error": err.Error(),
+			})
+		}
+		unameInfo = "unknown"
+	}
+
+	// Build the basic context
+	basicContext := fmt.Sprintf("# Context:\nYou are user %s with id %s in directory %s. Your shell is %s and your terminal is %s running on %s. %s",
+		currentUser, userID, currentDir, shell, term, unameInfo, systemInfo)
+	contextParts = append(contextParts, basicContext)
+
+	// Get aliases
+	aliases, err := r.getAliases()
+	if err != nil {
+		if r.debug {
+			logDebug("Failed to get aliases", map[string]any{
+				"error": err.Error(),
+			})
+		}
+	} else {
+		contextParts = append(contextParts, "\n# This is the alias defined in your shell:\n", aliases)
+	}
+
+	shellHistory, err := r.getShellHistory()
+	if err != nil {
+		if r.debug {
+			logDebug("Failed to get shell history", map[string]any{
+				"error": err.Error(),
+			})
+		}
+	} else {
+		contextParts = append(contextParts, "\n# Shell history:\n", shellHistory)
+	}
+
+	// Get the commands recorded by the proxy with their exit codes
+	sessionCommands, err := r.getRecentSessionCommands(5)
+	if err != nil {
+		if r.debug {
+			logDebug("Failed to get recorded session commands", map[string]any{
+				"error": err.Error(),
+			})
+		}
+	} else if sessionCommands != "" {
+		contextParts = append(contextParts, "\n# Recent commands in this session (oldest first):\n", sessionCommands)
+	}
+
+	// Get tmux buffer content if available
+	shellBuffer, err := r.getShellBuffer()
+	if err != nil {
+		if r.debug {
+			logDebug("Failed to get shell buffer", map[string]any{
+				"error": err.Error(),
+			})
+		}
+	} else {
+		contextParts = append(contextParts, "\n# Shell buffer:\n", shellBuffer)
+	}
+
+	// Get the other panes of the tmux window, if enabled
+	if r.getenv("TMUX") != "" && r.getenv("SMART_SUGGESTION_TMUX_SIBLING_PANES") == "true" {
+		siblingPanes, err := r.getTmuxSiblingPanes()
+		if err != nil {
+			if r.debug {
+				logDebug("Failed to get sibling tmux panes", map[string]any{
+					"error": err.Error(),
+				})
+			}
+		} else if siblingPanes != "" {
+			contextParts = append(contextParts, "\n# Other panes in this tmux window (may explain errors or state, but commands run here):\n", siblingPanes)
+		}
+	}
+
+	// Get the latest output of the user's other terminals, if enabled
+	if r.getenv("SMART_SUGGESTION_OTHER_SESSIONS") == "true" {
+		otherSessions, err := r.getOtherSessionsOutput()
+		if err != nil {
+			if r.debug {
+				logDebug("Failed to get output of other sessions", map[string]any{
+					"error": err.Error(),
+				})
+			}
+		} else if otherSessions != "" {
+			contextParts = append(contextParts, "\n# Latest output in the user's other terminals (may explain errors or state, but commands run here):\n", otherSessions)
+		}
+	}
+
+	// Get past commands relevant to the input and buffer from the full history
+	relevantHistory, err := r.getRelevantHistory(r.input, shellBuffer)
+	if err != nil {
+		if r.debug {
+			logDebug("Failed to get relevant past commands", map[string]any{
+				"error": err.Error(),
+			})
+		}
+	} else if relevantHistory != "" {
+		contextParts = append(contextParts, "\n# Relevant past commands:\n", relevantHistory)
+	}
+
+	// Get the most relevant snippets from the team runbooks, if configured
+	if docsDir := r.path(r.getenv("SMART_SUGGESTION_DOCS_DIR")); docsDir != "" {
+		runbookSnippets, err := r.getRunbookSnippets(docsDir, r.input, shellBuffer)
+		if err != nil {
+			if r.debug {
+				logDebug("Failed to get runbook snippets", map[string]any{
+					"error":    err.Error(),
+					"docs_dir": docsDir,
+				})
+			}
+		} else if runbookSnippets != "" {
+			contextParts = append(contextParts, "\n# Relevant snippets from the team runbooks (prefer these conventions and commands):\n", runbookSnippets)
+		}
+	}
+
+	// Get the man page or --help snippet for the command being typed
+	if r.getenv("SMART_SUGGESTION_COMMAND_HELP") != "false" {
+		helpConfig := pkg.DefaultCommandHelpConfig()
+		if r.env != nil {
+			helpConfig.Env = r.environ()
+		}
+		commandHelp, err := pkg.GetCommandHelp(r.input, helpConfig)
+		if err != nil {
+			if r.debug {
+				logDebug("Failed to get command help", map[string]any{
+					"error": err.Error(),
+					"input": r.input,
+				})
+			}
+		} else {
+			if r.debug {
+				logDebug("Using command help", map[string]any{
+					"command": commandHelp.Title(),
+					"source":  commandHelp.Source,
+				})
+			}
+			contextParts = append(contextParts,
+				fmt.Sprintf("\n# Help for the command being typed (%s, from `%s`), only use flags that exist here:\n", commandHelp.Title(), commandHelp.Source),
+				commandHelp.Text)
+		}
+	}
+
+	return strings.Join(contextParts, ""), nil
+}
+
+// staticContext memoizes context parts that don't change while the process
+// runs, so the daemon collects them only once
+var (
+	staticContextMutex sync.Mutex
+	staticContext      = make(map[string]string)
+)
+
+// cachedStaticContext returns the memoized result of get
+func cachedStaticContext(name string, get func() (string, error)) (string, error) {
+	staticContextMutex.Lock()
+	defer staticContextMutex.Unlock()
+	if value, ok := staticContext[name]; ok {
+		return value, nil
+	}
+	value, err := get()
+	if err != nil {
+		return "", err
+	}
+	staticContext[name] = value
+	return value, nil
+}
+
+// getSystemInfo gets system information similar to the zsh plugin
+func getSystemInfo() (string, error) {
+	switch runtime.GOOS {
+	case "darwin":
+		// macOS: use sw_vers command
+		cmd := exec.Command("sw_vers")
+		output, err := cmd.Output()
+		if err != nil {
+			return "", fmt.Errorf("failed to run sw_vers: %w", err)
+		}
+
+		// Process output similar to: $(sw_vers | xargs | sed 's/ /./g')
+		lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+		var parts []string
+		for _, line := range lines {
+			parts = append(parts, strings.ReplaceAll(line, " ", "."))
+		}
+		return fmt.Sprintf("Your system is %s.", strings.Join(parts, ".")), nil
+
+	default:
+		// Linux and others: read /etc/*-release files
+		releaseFiles := []string{"/etc/os-release", "/etc/lsb-release", "/etc/redhat-release"}
+		var content []string
+
+		for _, file := range releaseFiles {
+			data, err := os.ReadFile(file)
+			if err == nil {
+				content = append(content, string(data))
+			}
+		}
+
+		if len(content) == 0 {
+			return "", fmt.Errorf("no release files found")
+		}
+
+		// Process similar to: $(cat /etc/*-release | xargs | sed 's/ /,/g')
+		allContent := strings.Join(content, " ")
+		processedContent := strings.ReplaceAll(strings.TrimSpace(allContent), " ", ",")
+		return fmt.Sprintf("Your system is %s.", processedContent), nil
+	}
+}
+
+// getUserID gets user ID information
+func getUserID() (string, error) {
+	cmd := exec.Command("id")
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to run id command: %w", err)
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+func (r *fetchRequest) fetchGemini() (string, error) {
+	apiKey := r.getenv("GEMINI_API_KEY")
+	if apiKey == "" {
+		return "", fmt.Errorf("GEMINI_API_KEY environment variable is not set")
+	}
+
+	baseURL := r.getenv("GEMINI_BASE_URL")
+	if baseURL == "" {
+		baseURL = "https://generativelanguage.googleapis.com"
+	}
+
+	model := r.modelName("gemini")
+
+	// Handle different base URL formats
+	var url string
+	if strings.HasPrefix(baseURL, "http://") || strings.HasPrefix(baseURL, "https://") {
+		// Base URL already includes protocol
+		baseURL = strings.TrimSuffix(baseURL, "/")
+		url = fmt.Sprintf("%s/v1beta/models/%s:generateContent?key=%s", baseURL, model, apiKey)
+	} else {
+		// Base URL is just hostname, add https protocol
+		url = fmt.Sprintf("https://%s/v1beta/models/%s:generateContent?key=%s", baseURL, model, apiKey)
+	}
+
+	// Gemini API expects a different format - system prompt and user input are combined
+	var contents []GeminiContent
+
+	// Add system prompt as user message (Gemini doesn't have separate system role)
+	if r.systemPrompt != "" {
+		contents = append(contents, GeminiContent{
+			Parts: []GeminiPart{{Text: r.systemPrompt}},
+			Role:  "user",
+		})
+		contents = append(contents, GeminiContent{
+			Parts: []GeminiPart{{Text: "I understand. I'll follow these instructions."}},
+			Role:  "model",
+		})
+	}
+
+	// Add the conversation so far and the user input
+	for _, turn := range r.history {
+		role := turn.Role
+		if role == "assistant" {
+			role = "model"
+		}
+		contents = append(contents, GeminiContent{
+			Parts: []GeminiPart{{Text: turn.Content}},
+			Role:  role,
+		})
+	}
+	contents = append(contents, GeminiContent{
+		Parts: []GeminiPart{{Text: r.input}},
+		Role:  "user",
+	})
+
+	request := GeminiRequest{
+		Contents: contents,
+	}
+
+	jsonData, err := json.Marshal(request)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	if r.debug {
+		logDebug("Sending Gemini request", map[string]any{
+			"url":     url,
+			"request": string(jsonData),
+		})
+	}
+
+	req, err := http.NewRequestWithContext(r.ctx, "POST", url, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return "", fmt.Errorf("failed to create request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed to read response: %w", err)
+	}
+
+	if r.debug {
+		logDebug("Received Gemini response", map[string]any{
+			"status":   resp.Status,
+			"response": string(body),
+		})
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("API request failed with status %d: %s", resp.StatusCode, string(body))
+	}
+
+	var response GeminiResponse
+	if err := json.Unmarshal(body, &response); err != nil {
+		return "", fmt.Errorf("failed to unmarshal response: %w", err)
+	}
+
+	if response.Error != nil {
+		return "", fmt.Errorf("Gemini API error: %s", response.Error.Message)
+	}
+
+	if len(response.Candidates) == 0 {
+		return "", fmt.Errorf("no candidates returned from Gemini API")
+	}
+
+	if len(response.Candidates[0].Content.Parts) == 0 {
+		return "", fmt.Errorf("no content parts returned from Gemini API")
+	}
+
+	return response.Candidates[0].Content.Parts[0].Text, nil
+}
+
+// getUnameInfo gets uname information
+func getUnameInfo() (string, error) {
+	cmd := exec.Command("uname", "-a")
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to run uname command: %w", err)
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// getAliases gets shell aliases
+func (r *fetchRequest) getAliases() (string, error) {
+	// Try to get aliases using the alias command
+	cmd := r.command("alias")
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to get aliases: %w", err)
+	}
+
+	// No need to escape quotes here as Go handles JSON encoding properly
+	return strings.TrimSpace(string(output)), nil
+}
+
+func (r *fetchRequest) getShellHistory() (string, error) {
+	// Get the number of lines to fetch
+	numLinesStr := r.getenv("SMART_SUGGESTION_HISTORY_LINES")
+	if numLinesStr == "" {
+		numLinesStr = "10"
+	}
+
+	cmd := r.command("fc", "-ln", fmt.Sprintf("-%s", numLinesStr))
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to run history command: %w", err)
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// getRecentSessionCommands returns a summary of the last commands recorded by
+// the proxy for the current session, including whether they failed
+func (r *fetchRequest) getRecentSessionCommands(n int) (string, error) {
+	currentSessionID := r.currentSessionID()
+	if currentSessionID == "" || r.logFile == "" {
+		return "", fmt.Errorf("no proxy session")
+	}
+
+	recordFile := pkg.GetSessionRecordFile(getSessionBasedLogFile(r.logFile, currentSessionID))
+	records, err := pkg.ReadCommandRecords(recordFile)
+	if err != nil {
+		return "", err
+	}
+	if len(records) > n {
+		records = records[len(records)-n:]
+	}
+	return pkg.FormatCommandRecords(records), nil
+}
+
+// getOtherSessionsOutput returns the latest rendered output of the user's other
+// active proxy sessions, each labeled with its terminal and directory
+func (r *fetchRequest) getOtherSessionsOutput() (string, error) {
+	const maxSessions = 3
+	numLines, err := r.envInt("SMART_SUGGESTION_OTHER_SESSIONS_LINES", 20)
+	if err != nil {
+		return "", err
+	}
+	if numLines <= 0 {
+		return "", nil
+	}
+
+	sessions, err := getSessionLayout(r.logFile).List()
+	if err != nil {
+		return "", err
+	}
+
+	currentSessionID := r.currentSessionID()
+	now := time.Now()
+	var parts []string
+	for i := range sessions {
+		session := &sessions[i]
+		if !session.Active || session.ID == currentSessionID || session.UID != os.Getuid() {
+			continue
+		}
+
+		data, err := readSessionOutput(session)
+		if err != nil {
+			continue
+		}
+		width, height := r.terminalSize()
+		lines := pkg.RenderTerminalOutput(data, width, height, 1000)
+		for len(lines) > 0 && strings.TrimSpace(lines[len(lines)-1]) == "" {
+			lines = lines[:len(lines)-1]
+		}
+		if len(lines) == 0 {
+			continue
+		}
+		if len(lines) > numLines {
+			lines = lines[len(lines)-numLines:]
+		}
+
+		// The last recorded command knows the current directory
+		cwd := session.Cwd
+		if records, err := pkg.ReadCommandRecords(session.Files.Records); err == nil && len(records) > 0 && records[len(records)-1].Cwd != "" {
+			cwd = records[len(records)-1].Cwd
+		}
+		label := session.TTY
+		if label == "" {
+			label = "session " + session.ID
+		}
+		if cwd != "" {
+			label += " in " + cwd
+		}
+		parts = append(parts, fmt.Sprintf("## Terminal %s (last output %s ago):\n%s",
+			label, pkg.FormatAge(now.Sub(session.LastActivity)), strings.Join(lines, "\n")))
+		if len(parts) == maxSessions {
+			break
+		}
+	}
+	return strings.Join(parts, "\n\n"), nil
+}
+
+// getRelevantHistory retrieves the past commands most similar to the current
+// input and shell buffer from a local BM25 index over the full shell history
+// and the rotated proxy logs
+func (r *fetchRequest) getRelevantHistory(input, shellBuffer string) (string, error) {
+	numResults, err := r.envInt("SMART_SUGGESTION_RELEVANT_HISTORY", 10)
+	if err != nil {
+		return "", err
+	}
+	if numResults <= 0 {
+		return "", nil
+	}
+
+	queryTerms := buildRetrievalQuery(input, shellBuffer)
+	if len(queryTerms) == 0 {
+		return "", nil
+	}
+
+	index, err := pkg.LoadHistoryIndex(r.historyFiles(), pkg.RotatedProxyLogFiles(r.logFile))
+	if err != nil {
+		return "", err
+	}
+
+	entries := index.Search(queryTerms, numResults)
+	if r.debug {
+		logDebug("Retrieved relevant past commands", map[string]any{
+			"indexed_commands": len(index.Entries),
+			"results":          len(entries),
+		})
+	}
+	return pkg.FormatHistoryEntries(entries, time.Now()), nil
+}
+
+// buildRetrievalQuery returns the search terms for the history and runbook
+// indexes: the input, weighted twice, and the most recent buffer lines
+func buildRetrievalQuery(input, shellBuffer string) []string {
+	queryTerms := pkg.Tokenize(input)
+	queryTerms = append(queryTerms, queryTerms...)
+	if shellBuffer != "" {
+		recentBuffer, _ := readLatestLines(shellBuffer, 20)
+		queryTerms = append(queryTerms, pkg.Tokenize(recentBuffer)...)
+	}
+	return queryTerms
+}
+
+// getRunbookSnippets retrieves the runbook sections most relevant to the current
+// input and shell buffer from a local BM25 index over the docs directory
+func (r *fetchRequest) getRunbookSnippets(docsDir, input, shellBuffer string) (string, error) {
+	numResults, err := r.envInt("SMART_SUGGESTION_DOCS_RESULTS", 3)
+	if err != nil {
+		return "", err
+	}
+	if numResults <= 0 {
+		return "", nil
+	}
+
+	queryTerms := buildRetrievalQuery(input, shellBuffer)
+	if len(queryTerms) == 0 {
+		return "", nil
+	}
+
+	index, err := pkg.LoadDocsIndex(docsDir)
+	if err != nil {
+		return "", err
+	}
+
+	chunks := index.Search(queryTerms, numResults)
+	if r.debug {
+		var references []string
+		for _, chunk := range chunks {
+			references = append(references, chunk.Reference())
+		}
+		logDebug("Retrieved runbook snippets", map[string]any{
+			"indexed_chunks": index.Len(),
+			"references":     references,
+		})
+	}
+	return pkg.FormatDocChunks(chunks, 6000), nil
+}
+
+// createProcessLock creates a lock file to prevent duplicate processes
+func createProcessLock(lockPath string) (*os.File, error) {
+	// Create directory if it doesn't exist
+	dir := filepath.Dir(lockPath)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create lock directory: %w", err)
+	}
+
+	// Try to create and lock the file
+	file, err := os.OpenFile(lockPath, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0644)
+	if err != nil {
+		if os.IsExist(err) {
+			// Check if the process is still running
+			if isProcessRunning(lockPath) {
+				return nil, fmt.Errorf("another instance is already running")
+			}
+			// Remove stale lock file
+			os.Remove(lockPath)
+			// Try again
+			file, err = os.OpenFile(lockPath, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0644)
+			if err != nil {
+				return nil, fmt.Errorf("failed to create lock file: %w", err)
+			}
+		} else {
+			return nil, fmt.Errorf("failed to create lock file: %w", err)
+		}
+	}
+
+	// Try to acquire an exclusive lock
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		file.Close()
+		os.Remove(lockPath)
+		return nil, fmt.Errorf("failed to acquire lock: %w", err)
+	}
+
+	// Write PID to the lock file
+	pid := os.Getpid()
+	if _, err := file.WriteString(fmt.Sprintf("%d\n", pid)); err != nil {
+		file.Close()
+		os.Remove(lockPath)
+		return nil, fmt.Errorf("failed to write PID to lock file: %w", err)
+	}
+
+	if err := file.Sync(); err != nil {
+		file.Close()
+		os.Remove(lockPath)
+		return nil, fmt.Errorf("failed to sync lock file: %w", err)
+	}
+
+	return file, nil
+}
+
+// isProcessRunning checks if the process in the lock file is still running
+func isProcessRunning(lockPath string) bool {
+	data, err := os.ReadFile(lockPath)
+	if err != nil {
+		return false
+	}
+
+	pidStr := strings.TrimSpace(string(data))
+	pid, err := strconv.Atoi(pidStr)
+	if err != nil {
+		return false
+	}
+
+	// Check if process is running by sending signal 0
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+
+	err = process.Signal(syscall.Signal(0))
+	return err == nil
+}
+
+// cleanupProcessLock removes the lock file and closes the file handle
+func cleanupProcessLock(file *os.File, lockPath string) {
+	if file != nil {
+		syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+		file.Close()
+	}
+	os.Remove(lockPath)
+}
+
+// generateSessionID generates a unique session ID
+func generateSessionID() (string, error) {
+	// Generate random bytes
+	randomBytes := make([]byte, 8)
+	if _, err := rand.Read(randomBytes); err != nil {
+		return "", fmt.Errorf("failed to generate random bytes: %w", err)
+	}
+
+	// Create session ID with PID and timestamp for uniqueness
+	pid := os.Getpid()
+	timestamp := time.Now().Unix()
+	randomHex := hex.EncodeToString(randomBytes)
+
+	sessionID := fmt.Sprintf("%d_%d_%s", pid, timestamp, randomHex)
+	return sessionID, nil
+}
+
+// getSessionBasedLogFile returns the session-specific log file path
+func getSessionBasedLogFile(baseLogFile, sessionID string) string {
+	if sessionID == "" {
+		return baseLogFile
+	}
+
+	// Extract directory and base filename
+	dir := filepath.Dir(baseLogFile)
+	base := filepath.Base(baseLogFile)
+
+	// Remove extension if present
+	ext := filepath.Ext(base)
+	if ext != "" {
+		base = strings.TrimSuffix(base, ext)
+	}
+
+	// Create session-specific filename
+	sessionLogFile := fmt.Sprintf("%s.%s%s", base, sessionID, ext)
+	return filepath.Join(dir, sessionLogFile)
+}
+
+// getSessionBasedLockFile returns the session-specific lock file path
+func getSessionBasedLockFile(baseLockFile, sessionID string) string {
+	if sessionID == "" {
+		return baseLockFile
+	}
+
+	dir := filepath.Dir(baseLockFile)
+	base := filepath.Base(baseLockFile)
+	ext := filepath.Ext(base)
+	if ext != "" {
+		base = strings.TrimSuffix(base, ext)
+	}
+
+	sessionLockFile := fmt.Sprintf("%s.%s%s", base, sessionID, ext)
+	return filepath.Join(dir, sessionLockFile)
+}
+
+// getSessionSocketFile returns the Unix socket path of a proxy session
+func getSessionSocketFile(sessionID string) string {
+	return getSessionBasedLockFile("/tmp/smart-suggestion-proxy.sock", sessionID)
+}
+
+// currentSessionID gets the current session ID from environment or generates one
+func (r *fetchRequest) currentSessionID() string {
+	// Try to get from environment variable first
+	if sessionID := r.getenv("SMART_SUGGESTION_SESSION_ID"); sessionID != "" {
+		return sessionID
+	}
+
+	// Try to get from TTY device name
+	if ttyName := r.ttyName(); ttyName != "" {
+		return ttyName
+	}
+
+	// Generate a new one based on PID
+	return fmt.Sprintf("pid_%d", os.Getpid())
+}
+
+// getTTYName gets the current TTY device name for session identification
+func getTTYName() string {
+	// Try to get TTY name from various sources
+	if tty := os.Getenv("TTY"); tty != "" {
+		// Extract just the device name
+		if parts := strings.Split(tty, "/"); len(parts) > 0 {
+			return strings.ReplaceAll(parts[len(parts)-1], ".", "_")
+		}
+	}
+
+	// Try to get from tty command
+	cmd := exec.Command("tty")
+	output, err := cmd.Output()
+	if err == nil {
+		ttyPath := strings.TrimSpace(string(output))
+		if parts := strings.Split(ttyPath, "/"); len(parts) > 0 {
+			deviceName := parts[len(parts)-1]
+			// Replace special characters to make it filesystem-safe
+			deviceName = strings.ReplaceAll(deviceName, ".", "_")
+			deviceName = strings.ReplaceAll(deviceName, ":", "_")
+			return deviceName
+		}
+	}
+
+	return ""
+}
+
+// getSessionLayout returns where the proxy sessions logging to logFile keep
+// their files
+func getSessionLayout(logFile string) pkg.SessionLayout {
+	return pkg.SessionLayout{
+		LogFile:    logFile,
+		LockFile:   "/tmp/smart-suggestion-proxy.lock",
+		SocketFile: "/tmp/smart-suggestion-proxy.sock",
+	}
+}
+
+// getSessionPrunePolicy returns the session prune policy configured through
+// SMART_SUGGESTION_SESSION_MAX_AGE and SMART_SUGGESTION_SESSION_MAX_SIZE
+func getSessionPrunePolicy() pkg.SessionPrunePolicy {
+	policy := pkg.SessionPrunePolicy{MaxAge: 24 * time.Hour, MaxSize: 100 * 1024 * 1024}
+	if value := os.Getenv("SMART_SUGGESTION_SESSION_MAX_AGE"); value != "" {
+		if maxAge, err := time.ParseDuration(value); err == nil {
+			policy.MaxAge = maxAge
+		}
+	}
+	if value := os.Getenv("SMART_SUGGESTION_SESSION_MAX_SIZE"); value != "" {
+		if maxSize, err := pkg.ParseSizeString(value); err == nil {
+			policy.MaxSize = maxSize
+		}
+	}
+	return policy
+}
+
+// findSession returns the session with the given ID or ID prefix, or the
+// current session if args is empty
+func findSession(args []string) (*pkg.SessionInfo, error) {
+	if len(args) > 0 {
+		return getSessionLayout(proxyLogFile).Find(args[0])
+	}
+	currentSessionID := os.Getenv("SMART_SUGGESTION_SESSION_ID")
+	if currentSessionID == "" {
+		return nil, fmt.Errorf("not inside a proxy session, pass a session ID")
+	}
+	session := getSessionLayout(proxyLogFile).Session(currentSessionID)
+	return &session, nil
+}
+
+// readSessionOutput returns the recent raw output of a session, from its
+// socket while it is active and from its log file otherwise
+func readSessionOutput(session *pkg.SessionInfo) ([]byte, error) {
+	if session.Active {
+		data, err := pkg.QuerySession(session.Files.Socket, "buffer", nil, time.Second)
+		if err == nil {
+			return []byte(data), nil
+		}
+		if debug {
+			logDebug("Failed to query session socket", map[string]any{
+				"error":      err.Error(),
+				"session_id": session.ID,
+			})
+		}
+	}
+	return readFileTail(session.Files.Log, 1024*1024)
+}
+
+// runSessionsList handles the sessions list command
+func runSessionsList(cmd *cobra.Command, args []string) {
+	sessions, err := getSessionLayout(proxyLogFile).List()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error listing sessions: %v\n", err)
+		os.Exit(1)
+	}
+	if len(sessions) == 0 {
+		fmt.Println("No proxy sessions found")
+		return
+	}
+
+	currentSessionID := os.Getenv("SMART_SUGGESTION_SESSION_ID")
+	now := time.Now()
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "  ID\tSTATE\tPID\tTTY\tSIZE\tAGE\tIDLE\tCOMMAND")
+	for _, session := range sessions {
+		marker := " "
+		if session.ID == currentSessionID {
+			marker = "*"
+		}
+		state := "ended"
+		if session.Active {
+			state = "active"
+		} else if _, err := os.Stat(session.Files.Lock); err == nil {
+			// The proxy exited without removing its lock
+			state = "dead"
+		}
+		fmt.Fprintf(w, "%s %s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			marker, session.ID, state, formatOptionalInt(session.PID), valueOrDash(session.TTY),
+			pkg.FormatSize(session.Size), pkg.FormatAge(now.Sub(session.StartTime)),
+			pkg.FormatAge(now.Sub(session.LastActivity)), valueOrDash(strings.Join(session.Command, " ")))
+	}
+	w.Flush()
+}
+
+// runSessionsShow handles the sessions show command
+func runSessionsShow(cmd *cobra.Command, args []string) {
+	session, err := findSession(args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	state := "ended"
+	if session.Active {
+		state = "active"
+	}
+	fmt.Printf("Session:  %s\n", session.ID)
+	fmt.Printf("State:    %s\n", state)
+	fmt.Printf("PID:      %s\n", formatOptionalInt(session.PID))
+	fmt.Printf("TTY:      %s\n", valueOrDash(session.TTY))
+	fmt.Printf("Command:  %s\n", valueOrDash(strings.Join(session.Command, " ")))
+	fmt.Printf("Cwd:      %s\n", valueOrDash(session.Cwd))
+	fmt.Printf("Started:  %s\n", session.StartTime.Format(time.RFC3339))
+	fmt.Printf("Activity: %s\n", session.LastActivity.Format(time.RFC3339))
+	fmt.Printf("Size:     %s\n", pkg.FormatSize(session.Size))
+	fmt.Printf("Log:      %s\n", session.Files.Log)
+
+	if records, err := pkg.ReadCommandRecords(session.Files.Records); err == nil && len(records) > 0 {
+		if len(records) > 10 {
+			records = records[len(records)-10:]
+		}
+		fmt.Printf("\nRecent commands:\n%s\n", pkg.FormatCommandRecords(records))
+	}
+
+	if data, err := readSessionOutput(session); err == nil {
+		width, height := getTerminalSize()
+		fmt.Printf("\nOutput:\n%s\n", renderProxyContent(data, width, height))
+	}
+}
+
+// runSessionsTail handles the sessions tail command
+func runSessionsTail(cmd *cobra.Command, args []string) {
+	lines, _ := cmd.Flags().GetInt("lines")
+	follow, _ := cmd.Flags().GetBool("follow")
+
+	session, err := findSession(args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	data, err := readSessionOutput(session)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading session output: %v\n", err)
+		os.Exit(1)
+	}
+	width, height := getTerminalSize()
+	rendered := pkg.RenderTerminalOutput(data, width, height, 1000)
+	if lines > 0 && len(rendered) > lines {
+		rendered = rendered[len(rendered)-lines:]
+	}
+	fmt.Println(strings.Join(rendered, "\n"))
+
+	if follow {
+		if err := followSessionLog(session); err != nil {
+			fmt.Fprintf(os.Stderr, "Error following session: %v\n", err)
+			os.Exit(1)
+		}
+	}
+}
+
+// followSessionLog copies output appended to the session log to stdout until
+// the session ends
+func followSessionLog(session *pkg.SessionInfo) error {
+	file, err := os.Open(session.Files.Log)
+	if err != nil {
+		return fmt.Errorf("session has no log file to follow: %w", err)
+	}
+	defer file.Close()
+	if _, err := file.Seek(0, io.SeekEnd); err != nil {
+		return fmt.Errorf("failed to seek session log: %w", err)
+	}
+
+	for {
+		if _, err := io.Copy(os.Stdout, file); err != nil {
+			return fmt.Errorf("failed to read session log: %w", err)
+		}
+		if _, err := os.Stat(session.Files.Lock); err != nil {
+			return nil
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+}
+
+// runSessionsPrune handles the sessions prune command
+func runSessionsPrune(cmd *cobra.Command, args []string) {
+	policy := getSessionPrunePolicy()
+	if value, _ := cmd.Flags().GetString("max-age"); value != "" {
+		maxAge, err := time.ParseDuration(value)
 		if err != nil {
-			continue
+			fmt.Fprintf(os.Stderr, "Invalid max age: %v\n", err)
+			os.Exit(1)
+		}
+		policy.MaxAge = maxAge
+	}
+	if value, _ := cmd.Flags().GetString("max-size"); value != "" {
+		maxSize, err := pkg.ParseSizeString(value)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid max size: %v\n", err)
+			os.Exit(1)
+		}
+		policy.MaxSize = maxSize
+	}
+	dryRun, _ := cmd.Flags().GetBool("dry-run")
+
+	pruned, pruneErr := getSessionLayout(proxyLogFile).Prune(policy, dryRun)
+
+	var freed int64
+	for _, session := range pruned {
+		freed += session.Size
+		fmt.Printf("%s  %s  idle %s\n", session.ID, pkg.FormatSize(session.Size), pkg.FormatAge(time.Since(session.LastActivity)))
+	}
+	verb := "Removed"
+	if dryRun {
+		verb = "Would remove"
+	}
+	fmt.Printf("%s %d sessions (%s)\n", verb, len(pruned), pkg.FormatSize(freed))
+	if pruneErr != nil {
+		fmt.Fprintf(os.Stderr, "Error pruning sessions: %v\n", pruneErr)
+		os.Exit(1)
+	}
+}
+
+// runSessionsExport handles the sessions export command
+func runSessionsExport(cmd *cobra.Command, args []string) {
+	format, _ := cmd.Flags().GetString("format")
+	outputPath, _ := cmd.Flags().GetString("output")
+
+	session, err := findSession(args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	var out io.Writer = os.Stdout
+	if outputPath != "" {
+		file, err := os.Create(outputPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error creating output file: %v\n", err)
+			os.Exit(1)
+		}
+		defer file.Close()
+		out = file
+	}
+
+	if err := exportSession(out, session, format); err != nil {
+		fmt.Fprintf(os.Stderr, "Error exporting session: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// exportSession writes a session in the given format
+func exportSession(out io.Writer, session *pkg.SessionInfo, format string) error {
+	// The asciicast header has the size the session was recorded at
+	width, height := getTerminalSize()
+	header, _, castErr := pkg.ReadAsciicast(session.Files.Cast)
+	if castErr == nil {
+		width, height = header.Width, header.Height
+	}
+
+	if format == "asciicast" && castErr == nil {
+		file, err := os.Open(session.Files.Cast)
+		if err != nil {
+			return fmt.Errorf("failed to open recording: %w", err)
+		}
+		defer file.Close()
+		_, err = io.Copy(out, file)
+		return err
+	}
+
+	// Use the whole log, or the in-memory buffer of sessions without one
+	output, err := os.ReadFile(session.Files.Log)
+	if err != nil {
+		if output, err = readSessionOutput(session); err != nil {
+			return fmt.Errorf("session has no recorded output: %w", err)
+		}
+	}
+
+	switch format {
+	case "asciicast":
+		// Sessions recorded without timestamps become a single event
+		return pkg.WriteAsciicast(out, pkg.AsciicastHeader{
+			Width:     width,
+			Height:    height,
+			Timestamp: session.StartTime.Unix(),
+			Title:     strings.Join(session.Command, " "),
+		}, output)
+	case "text", "html":
+		records, _ := pkg.ReadCommandRecords(session.Files.Records)
+		export := pkg.NewSessionExport(session.SessionMeta, records, output, width)
+		if format == "text" {
+			return export.WriteText(out)
+		}
+		return export.WriteHTML(out)
+	default:
+		return fmt.Errorf("unsupported format %q (use asciicast, text or html)", format)
+	}
+}
+
+// runReplay handles the replay command
+func runReplay(cmd *cobra.Command, args []string) {
+	speed, _ := cmd.Flags().GetFloat64("speed")
+	maxIdle, _ := cmd.Flags().GetDuration("max-idle")
+	if speed <= 0 {
+		fmt.Fprintf(os.Stderr, "Error: speed must be positive\n")
+		os.Exit(1)
+	}
+
+	// Accept a recording file as well as a session
+	castFile := ""
+	if len(args) > 0 && strings.HasSuffix(args[0], ".cast") {
+		castFile = args[0]
+	} else {
+		session, err := findSession(args)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		castFile = session.Files.Cast
+	}
+
+	_, events, err := pkg.ReadAsciicast(castFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading recording: %v\n", err)
+		os.Exit(1)
+	}
+
+	last := 0.0
+	for _, event := range events {
+		delay := time.Duration((event.Time - last) / speed * float64(time.Second))
+		if maxIdle > 0 && delay > maxIdle {
+			delay = maxIdle
+		}
+		time.Sleep(delay)
+		last = event.Time
+		if event.Type == "o" {
+			os.Stdout.WriteString(event.Data)
+		}
+	}
+}
+
+func formatOptionalInt(value int) string {
+	if value == 0 {
+		return "-"
+	}
+	return strconv.Itoa(value)
+}
+
+func valueOrDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+// runProxy starts the shell proxy mode using PTY and exits with the shell's exit status
+func runProxy(cmd *cobra.Command, args []string) {
+	os.Exit(runProxySession(args))
+}
+
+// runProxySession runs the proxied shell, or the given command, and returns its
+// exit code. All cleanup, including restoring the terminal, happens in deferred
+// calls so that it runs on every return path.
+func runProxySession(command []string) int {
+	// Check if we're already inside a proxy session to prevent nesting. An
+	// explicit command is always recorded, in a session of its own.
+	if len(command) == 0 && os.Getenv("SMART_SUGGESTION_PROXY_ACTIVE") != "" {
+		if debug {
+			logDebug("Already inside a proxy session, preventing nesting", map[string]any{
+				"existing_proxy_pid": os.Getenv("SMART_SUGGESTION_PROXY_ACTIVE"),
+			})
+		}
+		return 0
+	}
+
+	// Generate or get session ID
+	if sessionID == "" {
+		// Auto-generate session ID if not provided
+		generatedID, err := generateSessionID()
+		if err != nil {
+			if debug {
+				logDebug("Failed to generate session ID", map[string]any{
+					"error": err.Error(),
+				})
+			}
+			fmt.Fprintf(os.Stderr, "Failed to generate session ID: %v\n", err)
+			return 1
+		}
+		sessionID = generatedID
+	}
+
+	// Create session-based file paths
+	sessionLogFile := getSessionBasedLogFile(proxyLogFile, sessionID)
+	sessionLockFile := getSessionBasedLockFile("/tmp/smart-suggestion-proxy.lock", sessionID)
+
+	// Create a lock file to prevent duplicate proxy processes for this session
+	lockFile, err := createProcessLock(sessionLockFile)
+	if err != nil {
+		if debug {
+			logDebug("Failed to create process lock", map[string]any{
+				"error":      err.Error(),
+				"lock_path":  sessionLockFile,
+				"session_id": sessionID,
+			})
+		}
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+
+	// Ensure cleanup on exit
+	defer cleanupProcessLock(lockFile, sessionLockFile)
+
+	// Set environment variables for child processes
+	os.Setenv("SMART_SUGGESTION_SESSION_ID", sessionID)
+	// Set proxy active flag with current PID to prevent nesting
+	os.Setenv("SMART_SUGGESTION_PROXY_ACTIVE", fmt.Sprintf("%d", os.Getpid()))
+	// The plugin tags its markers with the nonce, so those of the user's own
+	// terminal integration are passed through
+	nonceBytes := make([]byte, 8)
+	if _, err := rand.Read(nonceBytes); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to generate marker nonce: %v\n", err)
+		return 1
+	}
+	markerNonce := hex.EncodeToString(nonceBytes)
+	os.Setenv(pkg.MarkerNonceEnv, markerNonce)
+
+	// Clean up the files of ended sessions
+	pruned, err := getSessionLayout(proxyLogFile).Prune(getSessionPrunePolicy(), false)
+	if err != nil && debug {
+		// Continue even if cleanup fails
+		logDebug("Failed to prune some old sessions", map[string]any{
+			"error": err.Error(),
+		})
+	}
+	if len(pruned) > 0 && debug {
+		logDebug("Pruned old sessions", map[string]any{
+			"count": len(pruned),
+		})
+	}
+
+	if debug {
+		logDebug("Starting shell proxy mode with PTY", map[string]any{
+			"log_file":   sessionLogFile,
+			"lock_file":  sessionLockFile,
+			"session_id": sessionID,
+			"pid":        os.Getpid(),
+		})
+	}
+
+	// Get the user's shell, default to bash if not set
+	recordCommand := len(command) > 0
+	if !recordCommand {
+		shell := os.Getenv("SHELL")
+		if shell == "" {
+			shell = "/bin/bash"
+		}
+		command = []string{shell}
+	}
+
+	// Use pipes instead of a PTY when asked to, or when there is no terminal
+	// at all (e.g. in CI)
+	noTTY := proxyNoTTY || (!term.IsTerminal(int(os.Stdin.Fd())) && !term.IsTerminal(int(os.Stdout.Fd())))
+
+	// Describe the session for "smart-suggestion sessions"
+	sessionMeta := pkg.SessionMeta{
+		ID:        sessionID,
+		PID:       os.Getpid(),
+		TTY:       pkg.TerminalName(os.Stdin),
+		Command:   command,
+		StartTime: time.Now(),
+	}
+	sessionMeta.Cwd, _ = os.Getwd()
+	if err := pkg.WriteSessionMeta(pkg.GetSessionMetaFile(sessionLogFile), sessionMeta); err != nil && debug {
+		logDebug("Failed to write session metadata", map[string]any{
+			"error":      err.Error(),
+			"session_id": sessionID,
+		})
+	}
+
+	// Open the structured command record file written from the shell
+	// integration markers emitted by the plugin
+	sessionRecordFile := pkg.GetSessionRecordFile(sessionLogFile)
+	recordFile, err := os.OpenFile(sessionRecordFile, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		if debug {
+			logDebug("Failed to open session record file", map[string]any{
+				"error":       err.Error(),
+				"record_file": sessionRecordFile,
+				"session_id":  sessionID,
+			})
+		}
+		fmt.Fprintf(os.Stderr, "Failed to open session record file: %v\n", err)
+		return 1
+	}
+	defer recordFile.Close()
+	recorder := pkg.NewSessionRecorder(recordFile)
+
+	// Keep recent output in memory and serve it over the session socket
+	bufferSize, err := pkg.ParseSizeString(proxyBufferSize)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid buffer size: %v\n", err)
+		return 1
+	}
+	outputBuffer := pkg.NewRingBuffer(int(bufferSize))
+
+	sessionSocketFile := getSessionSocketFile(sessionID)
+	sessionServer, err := pkg.NewSessionServer(sessionSocketFile)
+	if err != nil {
+		if debug {
+			logDebug("Failed to start session socket", map[string]any{
+				"error":       err.Error(),
+				"socket_file": sessionSocketFile,
+				"session_id":  sessionID,
+			})
+		}
+		// Continue without the socket, the log file is still available
+	} else {
+		sessionServer.Handle("buffer", func(args []string) (string, error) {
+			return string(outputBuffer.Bytes()), nil
+		})
+		go sessionServer.Serve()
+		defer sessionServer.Close()
+	}
+
+	// try to delete session log file if it exists
+	if _, err := os.Stat(sessionLogFile); err == nil {
+		if err := os.Remove(sessionLogFile); err != nil {
+			if debug {
+				logDebug("Failed to delete session log file", map[string]any{
+					"error":      err.Error(),
+					"log_file":   sessionLogFile,
+					"session_id": sessionID,
+				})
+			}
+			fmt.Fprintf(os.Stderr, "Failed to delete session log file: %v\n", err)
+			return 1
+		}
+	}
+
+	// Open session log file for writing, unless output is only kept in memory
+	var logWriter io.Writer = io.Discard
+	if !noDiskLog {
+		logFile, err := os.OpenFile(sessionLogFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			if debug {
+				logDebug("Failed to open session log file", map[string]any{
+					"error":      err.Error(),
+					"log_file":   sessionLogFile,
+					"session_id": sessionID,
+				})
+			}
+			fmt.Fprintf(os.Stderr, "Failed to open session log file: %v\n", err)
+			return 1
+		}
+		defer logFile.Close()
+		logWriter = logFile
+	}
+
+	// Record a timestamped asciicast of the session for export and replay if
+	// asked to. It has everything shown in the terminal, so only the user can
+	// read it and it is capped in size.
+	var castWriter *pkg.AsciicastWriter
+	if proxyCast && !noDiskLog {
+		castMaxSize, err := pkg.ParseSizeString(proxyCastMaxSize)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid cast size: %v\n", err)
+			return 1
+		}
+		sessionCastFile := pkg.GetSessionCastFile(sessionLogFile)
+		// An existing file keeps its mode, so start from a new one
+		_ = os.Remove(sessionCastFile)
+		castFile, err := os.OpenFile(sessionCastFile, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			defer castFile.Close()
+			width, height, sizeErr := term.GetSize(int(os.Stdin.Fd()))
+			if sizeErr != nil {
+				width, height = getTerminalSize()
+			}
+			castWriter, err = pkg.NewAsciicastWriter(castFile, pkg.AsciicastHeader{
+				Width:  width,
+				Height: height,
+				Title:  quoteCommand(command),
+				Env:    map[string]string{"SHELL": os.Getenv("SHELL"), "TERM": os.Getenv("TERM")},
+			}, castMaxSize)
+		}
+		if err != nil && debug {
+			logDebug("Failed to start asciicast recording", map[string]any{
+				"error":     err.Error(),
+				"cast_file": sessionCastFile,
+			})
+		}
+	}
+
+	// Recording to the log file and buffer can be paused, explicitly or
+	// while a password prompt is reading input
+	recordingGate := pkg.NewRecordingGate(io.MultiWriter(logWriter, outputBuffer), recorder)
+	if sessionServer != nil {
+		sessionServer.Handle("pause", func(args []string) (string, error) {
+			recordingGate.SetPaused(true)
+			return recordingGate.Status(), nil
+		})
+		sessionServer.Handle("resume", func(args []string) (string, error) {
+			recordingGate.SetPaused(false)
+			return recordingGate.Status(), nil
+		})
+		sessionServer.Handle("status", func(args []string) (string, error) {
+			return recordingGate.Status(), nil
+		})
+	}
+
+	// Full-screen applications are recorded as a one-line summary instead of
+	// their redraws
+	altScreenFilter := pkg.NewAltScreenFilter(recordingGate, recorder.CurrentCommand)
+	defer altScreenFilter.Flush()
+
+	// The asciicast keeps full-screen applications for faithful replays, but
+	// honors pauses
+	var castOutput io.Writer = io.Discard
+	if castWriter != nil {
+		castOutput = recordingGate.Wrap(castWriter)
+	}
+
+	// Create a tee writer to write to both stdout and log file, with the
+	// shell integration markers stripped and recorded
+	teeWriter := pkg.NewMarkerFilter(io.MultiWriter(os.Stdout, altScreenFilter, castOutput), recorder, markerNonce)
+
+	// Record an explicit command as a single command of the session
+	if recordCommand {
+		if cwd, err := os.Getwd(); err == nil {
+			recorder.Marker("7;file://" + (&url.URL{Path: cwd}).EscapedPath())
+		}
+		recorder.Marker("633;E;" + pkg.EscapeMarkerValue(quoteCommand(command)))
+		recorder.Marker("133;C")
+	}
+
+	c := exec.Command(command[0], command[1:]...)
+	var ptmx *os.File
+	if noTTY {
+		// Output goes through pipes, stderr is kept separate from stdout.
+		// Nothing translates newlines like a terminal would, so do it for the
+		// recorded copy, which is rendered as terminal output.
+		c.Stdin = os.Stdin
+		c.Stdout = io.MultiWriter(os.Stdout, &crlfWriter{w: pkg.NewMarkerFilter(io.MultiWriter(recordingGate, castOutput), recorder, markerNonce)})
+		c.Stderr = io.MultiWriter(os.Stderr, &crlfWriter{w: pkg.NewMarkerFilter(io.MultiWriter(recordingGate, castOutput), recorder, markerNonce)})
+		if !term.IsTerminal(int(os.Stdin.Fd())) {
+			// Own process group so signals can be forwarded to the whole job
+			c.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+		}
+		if err := c.Start(); err != nil {
+			if debug {
+				logDebug("Failed to start command", map[string]any{
+					"error":   err.Error(),
+					"command": command,
+				})
+			}
+			fmt.Fprintf(os.Stderr, "Failed to start %s: %v\n", command[0], err)
+			return 1
+		}
+	} else {
+		// Start the command with a pty
+		ptmx, err = pty.Start(c)
+		if err != nil {
+			if debug {
+				logDebug("Failed to start PTY", map[string]any{
+					"error":   err.Error(),
+					"command": command,
+				})
+			}
+			fmt.Fprintf(os.Stderr, "Failed to start PTY: %v\n", err)
+			return 1
+		}
+		defer func() { _ = ptmx.Close() }()
+
+		// Handle pty size changes
+		ch := make(chan os.Signal, 1)
+		signal.Notify(ch, syscall.SIGWINCH)
+		go func() {
+			for range ch {
+				if err := pty.InheritSize(os.Stdin, ptmx); err != nil {
+					if debug {
+						logDebug("Error resizing pty", map[string]any{
+							"error": err.Error(),
+						})
+					}
+				}
+				if rows, cols, err := pty.Getsize(ptmx); err == nil {
+					recorder.SetWidth(cols)
+					if castWriter != nil && rows > 0 && cols > 0 {
+						_ = castWriter.Resize(cols, rows)
+					}
+				}
+			}
+		}()
+		ch <- syscall.SIGWINCH // Initial resize
+		defer func() { signal.Stop(ch); close(ch) }()
+
+		// Set stdin in raw mode to properly handle terminal input (only if it's a terminal)
+		var oldState *term.State
+		if term.IsTerminal(int(os.Stdin.Fd())) {
+			oldState, err = term.MakeRaw(int(os.Stdin.Fd()))
+			if err != nil {
+				if debug {
+					logDebug("Failed to set raw mode", map[string]any{
+						"error": err.Error(),
+					})
+				}
+				fmt.Fprintf(os.Stderr, "Failed to set raw mode: %v\n", err)
+				return 1
+			}
+			defer func() {
+				if oldState != nil {
+					_ = term.Restore(int(os.Stdin.Fd()), oldState)
+				}
+			}()
+		} else {
+			if debug {
+				logDebug("Stdin is not a terminal, skipping raw mode", map[string]any{
+					"stdin_fd": int(os.Stdin.Fd()),
+				})
+			}
 		}
+	}
+
+	// Forward signals to the shell's process group instead of exiting, the
+	// session ends when the shell does
+	sigCh := make(chan os.Signal, 4)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGCONT, syscall.SIGQUIT, syscall.SIGUSR1, syscall.SIGUSR2)
+	defer signal.Stop(sigCh)
+
+	// Reap the shell
+	waitCh := make(chan error, 1)
+	go func() {
+		waitCh <- c.Wait()
+	}()
+
+	outputDone := make(chan struct{})
+	if ptmx == nil {
+		// exec.Cmd.Wait copies all piped output before returning
+		close(outputDone)
+	} else {
+		// Copy from stdin to pty (user input). This may stay blocked in Read after
+		// the shell has exited, so the session does not wait for it.
+		go func() {
+			_, err := io.Copy(ptmx, os.Stdin)
+			if err != nil {
+				if debug {
+					logDebug("Error copying stdin to pty", map[string]any{
+						"error": err.Error(),
+					})
+				}
+				return
+			}
+			// Stdin reached EOF (e.g. a pipe), pass the EOF on to the shell.
+			// With the plugin's prompt markers it is sent while the shell is
+			// idle at a prompt, once per prompt in case the line editor
+			// discarded it while starting, so a running command that reads
+			// the terminal never gets it. Without markers it is sent once
+			// when the output pauses, like script(1) does.
+			sentPrompt := -1
+			for {
+				total := outputBuffer.Total()
+				select {
+				case <-outputDone:
+					return
+				case <-time.After(300 * time.Millisecond):
+				}
+				if outputBuffer.Total() != total || recordingGate.Paused() {
+					continue
+				}
+				prompts, atPrompt := recorder.PromptState()
+				if (prompts == 0 || atPrompt) && prompts != sentPrompt {
+					if _, err := ptmx.Write([]byte{4}); err != nil {
+						return
+					}
+					sentPrompt = prompts
+				}
+			}
+		}()
+
+		// Copy from pty to stdout and log file (shell output), checking
+		// before each write whether a password prompt turned off echo
+		go func() {
+			defer close(outputDone)
+			ptmxFd := int(ptmx.Fd())
+			buf := make([]byte, 32*1024)
+			for {
+				n, err := ptmx.Read(buf)
+				if n > 0 {
+					recordingGate.SetSensitive(pkg.SensitiveInput(ptmxFd))
+					_, _ = teeWriter.Write(buf[:n])
+				}
+				if err != nil {
+					if err != io.EOF && debug {
+						logDebug("Error copying pty to output", map[string]any{
+							"error": err.Error(),
+						})
+					}
+					return
+				}
+			}
+		}()
+	}
 
-		// Remove if older than cutoff
-		if info.ModTime().Before(cutoff) {
-			if err := os.Remove(fullPath); err == nil {
-				removedFiles = append(removedFiles, filename)
+	var waitErr error
+	for exited := false; !exited; {
+		select {
+		case waitErr = <-waitCh:
+			exited = true
+		case sig := <-sigCh:
+			// SIGUSR1 and SIGUSR2 pause and resume recording
+			if sig == syscall.SIGUSR1 || sig == syscall.SIGUSR2 {
+				recordingGate.SetPaused(sig == syscall.SIGUSR1)
+				if debug {
+					logDebug("Recording state changed by signal", map[string]any{
+						"status": recordingGate.Status(),
+					})
+				}
+				continue
+			}
+			if c.SysProcAttr == nil && ptmx == nil && (sig == syscall.SIGINT || sig == syscall.SIGQUIT) {
+				// The command shares our terminal's process group and got
+				// the keyboard signal already
+				continue
+			}
+			if debug {
+				logDebug("Forwarding signal to shell", map[string]any{
+					"signal": sig.String(),
+					"pid":    c.Process.Pid,
+				})
+			}
+			if err := syscall.Kill(-c.Process.Pid, sig.(syscall.Signal)); err != nil {
+				_ = c.Process.Signal(sig)
+			}
+			if sig == syscall.SIGTERM {
+				// Interactive shells ignore SIGTERM, follow up with the SIGHUP
+				// a closing terminal would send
+				_ = syscall.Kill(-c.Process.Pid, syscall.SIGHUP)
 			}
 		}
 	}
 
-	if len(removedFiles) > 0 && debug {
-		logDebug("Cleaned up old session logs", map[string]any{
-			"removed_files": removedFiles,
-			"base_path":     baseLogPath,
+	// Drain what the shell wrote before exiting; background jobs may keep
+	// the pty open, so don't wait for them
+	select {
+	case <-outputDone:
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	exitCode := exitCodeFromWaitError(waitErr)
+	if recordCommand {
+		recorder.Marker(fmt.Sprintf("133;D;%d", exitCode))
+	}
+	if debug {
+		logDebug("Proxy session completed", map[string]any{
+			"log_file":  sessionLogFile,
+			"command":   command,
+			"no_tty":    noTTY,
+			"exit_code": exitCode,
 		})
 	}
+	return exitCode
+}
 
-	return nil
+// crlfWriter translates "\n" to "\r\n", as a terminal in cooked mode does
+type crlfWriter struct {
+	w      io.Writer
+	lastCR bool
 }
 
-// runProxy starts the shell proxy mode using PTY
-func runProxy(cmd *cobra.Command, args []string) {
-	// Check if we're already inside a proxy session to prevent nesting
-	if os.Getenv("SMART_SUGGESTION_PROXY_ACTIVE") != "" {
-		if debug {
-			logDebug("Already inside a proxy session, preventing nesting", map[string]any{
-				"existing_proxy_pid": os.Getenv("SMART_SUGGESTION_PROXY_ACTIVE"),
-			})
+func (cw *crlfWriter) Write(p []byte) (int, error) {
+	out := make([]byte, 0, len(p)+len(p)/8)
+	for _, b := range p {
+		if b == '\n' && !cw.lastCR {
+			out = append(out, '\r')
 		}
-		return
+		out = append(out, b)
+		cw.lastCR = b == '\r'
 	}
-
-	// Generate or get session ID
-	if sessionID == "" {
-		// Auto-generate session ID if not provided
-		generatedID, err := generateSessionID()
-		if err != nil {
-			if debug {
-				logDebug("Failed to generate session ID", map[string]any{
-					"error": err.Error(),
-				})
-			}
-			fmt.Fprintf(os.Stderr, "Failed to generate session ID: %v\n", err)
-			os.Exit(1)
-		}
-		sessionID = generatedID
+	if _, err := cw.w.Write(out); err != nil {
+		return 0, err
 	}
+	return len(p), nil
+}
 
-	// Create session-based file paths
-	sessionLogFile := getSessionBasedLogFile(proxyLogFile, sessionID)
-	sessionLockFile := getSessionBasedLockFile("/tmp/smart-suggestion-proxy.lock", sessionID)
-
-	// Create a lock file to prevent duplicate proxy processes for this session
-	lockFile, err := createProcessLock(sessionLockFile)
-	if err != nil {
-		if debug {
-			logDebug("Failed to create process lock", map[string]any{
-				"error":      err.Error(),
-				"lock_path":  sessionLockFile,
-				"session_id": sessionID,
-			})
+// quoteCommand joins command arguments into a shell command line, quoting
+// arguments that need it
+func quoteCommand(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		if arg != "" && strings.IndexFunc(arg, func(r rune) bool {
+			return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_./:=@%+,", r))
+		}) == -1 {
+			quoted[i] = arg
+			continue
 		}
-		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-		os.Exit(1)
+		quoted[i] = "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
 	}
+	return strings.Join(quoted, " ")
+}
 
-	// Ensure cleanup on exit
-	defer cleanupProcessLock(lockFile, sessionLockFile)
-
-	// Set environment variables for child processes
-	os.Setenv("SMART_SUGGESTION_SESSION_ID", sessionID)
-	// Set proxy active flag with current PID to prevent nesting
-	os.Setenv("SMART_SUGGESTION_PROXY_ACTIVE", fmt.Sprintf("%d", os.Getpid()))
-
-	// Clean up old session logs (older than 24 hours)
-	if err := cleanupOldSessionLogs(proxyLogFile, 24*time.Hour); err != nil {
-		if debug {
-			logDebug("Failed to cleanup old session logs", map[string]any{
-				"error": err.Error(),
-			})
+// exitCodeFromWaitError converts the result of exec.Cmd.Wait to a shell-style
+// exit code, using 128+signal for processes killed by a signal
+func exitCodeFromWaitError(err error) int {
+	if err == nil {
+		return 0
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+			if status.Signaled() {
+				return 128 + int(status.Signal())
+			}
+			return status.ExitStatus()
 		}
-		// Continue even if cleanup fails
+		return exitErr.ExitCode()
 	}
+	return 1
+}
 
-	if debug {
-		logDebug("Starting shell proxy mode with PTY", map[string]any{
-			"log_file":   sessionLogFile,
-			"lock_file":  sessionLockFile,
-			"session_id": sessionID,
-			"pid":        os.Getpid(),
-		})
+// getShellBuffer gets terminal buffer content using multiple methods
+func (r *fetchRequest) getShellBuffer() (string, error) {
+	content, err := r.doGetShellBuffer()
+	if err != nil {
+		return "", err
 	}
+	return readLatestLines(content, 100)
+}
 
-	// Get the user's shell, default to bash if not set
-	shell := os.Getenv("SHELL")
-	if shell == "" {
-		shell = "/bin/bash"
-	}
+// bufferBackend reads the terminal buffer from one source
+type bufferBackend struct {
+	// available reports whether the backend applies to the caller's terminal
+	available func(r *fetchRequest) bool
+	read      func(r *fetchRequest) (string, error)
+}
 
-	// Create a shell command
-	c := exec.Command(shell)
+// defaultBufferBackends is the order backends are tried in unless
+// SMART_SUGGESTION_BUFFER_BACKENDS says otherwise. Multiplexers and terminals
+// know exactly what is on screen, so they come before the proxy recording.
+const defaultBufferBackends = "tmux,zellij,kitty,wezterm,proxy,screen"
+
+// maxBufferScrollback is how many lines of scrollback backends request
+const maxBufferScrollback = 1000
+
+var bufferBackends = map[string]bufferBackend{
+	"tmux": {
+		available: func(r *fetchRequest) bool { return r.getenv("TMUX") != "" },
+		read:      (*fetchRequest).getTmuxBuffer,
+	},
+	"zellij": {
+		available: func(r *fetchRequest) bool { return r.getenv("ZELLIJ") != "" },
+		read:      (*fetchRequest).getZellijBuffer,
+	},
+	"kitty": {
+		available: func(r *fetchRequest) bool { return r.getenv("KITTY_LISTEN_ON") != "" },
+		read:      (*fetchRequest).getKittyBuffer,
+	},
+	"wezterm": {
+		available: func(r *fetchRequest) bool { return r.getenv("WEZTERM_PANE") != "" },
+		read:      (*fetchRequest).getWeztermBuffer,
+	},
+	"proxy": {
+		available: func(r *fetchRequest) bool { return r.currentSessionID() != "" || r.logFile != "" },
+		read:      (*fetchRequest).getProxyBuffer,
+	},
+	"screen": {
+		available: func(r *fetchRequest) bool { return r.getenv("STY") != "" },
+		read:      (*fetchRequest).getScreenBuffer,
+	},
+}
 
-	// Start the shell with a pty
-	ptmx, err := pty.Start(c)
-	if err != nil {
-		if debug {
-			logDebug("Failed to start PTY", map[string]any{
-				"error": err.Error(),
-				"shell": shell,
-			})
-		}
-		fmt.Fprintf(os.Stderr, "Failed to start PTY: %v\n", err)
-		os.Exit(1)
+// getBufferBackendOrder returns the backend names to try, in priority order,
+// from SMART_SUGGESTION_BUFFER_BACKENDS (comma-separated)
+func (r *fetchRequest) getBufferBackendOrder() []string {
+	value := r.getenv("SMART_SUGGESTION_BUFFER_BACKENDS")
+	if strings.TrimSpace(value) == "" {
+		value = defaultBufferBackends
 	}
-	defer func() { _ = ptmx.Close() }()
 
-	// Handle pty size changes
-	ch := make(chan os.Signal, 1)
-	signal.Notify(ch, syscall.SIGWINCH)
-	go func() {
-		for range ch {
-			if err := pty.InheritSize(os.Stdin, ptmx); err != nil {
-				if debug {
-					logDebug("Error resizing pty", map[string]any{
-						"error": err.Error(),
-					})
-				}
+	var names []string
+	for _, name := range strings.Split(value, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		if _, ok := bufferBackends[name]; !ok {
+			if r.debug {
+				logDebug("Ignoring unknown terminal buffer backend", map[string]any{
+					"backend": name,
+				})
 			}
+			continue
 		}
-	}()
-	ch <- syscall.SIGWINCH // Initial resize
-	defer func() { signal.Stop(ch); close(ch) }()
+		names = append(names, name)
+	}
+	return names
+}
 
-	// Set stdin in raw mode to properly handle terminal input (only if it's a terminal)
-	var oldState *term.State
-	if term.IsTerminal(int(os.Stdin.Fd())) {
-		oldState, err = term.MakeRaw(int(os.Stdin.Fd()))
+func (r *fetchRequest) doGetShellBuffer() (string, error) {
+	var tried []string
+	for _, name := range r.getBufferBackendOrder() {
+		backend := bufferBackends[name]
+		if !backend.available(r) {
+			continue
+		}
+		tried = append(tried, name)
+
+		content, err := backend.read(r)
 		if err != nil {
-			if debug {
-				logDebug("Failed to set raw mode", map[string]any{
-					"error": err.Error(),
+			if r.debug {
+				logDebug("Terminal buffer backend failed", map[string]any{
+					"backend": name,
+					"error":   err.Error(),
 				})
 			}
-			fmt.Fprintf(os.Stderr, "Failed to set raw mode: %v\n", err)
-			os.Exit(1)
+			continue
 		}
-		defer func() {
-			if oldState != nil {
-				_ = term.Restore(int(os.Stdin.Fd()), oldState)
-			}
-		}()
-	} else {
-		if debug {
-			logDebug("Stdin is not a terminal, skipping raw mode", map[string]any{
-				"stdin_fd": int(os.Stdin.Fd()),
+		if r.debug {
+			logDebug("Using terminal buffer backend", map[string]any{
+				"backend": name,
+				"bytes":   len(content),
 			})
 		}
+		return content, nil
 	}
 
-	// try to delete session log file if it exists
-	if _, err := os.Stat(sessionLogFile); err == nil {
-		if err := os.Remove(sessionLogFile); err != nil {
-			if debug {
-				logDebug("Failed to delete session log file", map[string]any{
-					"error":      err.Error(),
-					"log_file":   sessionLogFile,
-					"session_id": sessionID,
-				})
-			}
-			fmt.Fprintf(os.Stderr, "Failed to delete session log file: %v\n", err)
-			os.Exit(1)
-		}
+	if len(tried) == 0 {
+		return "", fmt.Errorf("no terminal buffer available - no supported terminal, multiplexer or proxy session found")
 	}
+	return "", fmt.Errorf("no terminal buffer available - backends %s failed", strings.Join(tried, ", "))
+}
+
+// getTmuxBuffer captures the pane the shell runs in. $TMUX_PANE is targeted
+// explicitly, as tmux's idea of the current pane is wrong when running from a
+// hook or in the background.
+func (r *fetchRequest) getTmuxBuffer() (string, error) {
+	return r.captureTmuxPane(r.getenv("TMUX_PANE"), maxBufferScrollback)
+}
 
-	// Open session log file for writing
-	logFile, err := os.OpenFile(sessionLogFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+// captureTmuxPane captures the last lines of a tmux pane, joining wrapped lines
+func (r *fetchRequest) captureTmuxPane(pane string, lines int) (string, error) {
+	args := []string{"capture-pane", "-p", "-J", "-S", strconv.Itoa(-lines)}
+	if pane != "" {
+		args = append(args, "-t", pane)
+	}
+	output, err := r.command("tmux", args...).Output()
 	if err != nil {
-		if debug {
-			logDebug("Failed to open session log file", map[string]any{
-				"error":      err.Error(),
-				"log_file":   sessionLogFile,
-				"session_id": sessionID,
-			})
-		}
-		fmt.Fprintf(os.Stderr, "Failed to open session log file: %v\n", err)
-		os.Exit(1)
+		return "", fmt.Errorf("failed to get tmux buffer: %w", err)
 	}
-	defer logFile.Close()
-
-	// Create a tee writer to write to both stdout and log file
-	teeWriter := io.MultiWriter(os.Stdout, logFile)
-
-	// Handle graceful shutdown
-	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	return strings.TrimSpace(string(output)), nil
+}
 
-	// Start goroutines for copying data
-	done := make(chan struct{})
+// getTmuxSiblingPanes returns the latest output of the other panes in the
+// current tmux window, each labeled with its command and directory
+func (r *fetchRequest) getTmuxSiblingPanes() (string, error) {
+	numLines, err := r.envInt("SMART_SUGGESTION_TMUX_SIBLING_LINES", 20)
+	if err != nil {
+		return "", err
+	}
+	if numLines <= 0 {
+		return "", nil
+	}
 
-	// Copy from stdin to pty (user input)
-	go func() {
-		defer close(done)
-		_, err := io.Copy(ptmx, os.Stdin)
-		if err != nil && debug {
-			logDebug("Error copying stdin to pty", map[string]any{
-				"error": err.Error(),
-			})
+	// Without knowing its own pane, the shell's pane would be sent again as
+	// a sibling
+	currentPane := r.getenv("TMUX_PANE")
+	if currentPane == "" {
+		output, err := r.command("tmux", "display-message", "-p", "#{pane_id}").Output()
+		if err != nil {
+			return "", nil
 		}
-	}()
-
-	// Copy from pty to stdout and log file (shell output)
-	go func() {
-		_, err := io.Copy(teeWriter, ptmx)
-		if err != nil && debug {
-			logDebug("Error copying pty to output", map[string]any{
-				"error": err.Error(),
-			})
+		currentPane = strings.TrimSpace(string(output))
+		if currentPane == "" {
+			return "", nil
 		}
-		done <- struct{}{}
-	}()
+	}
+	output, err := r.command("tmux", "list-panes", "-t", currentPane, "-F", "#{pane_id}\t#{pane_current_command}\t#{pane_current_path}").Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to list tmux panes: %w", err)
+	}
 
-	// Wait for either completion or signal
-	select {
-	case <-done:
-		if debug {
-			logDebug("PTY session completed", map[string]any{
-				"log_file": proxyLogFile,
-			})
+	var parts []string
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		fields := strings.SplitN(line, "\t", 3)
+		if len(fields) != 3 || fields[0] == currentPane {
+			continue
 		}
-	case sig := <-sigCh:
-		if debug {
-			logDebug("Received signal, shutting down", map[string]any{
-				"signal":   sig.String(),
-				"log_file": proxyLogFile,
-			})
+		content, err := r.captureTmuxPane(fields[0], numLines)
+		if err != nil || content == "" {
+			continue
 		}
+		content, _ = readLatestLines(content, numLines)
+		parts = append(parts, fmt.Sprintf("## Pane %s (%s in %s):\n%s", fields[0], fields[1], fields[2], content))
 	}
+	return strings.Join(parts, "\n\n"), nil
 }
 
-// getShellBuffer gets terminal buffer content using multiple methods
-func getShellBuffer() (string, error) {
-	content, err := doGetShellBuffer()
+// getKittyBuffer gets the scrollback of the kitty window
+func (r *fetchRequest) getKittyBuffer() (string, error) {
+	cmd := r.command("kitten", "@", "get-text", "--extent", "all")
+	output, err := cmd.Output()
 	if err != nil {
-		return "", err
+		return "", fmt.Errorf("failed to get kitty scrollback buffer: %w", err)
 	}
-	return readLatestLines(content, 100)
+	return strings.TrimSpace(string(output)), nil
 }
 
-func doGetShellBuffer() (string, error) {
-	// Try tmux first if available
-	if os.Getenv("TMUX") != "" {
-		cmd := exec.Command("tmux", "capture-pane", "-pS", "-")
-		output, err := cmd.Output()
-		if err == nil {
-			return strings.TrimSpace(string(output)), nil
-		}
-		if debug {
-			logDebug("Failed to get tmux buffer", map[string]any{
-				"error": err.Error(),
-			})
-		}
+// getWeztermBuffer gets the screen and scrollback of the current WezTerm pane
+func (r *fetchRequest) getWeztermBuffer() (string, error) {
+	cmd := r.command("wezterm", "cli", "get-text",
+		"--pane-id", r.getenv("WEZTERM_PANE"),
+		"--start-line", strconv.Itoa(-maxBufferScrollback))
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to get wezterm buffer: %w", err)
 	}
+	return strings.TrimSpace(string(output)), nil
+}
 
-	// Try kitty if available
-	if os.Getenv("KITTY_LISTEN_ON") != "" {
-		cmd := exec.Command("kitten", "@", "get-text", "--extent", "all")
-		output, err := cmd.Output()
+// getZellijBuffer dumps the focused Zellij pane, including its scrollback, to
+// a private temporary file
+func (r *fetchRequest) getZellijBuffer() (string, error) {
+	return captureToPrivateFile(func(path string) *exec.Cmd {
+		return r.command("zellij", "action", "dump-screen", "--full", path)
+	})
+}
+
+// getProxyBuffer reads the proxy's in-memory buffer over the session socket,
+// falling back to the session's log file and then the base log file
+func (r *fetchRequest) getProxyBuffer() (string, error) {
+	// The output is rendered at the size of the caller's terminal
+	width, height := r.terminalSize()
+
+	// Try to query the proxy's in-memory buffer over the session socket
+	currentSessionID := r.currentSessionID()
+	if currentSessionID != "" {
+		socketFile := getSessionSocketFile(currentSessionID)
+		data, err := pkg.QuerySession(socketFile, "buffer", nil, time.Second)
 		if err == nil {
-			return strings.TrimSpace(string(output)), nil
+			return renderProxyContent([]byte(data), width, height), nil
 		}
-		if debug {
-			logDebug("Failed to get kitty scrollback buffer", map[string]any{
-				"error": err.Error(),
+		if r.debug {
+			logDebug("Failed to query session socket", map[string]any{
+				"error":      err.Error(),
+				"socket":     socketFile,
+				"session_id": currentSessionID,
 			})
 		}
 	}
 
 	// Try to read from session-specific proxy log file if it exists
-	currentSessionID := getCurrentSessionID()
-	if currentSessionID != "" && proxyLogFile != "" {
-		sessionLogFile := getSessionBasedLogFile(proxyLogFile, currentSessionID)
-		content, err := readLatestProxyContent(sessionLogFile)
+	if currentSessionID != "" && r.logFile != "" {
+		sessionLogFile := getSessionBasedLogFile(r.logFile, currentSessionID)
+		content, err := readLatestProxyContent(sessionLogFile, width, height)
 		if err == nil {
 			return content, nil
 		}
-		if debug {
+		if r.debug {
 			logDebug("Failed to read session proxy log", map[string]any{
 				"error":      err.Error(),
 				"file":       sessionLogFile,
@@ -1618,32 +4248,20 @@ func doGetShellBuffer() (string, error) {
 	}
 
 	// Fallback to base proxy log file if session-specific file doesn't exist
-	if proxyLogFile != "" {
-		content, err := readLatestProxyContent(proxyLogFile)
+	if r.logFile != "" {
+		content, err := readLatestProxyContent(r.logFile, width, height)
 		if err == nil {
 			return content, nil
 		}
-		if debug {
+		if r.debug {
 			logDebug("Failed to read base proxy log", map[string]any{
 				"error": err.Error(),
-				"file":  proxyLogFile,
+				"file":  r.logFile,
 			})
 		}
 	}
 
-	// Try screen if available
-	content, err := getScreenBuffer()
-	if err == nil {
-		return content, nil
-	}
-
-	// Try to get terminal buffer using tput if available
-	content, err = getTerminalBufferWithTput()
-	if err == nil {
-		return content, nil
-	}
-
-	return "", fmt.Errorf("no terminal buffer available - not in tmux/screen session and no proxy log found")
+	return "", fmt.Errorf("no proxy session output found")
 }
 
 func readLatestLines(content string, maxLines int) (string, error) {
@@ -1654,80 +4272,127 @@ func readLatestLines(content string, maxLines int) (string, error) {
 	return strings.Join(lines, "\n"), nil
 }
 
-// readLatestProxyContent reads the latest content from proxy log file
-func readLatestProxyContent(logFile string) (string, error) {
+// readLatestProxyContent reads the latest content from proxy log file,
+// rendering the raw terminal output through a screen model so cursor
+// movement, colors and redraws are resolved into the lines the user saw
+func readLatestProxyContent(logFile string, width, height int) (string, error) {
+	data, err := readFileTail(logFile, 1024*1024)
+	if err != nil {
+		return "", err
+	}
+	return renderProxyContent(data, width, height), nil
+}
+
+// readFileTail reads at most the last maxBytes of a proxy log file
+func readFileTail(logFile string, maxBytes int64) ([]byte, error) {
 	file, err := os.Open(logFile)
 	if err != nil {
-		return "", fmt.Errorf("failed to open proxy log file: %w", err)
+		return nil, fmt.Errorf("failed to open proxy log file: %w", err)
 	}
 	defer file.Close()
 
-	// Read the last N lines from the file
-	const maxLines = 50
-	scanner := bufio.NewScanner(file)
-	var lines []string
-
-	for scanner.Scan() {
-		lines = append(lines, scanner.Text())
-		// Keep only the last maxLines
-		if len(lines) > maxLines {
-			lines = lines[1:]
+	info, err := file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat proxy log file: %w", err)
+	}
+	if info.Size() > maxBytes {
+		if _, err := file.Seek(info.Size()-maxBytes, io.SeekStart); err != nil {
+			return nil, fmt.Errorf("failed to seek proxy log file: %w", err)
 		}
 	}
 
-	if err := scanner.Err(); err != nil {
-		return "", fmt.Errorf("failed to read proxy log file: %w", err)
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read proxy log file: %w", err)
 	}
-
-	return strings.Join(lines, "\n"), nil
+	return data, nil
 }
 
-// getScreenBuffer tries to get buffer from GNU screen
-func getScreenBuffer() (string, error) {
-	// Check if we're in a screen session
-	if os.Getenv("STY") == "" {
-		return "", fmt.Errorf("not in a screen session")
+// renderProxyContent renders raw proxy output on a terminal of the given size
+// and returns the last N lines
+func renderProxyContent(data []byte, width, height int) string {
+	const maxLines = 50
+	lines := pkg.RenderTerminalOutput(data, width, height, 1000)
+	if len(lines) > maxLines {
+		lines = lines[len(lines)-maxLines:]
 	}
+	return strings.Join(lines, "\n")
+}
 
-	// Try to capture screen buffer
-	cmd := exec.Command("screen", "-X", "hardcopy", "/tmp/screen_buffer.txt")
-	if err := cmd.Run(); err != nil {
-		return "", fmt.Errorf("failed to capture screen buffer: %w", err)
+// getTerminalSize returns the size of the controlling terminal, which the
+// proxy output was rendered on
+func getTerminalSize() (int, int) {
+	if tty, err := os.Open("/dev/tty"); err == nil {
+		defer tty.Close()
+		if width, height, err := term.GetSize(int(tty.Fd())); err == nil && width > 0 && height > 0 {
+			return width, height
+		}
 	}
+	return terminalSizeFromEnv(os.Getenv)
+}
 
-	// Read the captured buffer
-	content, err := os.ReadFile("/tmp/screen_buffer.txt")
-	if err != nil {
-		return "", fmt.Errorf("failed to read screen buffer: %w", err)
+// terminalSizeFromEnv returns the terminal size from $COLUMNS and $LINES, or
+// a common default
+func terminalSizeFromEnv(getenv func(string) string) (int, int) {
+	width, _ := strconv.Atoi(getenv("COLUMNS"))
+	height, _ := strconv.Atoi(getenv("LINES"))
+	if width <= 0 {
+		width = 120
 	}
+	if height <= 0 {
+		height = 40
+	}
+	return width, height
+}
 
-	// Clean up the temporary file
-	os.Remove("/tmp/screen_buffer.txt")
-
-	return strings.TrimSpace(string(content)), nil
+// getScreenBuffer gets the current GNU screen window, including its
+// scrollback, through a private temporary file
+func (r *fetchRequest) getScreenBuffer() (string, error) {
+	return captureToPrivateFile(func(path string) *exec.Cmd {
+		args := []string{"-S", r.getenv("STY")}
+		if window := r.getenv("WINDOW"); window != "" {
+			args = append(args, "-p", window)
+		}
+		return r.command("screen", append(args, "-X", "hardcopy", "-h", path)...)
+	})
 }
 
-// getTerminalBufferWithTput tries to get terminal content using tput
-func getTerminalBufferWithTput() (string, error) {
-	// This is a limited approach that only works in some terminals
-	// Get terminal size
-	rowsCmd := exec.Command("tput", "lines")
-	rowsOutput, err := rowsCmd.Output()
+// captureToPrivateFile runs a command that writes the terminal buffer to the
+// given path and returns the file's content. The file lives in a fresh
+// directory only the current user can access, and is removed afterwards.
+func captureToPrivateFile(command func(path string) *exec.Cmd) (string, error) {
+	dir, err := os.MkdirTemp("", "smart-suggestion-buffer-")
 	if err != nil {
-		return "", fmt.Errorf("failed to get terminal rows: %w", err)
+		return "", fmt.Errorf("failed to create temporary directory: %w", err)
 	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "buffer.txt")
 
-	rows, err := strconv.Atoi(strings.TrimSpace(string(rowsOutput)))
-	if err != nil {
-		return "", fmt.Errorf("failed to parse terminal rows: %w", err)
+	cmd := command(path)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return "", fmt.Errorf("failed to run %s: %w: %s", cmd.Args[0], err, strings.TrimSpace(string(output)))
 	}
 
-	// This is a very limited approach and may not work in all terminals
-	// We can try to use ANSI escape sequences to query the terminal
-	// but this is complex and terminal-dependent
-
-	// For now, return an error indicating this method is not implemented
-	return "", fmt.Errorf("tput method not fully implemented (terminal has %d rows)", rows)
+	// The multiplexer server writes the file after the command returns, wait
+	// until it stops growing
+	deadline := time.Now().Add(time.Second)
+	previousSize := -1
+	for {
+		content, err := os.ReadFile(path)
+		if err == nil && len(content) > 0 && len(content) == previousSize {
+			return strings.TrimSpace(string(content)), nil
+		}
+		if time.Now().After(deadline) {
+			if err == nil && len(content) > 0 {
+				return strings.TrimSpace(string(content)), nil
+			}
+			return "", fmt.Errorf("%s did not write the buffer", cmd.Args[0])
+		}
+		if err == nil {
+			previousSize = len(content)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
 }
 
 // runRotateLogs handles the rotate-logs command
@@ -1781,13 +4446,13 @@ func runRotateLogs(cmd *cobra.Command, args []string) {
 	}
 }
 
-func fetchDeepSeek() (string, error) {
-	apiKey := os.Getenv("DEEPSEEK_API_KEY")
+func (r *fetchRequest) fetchDeepSeek() (string, error) {
+	apiKey := r.getenv("DEEPSEEK_API_KEY")
 	if apiKey == "" {
 		return "", fmt.Errorf("DEEPSEEK_API_KEY environment variable is not set")
 	}
 
-	baseURL := os.Getenv("DEEPSEEK_BASE_URL")
+	baseURL := r.getenv("DEEPSEEK_BASE_URL")
 	if baseURL == "" {
 		baseURL = "https://api.deepseek.com"
 	}
@@ -1803,18 +4468,11 @@ func fetchDeepSeek() (string, error) {
 		url = fmt.Sprintf("https://%s/chat/completions", baseURL)
 	}
 
-	// Get model from environment or use default
-	model := os.Getenv("DEEPSEEK_MODEL")
-	if model == "" {
-		model = "deepseek-chat" // Default to deepseek-chat which points to DeepSeek-V3-0324
-	}
+	model := r.modelName("deepseek")
 
 	request := DeepSeekRequest{
-		Model: model,
-		Messages: []OpenAIMessage{
-			{Role: "system", Content: systemPrompt},
-			{Role: "user", Content: input},
-		},
+		Model:    model,
+		Messages: r.openAIMessages(),
 	}
 
 	jsonData, err := json.Marshal(request)
@@ -1822,14 +4480,14 @@ func fetchDeepSeek() (string, error) {
 		return "", fmt.Errorf("failed to marshal request: %w", err)
 	}
 
-	if debug {
+	if r.debug {
 		logDebug("Sending DeepSeek request", map[string]any{
 			"url":     url,
 			"request": string(jsonData),
 		})
 	}
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
+	req, err := http.NewRequestWithContext(r.ctx, "POST", url, bytes.NewBuffer(jsonData))
 	if err != nil {
 		return "", fmt.Errorf("failed to create request: %w", err)
 	}
@@ -1837,8 +4495,7 @@ func fetchDeepSeek() (string, error) {
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Authorization", "Bearer "+apiKey)
 
-	client := &http.Client{Timeout: 30 * time.Second}
-	resp, err := client.Do(req)
+	resp, err := httpClient.Do(req)
 	if err != nil {
 		return "", fmt.Errorf("failed to send request: %w", err)
 	}
@@ -1849,7 +4506,7 @@ func fetchDeepSeek() (string, error) {
 		return "", fmt.Errorf("failed to read response: %w", err)
 	}
 
-	if debug {
+	if r.debug {
 		logDebug("Received DeepSeek response", map[string]any{
 			"status":   resp.Status,
 			"response": string(body),
@@ -1876,6 +4533,30 @@ func fetchDeepSeek() (string, error) {
 	return response.Choices[0].Message.Content, nil
 }
 
+// fetchLocal predicts the command from history with the offline local engine
+func (r *fetchRequest) fetchLocal() (string, error) {
+	// Commands recorded by the proxy carry the directory they were run in
+	recorded := pkg.CommandEventsFromRecords(pkg.ReadAllCommandRecords(r.logFile))
+	engine := pkg.LoadLocalEngine(r.historyFiles(), pkg.RotatedProxyLogFiles(r.logFile), recorded, nil)
+
+	suggestion, err := engine.Suggest(r.input, r.cwd)
+	if err != nil {
+		return "", err
+	}
+
+	if r.debug {
+		logDebug("Local engine suggestion", map[string]any{
+			"input":    r.input,
+			"commands": engine.Len(),
+			"command":  suggestion.Command,
+			"reason":   suggestion.Reason,
+			"score":    suggestion.Score,
+		})
+	}
+
+	return suggestion.Format(), nil
+}
+
 func runUpdate(cmd *cobra.Command, args []string) {
 	checkOnly, _ := cmd.Flags().GetBool("check-only")
 
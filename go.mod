@@ -7,11 +7,11 @@ toolchain go1.23.1
 require (
 	github.com/creack/pty v1.1.24
 	github.com/spf13/cobra v1.8.0
+	golang.org/x/sys v0.33.0
 	golang.org/x/term v0.32.0
 )
 
 require (
 	github.com/inconshreveable/mousetrap v1.1.0 // indirect
 	github.com/spf13/pflag v1.0.5 // indirect
-	golang.org/x/sys v0.33.0 // indirect
 )
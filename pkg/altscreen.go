@@ -0,0 +1,148 @@
+package pkg
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxCSIBytes is the longest private-mode CSI sequence the filter buffers
+const maxCSIBytes = 64
+
+// AltScreenFilter is an io.Writer that replaces everything a full-screen
+// application (vim, less, htop) draws on the alternate screen with a one-line
+// summary such as "[vim README.md for 3m]"
+type AltScreenFilter struct {
+	mutex   sync.Mutex
+	out     io.Writer
+	command func() string
+	pending []byte
+	active  bool
+	name    string
+	entered time.Time
+}
+
+// NewAltScreenFilter creates a filter writing to out. command returns the
+// command line running when the alternate screen is entered and may be nil.
+func NewAltScreenFilter(out io.Writer, command func() string) *AltScreenFilter {
+	return &AltScreenFilter{out: out, command: command}
+}
+
+// Write implements io.Writer. Mode sequences split across writes are buffered until complete.
+func (f *AltScreenFilter) Write(p []byte) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	n := len(p)
+	data := p
+	if len(f.pending) > 0 {
+		data = append(f.pending, p...)
+		f.pending = nil
+	}
+
+	var passthrough bytes.Buffer
+	for len(data) > 0 {
+		start := bytes.Index(data, []byte("\x1b[?"))
+		if start == -1 {
+			// Keep a possibly incomplete sequence start for the next write
+			keep := 0
+			for _, prefix := range []string{"\x1b[", "\x1b"} {
+				if bytes.HasSuffix(data, []byte(prefix)) {
+					keep = len(prefix)
+					break
+				}
+			}
+			f.emit(&passthrough, data[:len(data)-keep])
+			if keep > 0 {
+				f.pending = append([]byte{}, data[len(data)-keep:]...)
+			}
+			break
+		}
+		f.emit(&passthrough, data[:start])
+		data = data[start:]
+
+		end := bytes.IndexFunc(data[3:], func(r rune) bool { return r >= 0x40 && r <= 0x7e })
+		if end == -1 {
+			if len(data) > maxCSIBytes {
+				f.emit(&passthrough, data)
+			} else {
+				f.pending = append([]byte{}, data...)
+			}
+			break
+		}
+
+		sequence := data[:3+end+1]
+		data = data[3+end+1:]
+		final := sequence[len(sequence)-1]
+		if (final != 'h' && final != 'l') || !isAltScreenMode(string(sequence[3:len(sequence)-1])) {
+			f.emit(&passthrough, sequence)
+			continue
+		}
+
+		if final == 'h' && !f.active {
+			f.active = true
+			f.entered = time.Now()
+			f.name = ""
+			if f.command != nil {
+				f.name = f.command()
+			}
+		} else if final == 'l' && f.active {
+			f.active = false
+			passthrough.WriteString(f.summary(false))
+		}
+	}
+
+	if passthrough.Len() > 0 {
+		if _, err := f.out.Write(passthrough.Bytes()); err != nil {
+			return 0, err
+		}
+	}
+	return n, nil
+}
+
+// Flush writes the summary of an application still on the alternate screen
+func (f *AltScreenFilter) Flush() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if !f.active {
+		return nil
+	}
+	f.active = false
+	_, err := f.out.Write([]byte(f.summary(true)))
+	return err
+}
+
+// emit passes data through unless the alternate screen is active
+func (f *AltScreenFilter) emit(buf *bytes.Buffer, data []byte) {
+	if !f.active {
+		buf.Write(data)
+	}
+}
+
+func (f *AltScreenFilter) summary(running bool) string {
+	name := strings.Join(strings.Fields(f.name), " ")
+	if name == "" {
+		name = "full-screen application"
+	}
+	name = truncateString(name, 80)
+	state := "for"
+	if running {
+		state = "still running after"
+	}
+	return fmt.Sprintf("[%s %s %s]\r\n", name, state, FormatAge(time.Since(f.entered)))
+}
+
+// isAltScreenMode reports whether DEC private mode parameters select the alternate screen
+func isAltScreenMode(params string) bool {
+	for _, param := range strings.Split(params, ";") {
+		switch param {
+		case "47", "1047", "1049":
+			return true
+		}
+	}
+	return false
+}
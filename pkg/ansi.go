@@ -0,0 +1,31 @@
+package pkg
+
+import (
+	"regexp"
+	"strings"
+)
+
+// ansiPattern matches CSI, OSC and other common escape sequences
+var ansiPattern = regexp.MustCompile(`\x1b\[[0-9;?<>=!]*[ -/]*[@-~]|\x1b\][^\x07\x1b]*(\x07|\x1b\\)|\x1b[PX^_][^\x1b]*\x1b\\|\x1b[()*+][0-9A-Za-z]|\x1b[@-Z\\-_=>78]`)
+
+// StripANSI removes terminal escape sequences and carriage-return overwrites
+// from text, keeping only what ends up on each line
+func StripANSI(text string) string {
+	text = ansiPattern.ReplaceAllString(text, "")
+
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		line = strings.TrimSuffix(line, "\r")
+		// A carriage return in the middle of a line means the line was redrawn
+		if pos := strings.LastIndex(line, "\r"); pos != -1 {
+			line = line[pos+1:]
+		}
+		lines[i] = strings.Map(func(r rune) rune {
+			if r < 0x20 && r != '\t' {
+				return -1
+			}
+			return r
+		}, line)
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,181 @@
+package pkg
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// AsciicastHeader is the first line of an asciicast v2 recording
+type AsciicastHeader struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp,omitempty"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+// AsciicastEvent is an output ("o") or resize ("r") event of a recording
+type AsciicastEvent struct {
+	// Time is the number of seconds since the start of the recording
+	Time float64
+	Type string
+	Data string
+}
+
+// MarshalJSON encodes the event as a [time, type, data] array
+func (e AsciicastEvent) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]any{e.Time, e.Type, e.Data})
+}
+
+// UnmarshalJSON decodes a [time, type, data] array
+func (e *AsciicastEvent) UnmarshalJSON(data []byte) error {
+	var fields []json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	if len(fields) != 3 {
+		return fmt.Errorf("asciicast event has %d fields, expected 3", len(fields))
+	}
+	if err := json.Unmarshal(fields[0], &e.Time); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(fields[1], &e.Type); err != nil {
+		return err
+	}
+	return json.Unmarshal(fields[2], &e.Data)
+}
+
+// GetSessionCastFile returns the asciicast recording for a session log file
+func GetSessionCastFile(sessionLogFile string) string {
+	return strings.TrimSuffix(sessionLogFile, filepath.Ext(sessionLogFile)) + ".cast"
+}
+
+// AsciicastWriter is an io.Writer recording terminal output as asciicast v2 events
+type AsciicastWriter struct {
+	mutex   sync.Mutex
+	w       io.Writer
+	start   time.Time
+	pending []byte
+	// maxSize caps the recording in bytes, 0 means unlimited
+	maxSize int64
+	written int64
+	full    bool
+}
+
+// NewAsciicastWriter writes the header to w and returns a writer for the
+// events. Once the recording would grow beyond maxSize bytes (if not 0),
+// further events are dropped.
+func NewAsciicastWriter(w io.Writer, header AsciicastHeader, maxSize int64) (*AsciicastWriter, error) {
+	header.Version = 2
+	start := time.Now()
+	if header.Timestamp == 0 {
+		header.Timestamp = start.Unix()
+	}
+	data, err := json.Marshal(header)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal asciicast header: %w", err)
+	}
+	if _, err := w.Write(append(data, '\n')); err != nil {
+		return nil, fmt.Errorf("failed to write asciicast header: %w", err)
+	}
+	return &AsciicastWriter{w: w, start: start, maxSize: maxSize, written: int64(len(data) + 1)}, nil
+}
+
+// Write implements io.Writer. UTF-8 characters split across writes are kept
+// together, as events have to be valid strings.
+func (a *AsciicastWriter) Write(p []byte) (int, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	data := append(a.pending, p...)
+	a.pending = nil
+	// Hold back an incomplete UTF-8 sequence at the end
+	for i := 1; i <= utf8.UTFMax-1 && i <= len(data); i++ {
+		if utf8.RuneStart(data[len(data)-i]) {
+			if !utf8.FullRune(data[len(data)-i:]) {
+				a.pending = append([]byte{}, data[len(data)-i:]...)
+				data = data[:len(data)-i]
+			}
+			break
+		}
+	}
+	if len(data) > 0 {
+		if err := a.event("o", string(data)); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Resize records a terminal size change
+func (a *AsciicastWriter) Resize(width, height int) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.event("r", fmt.Sprintf("%dx%d", width, height))
+}
+
+func (a *AsciicastWriter) event(kind, data string) error {
+	if a.full {
+		return nil
+	}
+	line, err := json.Marshal(AsciicastEvent{
+		Time: time.Since(a.start).Seconds(),
+		Type: kind,
+		Data: data,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal asciicast event: %w", err)
+	}
+	// Stop at a whole event so the recording stays readable
+	if a.maxSize > 0 && a.written+int64(len(line)+1) > a.maxSize {
+		a.full = true
+		return nil
+	}
+	n, err := a.w.Write(append(line, '\n'))
+	a.written += int64(n)
+	return err
+}
+
+// ReadAsciicast reads an asciicast v2 recording
+func ReadAsciicast(path string) (*AsciicastHeader, []AsciicastEvent, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open recording: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	if !scanner.Scan() {
+		return nil, nil, fmt.Errorf("recording %s is empty", path)
+	}
+	var header AsciicastHeader
+	if err := json.Unmarshal(scanner.Bytes(), &header); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse asciicast header: %w", err)
+	}
+	if header.Version != 2 {
+		return nil, nil, fmt.Errorf("unsupported asciicast version %d", header.Version)
+	}
+
+	var events []AsciicastEvent
+	for scanner.Scan() {
+		var event AsciicastEvent
+		// Skip lines truncated by a proxy that was killed mid-write
+		if err := json.Unmarshal(scanner.Bytes(), &event); err == nil {
+			events = append(events, event)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return &header, events, fmt.Errorf("failed to read recording: %w", err)
+	}
+	return &header, events, nil
+}
@@ -0,0 +1,38 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestAsciicastWriterMaxSize(t *testing.T) {
+	var buf bytes.Buffer
+	writer, err := NewAsciicastWriter(&buf, AsciicastHeader{Width: 80, Height: 24}, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		if _, err := writer.Write([]byte("some output\r\n")); err != nil {
+			t.Fatalf("Write() failed once the recording is full: %v", err)
+		}
+	}
+	if err := writer.Resize(100, 30); err != nil {
+		t.Fatal(err)
+	}
+
+	if buf.Len() > 200 {
+		t.Errorf("recording has %d bytes, want at most 200", buf.Len())
+	}
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) < 2 {
+		t.Fatalf("recording has no events: %q", buf.String())
+	}
+	for _, line := range lines[1:] {
+		var event AsciicastEvent
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			t.Errorf("event %q is cut off: %v", line, err)
+		}
+	}
+}
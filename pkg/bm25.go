@@ -0,0 +1,131 @@
+package pkg
+
+import (
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// BM25Document is a single document in a BM25 index
+type BM25Document struct {
+	// ID identifies the document, e.g. a command or a file reference
+	ID string `json:"id"`
+	// Text is the original text of the document
+	Text string `json:"text"`
+	// Terms are the tokens of the document, see Tokenize
+	Terms []string `json:"terms"`
+}
+
+// BM25Result is a document returned from a search with its score
+type BM25Result struct {
+	Index int
+	Doc   *BM25Document
+	Score float64
+}
+
+// BM25Index is an in-memory Okapi BM25 index over a set of documents
+type BM25Index struct {
+	docs    []BM25Document
+	docFreq map[string]int
+	termTF  []map[string]int
+	avgLen  float64
+	k1      float64
+	b       float64
+}
+
+var tokenPattern = regexp.MustCompile(`[a-z0-9_]+`)
+
+// Tokenize lowercases text and splits it into alphanumeric terms
+func Tokenize(text string) []string {
+	return tokenPattern.FindAllString(strings.ToLower(text), -1)
+}
+
+// NewBM25Index builds an index over the given documents. Documents without
+// precomputed terms are tokenized from their text.
+func NewBM25Index(docs []BM25Document) *BM25Index {
+	idx := &BM25Index{
+		docs:    docs,
+		docFreq: make(map[string]int),
+		termTF:  make([]map[string]int, len(docs)),
+		k1:      1.2,
+		b:       0.75,
+	}
+
+	totalLen := 0
+	for i := range idx.docs {
+		if idx.docs[i].Terms == nil {
+			idx.docs[i].Terms = Tokenize(idx.docs[i].Text)
+		}
+		tf := make(map[string]int)
+		for _, term := range idx.docs[i].Terms {
+			tf[term]++
+		}
+		for term := range tf {
+			idx.docFreq[term]++
+		}
+		idx.termTF[i] = tf
+		totalLen += len(idx.docs[i].Terms)
+	}
+	if len(docs) > 0 {
+		idx.avgLen = float64(totalLen) / float64(len(docs))
+	}
+
+	return idx
+}
+
+// Len returns the number of documents in the index
+func (idx *BM25Index) Len() int {
+	return len(idx.docs)
+}
+
+// Search returns the k documents with the highest BM25 score for the query
+func (idx *BM25Index) Search(query string, k int) []BM25Result {
+	return idx.SearchTerms(Tokenize(query), k)
+}
+
+// SearchTerms is like Search but takes already tokenized query terms, which
+// allows callers to weight terms by repeating them
+func (idx *BM25Index) SearchTerms(queryTerms []string, k int) []BM25Result {
+	if len(idx.docs) == 0 || len(queryTerms) == 0 || k <= 0 {
+		return nil
+	}
+
+	queryTF := make(map[string]int)
+	for _, term := range queryTerms {
+		if idx.docFreq[term] > 0 {
+			queryTF[term]++
+		}
+	}
+	if len(queryTF) == 0 {
+		return nil
+	}
+
+	n := float64(len(idx.docs))
+	var results []BM25Result
+	for i, tf := range idx.termTF {
+		score := 0.0
+		docLen := float64(len(idx.docs[i].Terms))
+		for term, qtf := range queryTF {
+			f := float64(tf[term])
+			if f == 0 {
+				continue
+			}
+			df := float64(idx.docFreq[term])
+			idf := math.Log(1 + (n-df+0.5)/(df+0.5))
+			norm := f * (idx.k1 + 1) / (f + idx.k1*(1-idx.b+idx.b*docLen/idx.avgLen))
+			score += idf * norm * float64(qtf)
+		}
+		if score > 0 {
+			results = append(results, BM25Result{Index: i, Doc: &idx.docs[i], Score: score})
+		}
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Score > results[j].Score
+	})
+	if len(results) > k {
+		results = results[:k]
+	}
+	return results
+}
@@ -0,0 +1,65 @@
+package pkg
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	got := Tokenize("Docker-Compose up -d --build my_app:v2")
+	want := []string{"docker", "compose", "up", "d", "build", "my_app", "v2"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Tokenize() = %q, want %q", got, want)
+	}
+}
+
+func TestBM25Search(t *testing.T) {
+	index := NewBM25Index([]BM25Document{
+		{ID: "0", Text: "git status"},
+		{ID: "1", Text: "git push origin main"},
+		{ID: "2", Text: "docker compose up -d"},
+		{ID: "3", Text: "docker ps"},
+		{ID: "4", Text: "kubectl get pods -n kube-system"},
+		{ID: "5", Text: "git push --force-with-lease origin feature branch"},
+	})
+
+	tests := []struct {
+		query string
+		k     int
+		want  []string
+	}{
+		// Rare terms outweigh common ones
+		{"git push", 3, []string{"1", "5", "0"}},
+		// Shorter documents rank higher for the same term
+		{"docker", 2, []string{"3", "2"}},
+		{"pods kube", 5, []string{"4"}},
+		{"git", 1, []string{"0"}},
+		{"unknown", 5, nil},
+		{"", 5, nil},
+		{"git", 0, nil},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, result := range index.Search(tt.query, tt.k) {
+			got = append(got, result.Doc.ID)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Search(%q, %d) = %v, want %v", tt.query, tt.k, got, tt.want)
+		}
+	}
+
+	if results := NewBM25Index(nil).Search("git", 5); results != nil {
+		t.Errorf("Search() on an empty index = %v", results)
+	}
+}
+
+func TestBM25SearchTermsWeighting(t *testing.T) {
+	index := NewBM25Index([]BM25Document{
+		{ID: "build", Text: "make build"},
+		{ID: "test", Text: "go test"},
+	})
+	results := index.SearchTerms([]string{"build", "test", "test"}, 2)
+	if len(results) != 2 || results[0].Doc.ID != "test" {
+		t.Errorf("SearchTerms() = %v, want the repeated term first", results)
+	}
+}
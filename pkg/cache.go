@@ -0,0 +1,217 @@
+package pkg
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// SuggestionCache is an on-disk cache of suggestions with a TTL
+type SuggestionCache struct {
+	dir string
+	ttl time.Duration
+}
+
+// CacheStats holds hit/miss counters and the current size of the cache
+type CacheStats struct {
+	Hits    int64 `json:"hits"`
+	Misses  int64 `json:"misses"`
+	Entries int   `json:"-"`
+	Bytes   int64 `json:"-"`
+}
+
+type cacheEntry struct {
+	Created int64  `json:"created"`
+	Value   string `json:"value"`
+}
+
+const cacheStatsFile = "stats.json"
+
+// NewSuggestionCache opens the suggestion cache in the cache directory
+func NewSuggestionCache(ttl time.Duration) (*SuggestionCache, error) {
+	dir, err := CacheDir("suggestions")
+	if err != nil {
+		return nil, err
+	}
+	return &SuggestionCache{dir: dir, ttl: ttl}, nil
+}
+
+// SuggestionCacheKey hashes the parts identifying a request into a cache key
+func SuggestionCacheKey(parts ...string) string {
+	hash := sha256.New()
+	for _, part := range parts {
+		// Length-prefix each part so different splits can't collide
+		fmt.Fprintf(hash, "%d:%s\x00", len(part), part)
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// Get returns the cached value for key if it exists and has not expired
+func (c *SuggestionCache) Get(key string) (string, bool) {
+	path := c.entryPath(key)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		c.record(false)
+		return "", false
+	}
+
+	var entry cacheEntry
+	if err := json.Unmarshal(data, &entry); err != nil || time.Since(time.Unix(entry.Created, 0)) > c.ttl {
+		os.Remove(path)
+		c.record(false)
+		return "", false
+	}
+
+	c.record(true)
+	return entry.Value, true
+}
+
+// Put stores value for key and removes expired entries
+func (c *SuggestionCache) Put(key, value string) error {
+	data, err := json.Marshal(cacheEntry{Created: time.Now().Unix(), Value: value})
+	if err != nil {
+		return fmt.Errorf("failed to marshal cache entry: %w", err)
+	}
+
+	tmpPath := c.entryPath(key) + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return fmt.Errorf("failed to write cache entry: %w", err)
+	}
+	if err := os.Rename(tmpPath, c.entryPath(key)); err != nil {
+		return fmt.Errorf("failed to write cache entry: %w", err)
+	}
+
+	c.prune()
+	return nil
+}
+
+// Clear removes all cached entries and resets the statistics. It returns the
+// number of entries removed.
+func (c *SuggestionCache) Clear() (int, error) {
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read cache directory: %w", err)
+	}
+
+	removed := 0
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		if err := os.Remove(filepath.Join(c.dir, entry.Name())); err == nil && entry.Name() != cacheStatsFile {
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+// Stats returns the hit/miss counters and the number and size of entries
+func (c *SuggestionCache) Stats() CacheStats {
+	var stats CacheStats
+	if data, err := os.ReadFile(filepath.Join(c.dir, cacheStatsFile)); err == nil {
+		_ = json.Unmarshal(data, &stats)
+	}
+
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return stats
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") || entry.Name() == cacheStatsFile {
+			continue
+		}
+		if info, err := entry.Info(); err == nil {
+			stats.Entries++
+			stats.Bytes += info.Size()
+		}
+	}
+	return stats
+}
+
+func (c *SuggestionCache) entryPath(key string) string {
+	return filepath.Join(c.dir, key+".json")
+}
+
+// record counts a hit or miss. Shells update the counters concurrently, so
+// the read-modify-write holds a lock on the stats file.
+func (c *SuggestionCache) record(hit bool) {
+	file, err := os.OpenFile(filepath.Join(c.dir, cacheStatsFile), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX); err != nil {
+		return
+	}
+	defer syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+
+	var stats CacheStats
+	if data, err := io.ReadAll(file); err == nil {
+		_ = json.Unmarshal(data, &stats)
+	}
+	if hit {
+		stats.Hits++
+	} else {
+		stats.Misses++
+	}
+	data, err := json.Marshal(stats)
+	if err != nil {
+		return
+	}
+	if err := file.Truncate(0); err == nil {
+		_, _ = file.WriteAt(data, 0)
+	}
+}
+
+// prune removes entries older than the TTL
+func (c *SuggestionCache) prune() {
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return
+	}
+	cutoff := time.Now().Add(-c.ttl)
+	for _, entry := range entries {
+		if entry.IsDir() || entry.Name() == cacheStatsFile {
+			continue
+		}
+		if info, err := entry.Info(); err == nil && info.ModTime().Before(cutoff) {
+			os.Remove(filepath.Join(c.dir, entry.Name()))
+		}
+	}
+}
+
+var (
+	whitespacePattern = regexp.MustCompile(`\s+`)
+	timestampPatterns = []*regexp.Regexp{
+		// ISO 8601 / RFC 3339 and common log dates
+		regexp.MustCompile(`\d{4}-\d{2}-\d{2}[T ]\d{2}:\d{2}(:\d{2}(\.\d+)?)?(Z|[+-]\d{2}:?\d{2})?`),
+		regexp.MustCompile(`\d{4}[-/]\d{2}[-/]\d{2}`),
+		regexp.MustCompile(`\b(Mon|Tue|Wed|Thu|Fri|Sat|Sun),? +(Jan|Feb|Mar|Apr|May|Jun|Jul|Aug|Sep|Oct|Nov|Dec) +\d+`),
+		regexp.MustCompile(`\b(Jan|Feb|Mar|Apr|May|Jun|Jul|Aug|Sep|Oct|Nov|Dec) +\d+`),
+		// Clock times
+		regexp.MustCompile(`\b\d{1,2}:\d{2}(:\d{2}(\.\d+)?)?\b`),
+		// Unix timestamps
+		regexp.MustCompile(`\b1\d{9}(\.\d+)?\b`),
+		// Relative ages such as "358 (111s ago)", "(30h)" or "last 3d ago", but
+		// not durations like "--since 5m" or "sleep 30s", which change a command
+		regexp.MustCompile(`\(\d+(ms|s|m|h|d)( ago)?\)|\b\d+(ms|s|m|h|d) ago\b`),
+	}
+)
+
+// NormalizeContext returns a fingerprint of the context that ignores terminal
+// escape sequences, timestamps and whitespace differences
+func NormalizeContext(context string) string {
+	context = StripANSI(context)
+	for _, pattern := range timestampPatterns {
+		context = pattern.ReplaceAllString(context, "")
+	}
+	return strings.TrimSpace(whitespacePattern.ReplaceAllString(context, " "))
+}
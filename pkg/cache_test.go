@@ -0,0 +1,96 @@
+package pkg
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSuggestionCacheKey(t *testing.T) {
+	if SuggestionCacheKey("git") == SuggestionCacheKey("git ") {
+		t.Error("inputs differing in whitespace share a key")
+	}
+	if SuggestionCacheKey("ab", "c") == SuggestionCacheKey("a", "bc") {
+		t.Error("different splits of the same parts share a key")
+	}
+	if SuggestionCacheKey("a", "b") != SuggestionCacheKey("a", "b") {
+		t.Error("identical parts get different keys")
+	}
+}
+
+func TestSuggestionCache(t *testing.T) {
+	t.Setenv("SMART_SUGGESTION_CACHE_DIR", t.TempDir())
+	cache, err := NewSuggestionCache(time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := cache.Get("key"); ok {
+		t.Fatal("Get() hit on an empty cache")
+	}
+	if err := cache.Put("key", "+ status"); err != nil {
+		t.Fatal(err)
+	}
+	if value, ok := cache.Get("key"); !ok || value != "+ status" {
+		t.Fatalf("Get() = %q, %v, want %q, true", value, ok, "+ status")
+	}
+
+	stats := cache.Stats()
+	if stats.Hits != 1 || stats.Misses != 1 || stats.Entries != 1 {
+		t.Errorf("Stats() = %+v, want 1 hit, 1 miss and 1 entry", stats)
+	}
+}
+
+func TestSuggestionCacheConcurrentStats(t *testing.T) {
+	t.Setenv("SMART_SUGGESTION_CACHE_DIR", t.TempDir())
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Separate instances, like separate shells
+			cache, err := NewSuggestionCache(time.Minute)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			cache.Get("missing")
+		}()
+	}
+	wg.Wait()
+
+	cache, _ := NewSuggestionCache(time.Minute)
+	if stats := cache.Stats(); stats.Misses != 20 {
+		t.Errorf("Stats().Misses = %d, want 20", stats.Misses)
+	}
+}
+
+func TestNormalizeContext(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+	}{
+		{"escape sequences", "\x1b[31mfailed\x1b[0m", "failed"},
+		{"whitespace", "a  b\n\tc ", "a b c"},
+		{"timestamps", "started 2024-05-01T10:00:00Z ok", "started 2024-06-02T11:30:00Z ok"},
+		{"clock times", "12:01:02 done", "23:59:59 done"},
+		{"relative ages", "pod-a Running 3 (5m ago)", "pod-a Running 3 (17m ago)"},
+		{"relative ages in parentheses", "build finished (12s)", "build finished (3h)"},
+		{"ago", "last seen 2d ago", "last seen 40m ago"},
+	}
+	for _, tt := range tests {
+		if a, b := NormalizeContext(tt.a), NormalizeContext(tt.b); a != b {
+			t.Errorf("%s: NormalizeContext(%q) = %q, NormalizeContext(%q) = %q", tt.name, tt.a, a, tt.b, b)
+		}
+	}
+	for _, tt := range []struct{ a, b string }{
+		{"pod-a Running", "pod-a Pending"},
+		{"$ journalctl --since 5m", "$ journalctl --since 10m"},
+		{"$ sleep 1s", "$ sleep 30s"},
+		{"$ head -c 2m file", "$ head -c 5m file"},
+	} {
+		if NormalizeContext(tt.a) == NormalizeContext(tt.b) {
+			t.Errorf("%q and %q share a fingerprint", tt.a, tt.b)
+		}
+	}
+}
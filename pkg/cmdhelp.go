@@ -0,0 +1,456 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// CommandHelpConfig holds configuration for command help extraction
+type CommandHelpConfig struct {
+	// MaxBytes is the maximum size of the help snippet returned (default: 4000)
+	MaxBytes int
+	// MaxCachedBytes is the maximum size of the help text stored in the cache (default: 256KB)
+	MaxCachedBytes int
+	// Timeout is the maximum time to wait for man or --help (default: 2s)
+	Timeout time.Duration
+	// Env is the environment the command is looked up in and man or --help
+	// run with (default: the process environment)
+	Env []string
+	// HelpCommands are the commands that may be run with --help when they
+	// have no man page. Other programs might not know the flag and do their
+	// actual work instead (default: DefaultHelpCommands)
+	HelpCommands map[string]bool
+}
+
+// DefaultHelpCommands are well-known commands that print their usage for --help
+var DefaultHelpCommands = map[string]bool{
+	"apt": true, "aws": true, "az": true, "brew": true, "bun": true,
+	"cargo": true, "cat": true, "chmod": true, "chown": true, "cmake": true,
+	"conda": true, "cp": true, "curl": true, "cut": true, "date": true,
+	"deno": true, "df": true, "docker": true, "du": true, "find": true,
+	"gcloud": true, "gh": true, "git": true, "go": true, "grep": true,
+	"gzip": true, "head": true, "helm": true, "jq": true, "kubectl": true,
+	"ln": true, "ls": true, "make": true, "mkdir": true, "mv": true,
+	"node": true, "npm": true, "npx": true, "pip": true, "pip3": true,
+	"pnpm": true, "podman": true, "poetry": true, "python": true, "python3": true,
+	"rg": true, "rm": true, "rsync": true, "rustup": true, "sed": true,
+	"sort": true, "systemctl": true, "tail": true, "tar": true, "terraform": true,
+	"touch": true, "uniq": true, "uv": true, "wc": true, "wget": true,
+	"xargs": true, "yarn": true, "yq": true, "zip": true,
+}
+
+// DefaultCommandHelpConfig returns default configuration
+func DefaultCommandHelpConfig() *CommandHelpConfig {
+	return &CommandHelpConfig{
+		MaxBytes:       4000,
+		MaxCachedBytes: 256 * 1024,
+		Timeout:        2 * time.Second,
+		HelpCommands:   DefaultHelpCommands,
+	}
+}
+
+// CommandHelp is the help snippet for the command being typed
+type CommandHelp struct {
+	// Command is the resolved command name, e.g. "git"
+	Command string
+	// Subcommand is the subcommand the help was found for, if any, e.g. "commit"
+	Subcommand string
+	// Source describes where the help came from, e.g. "man git-commit" or "git commit --help"
+	Source string
+	// Text is the relevant, truncated section of the help output
+	Text string
+}
+
+// Title returns the command (and subcommand) the help is about
+func (h *CommandHelp) Title() string {
+	if h.Subcommand != "" {
+		return h.Command + " " + h.Subcommand
+	}
+	return h.Command
+}
+
+// commandWrappers are commands that run the command given as their
+// arguments, with their options that take a separate value
+var commandWrappers = map[string][]string{
+	"sudo":    {"-u", "--user", "-g", "--group", "-C", "--close-from", "-D", "--chdir", "-h", "--host", "-p", "--prompt", "-R", "--chroot", "-r", "--role", "-t", "--type", "-T", "--command-timeout", "-U", "--other-user"},
+	"doas":    {"-u", "-C"},
+	"env":     {"-u", "--unset", "-C", "--chdir", "-S", "--split-string"},
+	"time":    {"-f", "--format", "-o", "--output"},
+	"nohup":   nil,
+	"nice":    {"-n", "--adjustment"},
+	"command": nil,
+	"exec":    {"-a"},
+	"builtin": nil,
+	"noglob":  nil,
+}
+
+var (
+	commandSeparators = regexp.MustCompile(`\|\||&&|[;|&]`)
+	envAssignment     = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*=`)
+	subcommandPattern = regexp.MustCompile(`^[a-z][a-z0-9_-]*$`)
+	overstrike        = regexp.MustCompile(`.\x08`)
+	optionLine        = regexp.MustCompile(`^\s+-`)
+)
+
+// ParseCommandLine extracts the command, its possible subcommand and the flags
+// typed so far from the last command in the user input
+func ParseCommandLine(input string) (command, subcommand string, flags []string) {
+	segments := commandSeparators.Split(input, -1)
+	if len(segments) == 0 {
+		return "", "", nil
+	}
+	fields := strings.Fields(segments[len(segments)-1])
+
+	i := 0
+	var wrapperOptions []string
+	for ; i < len(fields); i++ {
+		field := fields[i]
+		if options, ok := commandWrappers[field]; ok {
+			wrapperOptions = options
+			continue
+		}
+		if envAssignment.MatchString(field) {
+			continue
+		}
+		// Skip options given to wrappers, and the value of those that take
+		// one such as "sudo -u root"
+		if strings.HasPrefix(field, "-") {
+			if slices.Contains(wrapperOptions, field) {
+				i++
+			}
+			continue
+		}
+		break
+	}
+	if i >= len(fields) {
+		return "", "", nil
+	}
+
+	command = filepath.Base(fields[i])
+	for _, field := range fields[i+1:] {
+		if strings.HasPrefix(field, "-") {
+			flag := field
+			if eq := strings.Index(flag, "="); eq != -1 {
+				flag = flag[:eq]
+			}
+			if flag != "-" && flag != "--" {
+				flags = append(flags, flag)
+			}
+			continue
+		}
+		if subcommand == "" && len(flags) == 0 && subcommandPattern.MatchString(field) {
+			subcommand = field
+		}
+	}
+	return command, subcommand, flags
+}
+
+// GetCommandHelp returns the relevant part of the man page or --help output for
+// the command being typed in input. Help texts are cached on disk, keyed by the
+// resolved binary and its modification time, so they follow the installed version.
+func GetCommandHelp(input string, config *CommandHelpConfig) (*CommandHelp, error) {
+	if config == nil {
+		config = DefaultCommandHelpConfig()
+	}
+
+	command, subcommand, flags := ParseCommandLine(input)
+	if command == "" {
+		return nil, fmt.Errorf("no command found in input")
+	}
+
+	binary, err := lookPath(command, config.Env)
+	if err != nil {
+		return nil, fmt.Errorf("command %s not found in PATH: %w", command, err)
+	}
+
+	source, text, err := loadCommandHelp(binary, command, "", config)
+	if err != nil {
+		return nil, err
+	}
+	help := &CommandHelp{Command: command, Source: source}
+
+	// Only ask for subcommand help when the command's own help lists the
+	// subcommand; otherwise "rm foo" would end up running "rm foo --help"
+	if subcommand != "" && helpMentionsWord(text, subcommand) {
+		if subSource, subText, err := loadCommandHelp(binary, command, subcommand, config); err == nil {
+			help.Subcommand = subcommand
+			help.Source = subSource
+			text = subText
+		}
+	}
+
+	help.Text = extractRelevantHelp(text, flags, config.MaxBytes)
+	return help, nil
+}
+
+// loadCommandHelp returns the full help text from the cache or by running man/--help
+func loadCommandHelp(binary, command, subcommand string, config *CommandHelpConfig) (string, string, error) {
+	info, err := os.Stat(binary)
+	if err != nil {
+		return "", "", err
+	}
+
+	key := sha1.Sum([]byte(fmt.Sprintf("%s\x00%s\x00%d", binary, subcommand, info.ModTime().UnixNano())))
+	cachePath := ""
+	if dir, err := CacheDir("help"); err == nil {
+		cachePath = filepath.Join(dir, hex.EncodeToString(key[:]))
+		if cached, err := os.Stat(cachePath); err == nil {
+			// An empty entry records that there was no help, so commands
+			// without any aren't run again on every keystroke. Retry after a
+			// while in case a man page has been installed since
+			if cached.Size() == 0 {
+				if time.Since(cached.ModTime()) < negativeHelpTTL {
+					return "", "", fmt.Errorf("no help output for %s", command)
+				}
+			} else if data, err := os.ReadFile(cachePath); err == nil {
+				source, text, _ := strings.Cut(string(data), "\n")
+				return source, text, nil
+			}
+		}
+	}
+
+	source, text := runCommandHelp(binary, command, subcommand, config)
+	if text == "" {
+		if cachePath != "" {
+			_ = os.WriteFile(cachePath, nil, 0600)
+		}
+		return "", "", fmt.Errorf("no help output for %s", command)
+	}
+	text = truncateString(text, config.MaxCachedBytes)
+
+	if cachePath != "" {
+		_ = os.WriteFile(cachePath, []byte(source+"\n"+text), 0600)
+	}
+	return source, text, nil
+}
+
+// negativeHelpTTL is how long a command without help isn't asked again
+const negativeHelpTTL = 24 * time.Hour
+
+// runCommandHelp tries the man page first and falls back to --help for the
+// commands in config.HelpCommands
+func runCommandHelp(binary, command, subcommand string, config *CommandHelpConfig) (string, string) {
+	var attempts [][]string
+	if subcommand != "" {
+		attempts = append(attempts, []string{"man", command + "-" + subcommand})
+		if config.HelpCommands[command] {
+			attempts = append(attempts, []string{binary, subcommand, "--help"})
+		}
+	} else {
+		attempts = append(attempts, []string{"man", command})
+		if config.HelpCommands[command] {
+			attempts = append(attempts, []string{binary, "--help"})
+		}
+	}
+
+	for _, args := range attempts {
+		output := runHelpCommand(args, config)
+		if output != "" {
+			source := strings.Join(args, " ")
+			if args[0] == binary {
+				source = strings.Join(append([]string{command}, args[1:]...), " ")
+			}
+			return source, output
+		}
+	}
+	return "", ""
+}
+
+func runHelpCommand(args []string, config *CommandHelpConfig) string {
+	ctx, cancel := context.WithTimeout(context.Background(), config.Timeout)
+	defer cancel()
+
+	env := config.Env
+	if env == nil {
+		env = os.Environ()
+	}
+	name, err := lookPath(args[0], env)
+	if err != nil {
+		return ""
+	}
+	cmd := exec.CommandContext(ctx, name, args[1:]...)
+	cmd.Env = append(env[:len(env):len(env)], "MANPAGER=cat", "PAGER=cat", "MANWIDTH=100", "GIT_PAGER=cat")
+	cmd.Stdin = nil
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	// Many programs print --help to stderr
+	cmd.Stderr = &out
+	err = cmd.Run()
+	if ctx.Err() != nil {
+		return ""
+	}
+
+	text := strings.TrimSpace(overstrike.ReplaceAllString(out.String(), ""))
+	// man exits non-zero when there is no page; --help may exit non-zero but still print usage
+	if err != nil && (args[0] == "man" || !strings.Contains(strings.ToLower(text), "usage")) {
+		return ""
+	}
+	return text
+}
+
+// lookPath is exec.LookPath with the PATH of env, or of the process if env
+// is nil
+func lookPath(file string, env []string) (string, error) {
+	if env == nil || strings.Contains(file, "/") {
+		return exec.LookPath(file)
+	}
+	var path string
+	for _, entry := range env {
+		if value, ok := strings.CutPrefix(entry, "PATH="); ok {
+			path = value
+		}
+	}
+	for _, dir := range filepath.SplitList(path) {
+		// Relative PATH entries would depend on the working directory
+		if !filepath.IsAbs(dir) {
+			continue
+		}
+		candidate := filepath.Join(dir, file)
+		if info, err := os.Stat(candidate); err == nil && info.Mode().IsRegular() && info.Mode()&0111 != 0 {
+			return candidate, nil
+		}
+	}
+	return "", fmt.Errorf("%s: %w", file, exec.ErrNotFound)
+}
+
+// extractRelevantHelp returns the synopsis plus the paragraphs that describe the
+// flags typed so far, or the head of the help text if no flags were typed
+func extractRelevantHelp(text string, flags []string, maxBytes int) string {
+	paragraphs := splitHelpParagraphs(text)
+	if len(paragraphs) == 0 {
+		return ""
+	}
+
+	var selected []string
+	size := 0
+	add := func(p string) bool {
+		if size+len(p) > maxBytes {
+			return false
+		}
+		selected = append(selected, p)
+		size += len(p) + 1
+		return true
+	}
+
+	// Always keep the first paragraph (name/usage/synopsis)
+	add(truncateString(paragraphs[0], maxBytes))
+
+	if len(flags) > 0 {
+		for _, p := range paragraphs[1:] {
+			if helpParagraphMentions(p, flags) && !add(p) {
+				break
+			}
+		}
+	}
+
+	for _, p := range paragraphs[1:] {
+		if len(flags) > 0 && helpParagraphMentions(p, flags) {
+			continue
+		}
+		if !add(p) {
+			break
+		}
+	}
+
+	return strings.Join(selected, "\n")
+}
+
+func splitHelpParagraphs(text string) []string {
+	var paragraphs []string
+	var current []string
+	for _, line := range strings.Split(text, "\n") {
+		if strings.TrimSpace(line) == "" {
+			if len(current) > 0 {
+				paragraphs = append(paragraphs, strings.Join(current, "\n"))
+				current = nil
+			}
+			continue
+		}
+		// Each option definition starts its own block so it can be selected by flag
+		if optionLine.MatchString(line) && len(current) > 0 {
+			paragraphs = append(paragraphs, strings.Join(current, "\n"))
+			current = nil
+		}
+		current = append(current, strings.TrimRight(line, " \t"))
+	}
+	if len(current) > 0 {
+		paragraphs = append(paragraphs, strings.Join(current, "\n"))
+	}
+	return paragraphs
+}
+
+// helpSpace holds the characters regexp's \s matches
+const helpSpace = " \t\n\f\r"
+
+// helpMentionsWord reports whether word appears in text on its own, followed
+// by whitespace, a comma or the end of the text
+func helpMentionsWord(text, word string) bool {
+	if word == "" {
+		return false
+	}
+	for offset := 0; ; {
+		i := strings.Index(text[offset:], word)
+		if i < 0 {
+			return false
+		}
+		start, end := offset+i, offset+i+len(word)
+		if (start == 0 || strings.IndexByte(helpSpace, text[start-1]) >= 0) &&
+			(end == len(text) || strings.IndexByte(helpSpace+",", text[end]) >= 0) {
+			return true
+		}
+		offset = start + 1
+	}
+}
+
+// helpParagraphMentions reports whether the paragraph defines one of the
+// flags, either first or after a short alias as in "-x, --extract"
+func helpParagraphMentions(paragraph string, flags []string) bool {
+	paragraph = strings.TrimLeft(paragraph, helpSpace)
+	var alias string
+	if i := strings.IndexAny(paragraph, helpSpace); i > 2 && paragraph[0] == '-' && paragraph[i-1] == ',' {
+		alias = strings.TrimLeft(paragraph[i:], helpSpace)
+	}
+	for _, flag := range flags {
+		names := []string{flag}
+		// Combined short flags like -xvf are matched letter by letter
+		if !strings.HasPrefix(flag, "--") && len(flag) > 2 {
+			names = nil
+			for _, r := range flag[1:] {
+				names = append(names, "-"+string(r))
+			}
+		}
+		for _, name := range names {
+			if startsWithOption(paragraph, name) || (alias != "" && startsWithOption(alias, name)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func startsWithOption(text, name string) bool {
+	rest, ok := strings.CutPrefix(text, name)
+	return ok && (rest == "" || strings.IndexByte(helpSpace+",=[", rest[0]) >= 0)
+}
+
+// truncateString cuts s to at most maxBytes without splitting a UTF-8 character
+func truncateString(s string, maxBytes int) string {
+	if len(s) <= maxBytes {
+		return s
+	}
+	for maxBytes > 0 && !utf8.RuneStart(s[maxBytes]) {
+		maxBytes--
+	}
+	return s[:maxBytes]
+}
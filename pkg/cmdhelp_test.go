@@ -0,0 +1,156 @@
+package pkg
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestParseCommandLine(t *testing.T) {
+	tests := []struct {
+		input      string
+		command    string
+		subcommand string
+		flags      []string
+	}{
+		{"git commit -am", "git", "commit", []string{"-am"}},
+		{"tar -xzf archive.tar.gz", "tar", "", []string{"-xzf"}},
+		{"ls | grep --color=auto", "grep", "", []string{"--color"}},
+		{"cd src && FOO=1 make test", "make", "test", nil},
+		{"sudo -u root systemctl restart", "systemctl", "restart", nil},
+		{"sudo -E -u www-data php -v", "php", "", []string{"-v"}},
+		{"sudo --user=root apt install", "apt", "install", nil},
+		{"nice -n 10 make -j8", "make", "", []string{"-j8"}},
+		{"env -u HOME -i /usr/bin/ls -la", "ls", "", []string{"-la"}},
+		{"time -f %e go build", "go", "build", nil},
+		{"sudo -- kill -9", "kill", "", []string{"-9"}},
+		{"sudo -u", "", "", nil},
+		{"", "", "", nil},
+	}
+	for _, tt := range tests {
+		command, subcommand, flags := ParseCommandLine(tt.input)
+		if command != tt.command || subcommand != tt.subcommand || !reflect.DeepEqual(flags, tt.flags) {
+			t.Errorf("ParseCommandLine(%q) = %q, %q, %q, want %q, %q, %q", tt.input, command, subcommand, flags, tt.command, tt.subcommand, tt.flags)
+		}
+	}
+}
+
+func TestTruncateString(t *testing.T) {
+	tests := []struct {
+		s        string
+		maxBytes int
+		want     string
+	}{
+		{"hello", 10, "hello"},
+		{"hello", 3, "hel"},
+		{"héllo", 2, "h"},
+		{"héllo", 3, "hé"},
+		{"日本語", 5, "日"},
+		{"日本語", 2, ""},
+	}
+	for _, tt := range tests {
+		got := truncateString(tt.s, tt.maxBytes)
+		if got != tt.want || !utf8.ValidString(got) {
+			t.Errorf("truncateString(%q, %d) = %q, want %q", tt.s, tt.maxBytes, got, tt.want)
+		}
+	}
+}
+
+func TestGetCommandHelpOnlyRunsAllowedCommands(t *testing.T) {
+	t.Setenv("SMART_SUGGESTION_CACHE_DIR", t.TempDir())
+	dir := t.TempDir()
+	runs := filepath.Join(dir, "runs")
+	script := func(name, output string) {
+		t.Helper()
+		content := "#!/bin/sh\necho \"$@\" >> " + runs + "\n" + output
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	script("deploy", "echo 'usage: deploy [-f]'\n")
+	script("mytool", "echo 'usage: mytool [-x]'\necho\necho '  -x  extended mode'\n")
+	script("quiet", "")
+
+	config := DefaultCommandHelpConfig()
+	config.Env = []string{"PATH=" + dir}
+	config.HelpCommands = map[string]bool{"mytool": true, "quiet": true}
+	invocations := func() []string {
+		data, _ := os.ReadFile(runs)
+		return strings.Fields(string(data))
+	}
+
+	// Unknown programs might act on --help, so they are never run
+	if _, err := GetCommandHelp("deploy -f", config); err == nil {
+		t.Error("GetCommandHelp(deploy) succeeded, want no help")
+	}
+	if got := invocations(); len(got) != 0 {
+		t.Fatalf("deploy was run with %q", got)
+	}
+
+	help, err := GetCommandHelp("mytool -x", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if help.Source != "mytool --help" || !strings.Contains(help.Text, "extended mode") {
+		t.Errorf("GetCommandHelp(mytool) = %+v", help)
+	}
+
+	// Commands without help are remembered and not run again
+	for range 2 {
+		if _, err := GetCommandHelp("quiet", config); err == nil {
+			t.Error("GetCommandHelp(quiet) succeeded, want no help")
+		}
+	}
+	if got := invocations(); !reflect.DeepEqual(got, []string{"--help", "--help"}) {
+		t.Errorf("invocations = %q, want mytool and quiet once each", got)
+	}
+}
+
+func TestHelpParagraphMentions(t *testing.T) {
+	tests := []struct {
+		paragraph string
+		flags     []string
+		want      bool
+	}{
+		{"  -x  extract files", []string{"-x"}, true},
+		{"  -x, --extract  extract files", []string{"--extract"}, true},
+		{"-x,\t--extract=DIR", []string{"--extract"}, true},
+		{"  --color[=WHEN]  colorize", []string{"--color"}, true},
+		{"  -f FILE  use archive FILE", []string{"-xzf"}, true},
+		{"  -v  verbose", []string{"-xzf"}, false},
+		{"  --extract-all  everything", []string{"--extract"}, false},
+		{"  see -x for details", []string{"-x"}, false},
+		{"  -a, -b, --both", []string{"--both"}, false},
+		{"", []string{"-x"}, false},
+		{"  -x", nil, false},
+	}
+	for _, tt := range tests {
+		if got := helpParagraphMentions(tt.paragraph, tt.flags); got != tt.want {
+			t.Errorf("helpParagraphMentions(%q, %q) = %v, want %v", tt.paragraph, tt.flags, got, tt.want)
+		}
+	}
+}
+
+func TestHelpMentionsWord(t *testing.T) {
+	tests := []struct {
+		text, word string
+		want       bool
+	}{
+		{"commit", "commit", true},
+		{"usage: git commit [-a]", "commit", true},
+		{"commands:\n  commit, push", "commit", true},
+		{"usage: git commits", "commit", false},
+		{"recommit everything", "commit", false},
+		{"recommit or commit", "commit", true},
+		{"git-commit", "commit", false},
+		{"anything", "", false},
+	}
+	for _, tt := range tests {
+		if got := helpMentionsWord(tt.text, tt.word); got != tt.want {
+			t.Errorf("helpMentionsWord(%q, %q) = %v, want %v", tt.text, tt.word, got, tt.want)
+		}
+	}
+}
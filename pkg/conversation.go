@@ -0,0 +1,113 @@
+package pkg
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+// ErrNoConversation is returned by LoadConversation when the session has no
+// suggestion to refine
+var ErrNoConversation = errors.New("no previous suggestion in this session")
+
+// maxConversationTurns is how many turns a conversation keeps. The first
+// request and answer are always kept, as the follow-ups refer to them.
+const maxConversationTurns = 12
+
+var unsafeConversationKey = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+
+// ConversationTurn is one message of a conversation with the provider
+type ConversationTurn struct {
+	// Role is "user" or "assistant"
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+// Conversation is the last suggestion request of a shell session and its
+// follow-ups, kept so the suggestion can be refined
+type Conversation struct {
+	Provider     string `json:"provider"`
+	SystemPrompt string `json:"system_prompt"`
+	Context      bool   `json:"context,omitempty"`
+	// Input is the command line the first suggestion was made for
+	Input string `json:"input"`
+	// NaturalLanguage is set when the input was a natural language intent
+	NaturalLanguage bool               `json:"natural_language,omitempty"`
+	Turns           []ConversationTurn `json:"turns"`
+	UpdatedAt       time.Time          `json:"updated_at"`
+}
+
+// Append adds a request and its answer, dropping the oldest follow-ups when
+// the conversation gets too long
+func (c *Conversation) Append(request, answer string) {
+	c.Turns = append(c.Turns,
+		ConversationTurn{Role: "user", Content: request},
+		ConversationTurn{Role: "assistant", Content: answer},
+	)
+	if len(c.Turns) > maxConversationTurns {
+		c.Turns = append(c.Turns[:2:2], c.Turns[len(c.Turns)-maxConversationTurns+2:]...)
+	}
+}
+
+// LoadConversation reads the conversation of a session, or returns
+// ErrNoConversation if there is none
+func LoadConversation(session string) (*Conversation, error) {
+	path, err := conversationPath(session)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNoConversation
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read conversation: %w", err)
+	}
+
+	// A corrupt file is replaced by the next suggestion
+	var conversation Conversation
+	if err := json.Unmarshal(data, &conversation); err != nil {
+		return nil, fmt.Errorf("%w (unreadable conversation: %v)", ErrNoConversation, err)
+	}
+	if len(conversation.Turns) == 0 {
+		return nil, ErrNoConversation
+	}
+	return &conversation, nil
+}
+
+// Save writes the conversation of a session, replacing the previous one
+func (c *Conversation) Save(session string) error {
+	path, err := conversationPath(session)
+	if err != nil {
+		return err
+	}
+	c.UpdatedAt = time.Now()
+	data, err := json.Marshal(c)
+	if err != nil {
+		return fmt.Errorf("failed to marshal conversation: %w", err)
+	}
+
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return fmt.Errorf("failed to write conversation: %w", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed to write conversation: %w", err)
+	}
+	return nil
+}
+
+func conversationPath(session string) (string, error) {
+	if session == "" {
+		return "", fmt.Errorf("no session to keep the conversation in")
+	}
+	dir, err := CacheDir("conversations")
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, unsafeConversationKey.ReplaceAllString(session, "_")+".json"), nil
+}
@@ -0,0 +1,96 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestConversationAppend(t *testing.T) {
+	var conversation Conversation
+	for i := range 10 {
+		conversation.Append(fmt.Sprintf("request %d", i), fmt.Sprintf("answer %d", i))
+	}
+	if len(conversation.Turns) != maxConversationTurns {
+		t.Fatalf("len(Turns) = %d, want %d", len(conversation.Turns), maxConversationTurns)
+	}
+
+	// The first request and answer stay, followed by the latest follow-ups
+	var got []string
+	for _, turn := range conversation.Turns {
+		got = append(got, turn.Role+": "+turn.Content)
+	}
+	want := []string{"user: request 0", "assistant: answer 0"}
+	for i := 5; i < 10; i++ {
+		want = append(want, fmt.Sprintf("user: request %d", i), fmt.Sprintf("assistant: answer %d", i))
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Turns = %q, want %q", got, want)
+	}
+}
+
+func TestConversationSaveLoad(t *testing.T) {
+	t.Setenv("SMART_SUGGESTION_CACHE_DIR", t.TempDir())
+
+	if _, err := LoadConversation("/dev/pts/3"); !errors.Is(err, ErrNoConversation) {
+		t.Errorf("LoadConversation() without a file = %v, want ErrNoConversation", err)
+	}
+
+	conversation := &Conversation{Provider: "openai", SystemPrompt: "prompt", Context: true, Input: "git pu", NaturalLanguage: true}
+	conversation.Append("git pu", "=git push")
+	if err := conversation.Save("/dev/pts/3"); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadConversation("/dev/pts/3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !loaded.UpdatedAt.Equal(conversation.UpdatedAt) || loaded.UpdatedAt.IsZero() {
+		t.Errorf("UpdatedAt = %v, want %v", loaded.UpdatedAt, conversation.UpdatedAt)
+	}
+	loaded.UpdatedAt = conversation.UpdatedAt
+	if !reflect.DeepEqual(loaded, conversation) {
+		t.Errorf("LoadConversation() = %+v, want %+v", loaded, conversation)
+	}
+
+	// Sessions are kept apart
+	if _, err := LoadConversation("/dev/pts/4"); !errors.Is(err, ErrNoConversation) {
+		t.Errorf("LoadConversation() of another session = %v, want ErrNoConversation", err)
+	}
+	if err := conversation.Save(""); err == nil {
+		t.Error("Save() without a session succeeded")
+	}
+}
+
+func TestLoadConversationCorrupt(t *testing.T) {
+	t.Setenv("SMART_SUGGESTION_CACHE_DIR", t.TempDir())
+	path, err := conversationPath("session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Base(path) != "session.json" {
+		t.Errorf("conversationPath() = %s", path)
+	}
+
+	for _, content := range []string{`{"provider": "openai", "turns": [`, `{"turns": []}`, ""} {
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if conversation, err := LoadConversation("session"); !errors.Is(err, ErrNoConversation) {
+			t.Errorf("LoadConversation() of %q = %+v, %v, want ErrNoConversation", content, conversation, err)
+		}
+	}
+
+	// The next suggestion replaces the corrupt file
+	conversation := &Conversation{Input: "ls"}
+	conversation.Append("ls", "=ls -la")
+	if err := conversation.Save("session"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadConversation("session"); err != nil {
+		t.Errorf("LoadConversation() after saving = %v", err)
+	}
+}
@@ -0,0 +1,205 @@
+package pkg
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ErrDaemonNotRunning is returned by QueryDaemon when no daemon is listening
+var ErrDaemonNotRunning = errors.New("daemon is not running")
+
+// DaemonError is an error reported by the daemon while handling a request, as
+// opposed to a failure to reach it
+type DaemonError struct {
+	Message string
+}
+
+func (e *DaemonError) Error() string {
+	return e.Message
+}
+
+// DaemonRequest is a request sent to the daemon socket, one JSON object per
+// line. Command is "suggest", "status" or "stop".
+type DaemonRequest struct {
+	Command string             `json:"command"`
+	Suggest *SuggestionRequest `json:"suggest,omitempty"`
+}
+
+// SuggestionRequest carries everything a suggestion depends on that differs
+// between the shells using one daemon
+type SuggestionRequest struct {
+	Provider      string `json:"provider"`
+	Input         string `json:"input"`
+	SystemPrompt  string `json:"system_prompt,omitempty"`
+	Context       bool   `json:"context,omitempty"`
+	NoCache       bool   `json:"no_cache,omitempty"`
+	LocalFallback bool   `json:"local_fallback,omitempty"`
+	Debug         bool   `json:"debug,omitempty"`
+	LogFile       string `json:"log_file,omitempty"`
+	// Autosuggest asks for an as-you-type completion of the input
+	Autosuggest bool `json:"autosuggest,omitempty"`
+	// History holds the earlier turns when refining a suggestion
+	History []ConversationTurn `json:"history,omitempty"`
+	// Cwd, Env and TTY are the calling shell's working directory,
+	// environment and terminal
+	Cwd string   `json:"cwd"`
+	Env []string `json:"env"`
+	TTY string   `json:"tty,omitempty"`
+}
+
+// DaemonResponse is the reply to a DaemonRequest
+type DaemonResponse struct {
+	OK    bool   `json:"ok"`
+	Data  string `json:"data,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// DaemonHandler handles a daemon request and returns its data. ctx is canceled
+// when the client disconnects before the answer is ready.
+type DaemonHandler func(ctx context.Context, request DaemonRequest) (string, error)
+
+// DaemonSocketPath returns the per-user daemon socket:
+// $SMART_SUGGESTION_DAEMON_SOCKET, a socket in $XDG_RUNTIME_DIR, or
+// smart-suggestion-<uid>.sock in the temp directory
+func DaemonSocketPath() string {
+	if path := os.Getenv("SMART_SUGGESTION_DAEMON_SOCKET"); path != "" {
+		return path
+	}
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "smart-suggestion.sock")
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("smart-suggestion-%d.sock", os.Getuid()))
+}
+
+// DaemonServer serves suggestion requests over a Unix socket
+type DaemonServer struct {
+	path     string
+	listener net.Listener
+	handler  DaemonHandler
+	timeout  time.Duration
+	once     sync.Once
+}
+
+// NewDaemonServer listens on the Unix socket at path, readable only by the
+// current user. Each connection may take up to timeout to be answered.
+func NewDaemonServer(path string, timeout time.Duration, handler DaemonHandler) (*DaemonServer, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create daemon socket directory: %w", err)
+	}
+	listener, err := listenUnixSocket(path, "daemon")
+	if err != nil {
+		return nil, err
+	}
+	return &DaemonServer{path: path, listener: listener, handler: handler, timeout: timeout}, nil
+}
+
+// Serve accepts connections until the server is closed
+func (s *DaemonServer) Serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.serveConn(conn)
+	}
+}
+
+func (s *DaemonServer) serveConn(conn net.Conn) {
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(s.timeout))
+
+	reader := bufio.NewReaderSize(conn, 64*1024)
+	line, err := reader.ReadBytes('\n')
+	if err != nil && len(line) == 0 {
+		return
+	}
+
+	// The client closing its end means nobody waits for the answer anymore
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_, _ = reader.ReadByte()
+		cancel()
+	}()
+
+	var request DaemonRequest
+	var response DaemonResponse
+	if err := json.Unmarshal(line, &request); err != nil {
+		response.Error = fmt.Sprintf("invalid request: %v", err)
+	} else if data, err := s.handler(ctx, request); err != nil {
+		response.Error = err.Error()
+	} else {
+		response.OK = true
+		response.Data = data
+	}
+
+	data, err := json.Marshal(response)
+	if err != nil {
+		return
+	}
+	_, _ = conn.Write(append(data, '\n'))
+}
+
+// Close stops the server and removes the socket
+func (s *DaemonServer) Close() error {
+	var err error
+	s.once.Do(func() {
+		err = s.listener.Close()
+		os.Remove(s.path)
+	})
+	return err
+}
+
+// QueryDaemon sends a request to the daemon socket and returns its data. The
+// request carries the caller's environment, so the socket has to be owned by
+// the current user. ErrDaemonNotRunning is returned when nothing listens on it
+// and a *DaemonError when the daemon failed to handle the request.
+func QueryDaemon(path string, request DaemonRequest, timeout time.Duration) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", ErrDaemonNotRunning
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok && int(stat.Uid) != os.Getuid() {
+		return "", fmt.Errorf("daemon socket %s is owned by another user", path)
+	}
+
+	conn, err := net.DialTimeout("unix", path, 100*time.Millisecond)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrDaemonNotRunning, err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+
+	data, err := json.Marshal(request)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal request: %w", err)
+	}
+	if _, err := conn.Write(append(data, '\n')); err != nil {
+		return "", fmt.Errorf("failed to send request: %w", err)
+	}
+
+	reader := bufio.NewReaderSize(conn, 64*1024)
+	line, err := reader.ReadBytes('\n')
+	if err != nil && len(line) == 0 {
+		return "", fmt.Errorf("failed to read response: %w", err)
+	}
+
+	var response DaemonResponse
+	if err := json.Unmarshal(line, &response); err != nil {
+		return "", fmt.Errorf("failed to unmarshal response: %w", err)
+	}
+	if !response.OK {
+		return "", &DaemonError{Message: strings.TrimSpace(response.Error)}
+	}
+	return response.Data, nil
+}
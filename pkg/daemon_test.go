@@ -0,0 +1,170 @@
+package pkg
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func startTestDaemon(t *testing.T, handler DaemonHandler) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "daemon.sock")
+	server, err := NewDaemonServer(path, 5*time.Second, handler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve()
+	t.Cleanup(func() { server.Close() })
+	return path
+}
+
+func TestQueryDaemon(t *testing.T) {
+	path := startTestDaemon(t, func(ctx context.Context, request DaemonRequest) (string, error) {
+		switch request.Command {
+		case "suggest":
+			s := request.Suggest
+			return fmt.Sprintf("%s|%s|%s|%s|%d", s.Provider, s.Input, s.Cwd, strings.Join(s.Env, ","), len(s.History)), nil
+		case "status":
+			return "multi\nline", nil
+		}
+		return "", fmt.Errorf("unknown command %q\n", request.Command)
+	})
+
+	data, err := QueryDaemon(path, DaemonRequest{Command: "suggest", Suggest: &SuggestionRequest{
+		Provider: "openai",
+		Input:    "git pu",
+		Cwd:      "/src",
+		Env:      []string{"A=1", "B=2"},
+		History:  []ConversationTurn{{Role: "user", Content: "git pu"}, {Role: "assistant", Content: "=git push"}},
+	}}, time.Second)
+	if err != nil || data != "openai|git pu|/src|A=1,B=2|2" {
+		t.Errorf("QueryDaemon(suggest) = %q, %v", data, err)
+	}
+	if data, err := QueryDaemon(path, DaemonRequest{Command: "status"}, time.Second); err != nil || data != "multi\nline" {
+		t.Errorf("QueryDaemon(status) = %q, %v", data, err)
+	}
+
+	// Errors of the handler are told apart from failures to reach the daemon
+	_, err = QueryDaemon(path, DaemonRequest{Command: "bogus"}, time.Second)
+	var daemonErr *DaemonError
+	if !errors.As(err, &daemonErr) || daemonErr.Message != `unknown command "bogus"` || errors.Is(err, ErrDaemonNotRunning) {
+		t.Errorf("QueryDaemon(bogus) = %v, want a DaemonError", err)
+	}
+
+	// A malformed request is answered with an error
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "not json\n")
+	line, _ := bufio.NewReader(conn).ReadBytes('\n')
+	var response DaemonResponse
+	if err := json.Unmarshal(line, &response); err != nil || response.OK || !strings.HasPrefix(response.Error, "invalid request") {
+		t.Errorf("response to a malformed request = %q", line)
+	}
+}
+
+func TestQueryDaemonNotRunning(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := QueryDaemon(filepath.Join(dir, "missing.sock"), DaemonRequest{Command: "status"}, time.Second); !errors.Is(err, ErrDaemonNotRunning) {
+		t.Errorf("QueryDaemon() without a socket = %v, want ErrDaemonNotRunning", err)
+	}
+
+	// A socket left behind by a daemon that crashed
+	stale := filepath.Join(dir, "stale.sock")
+	listener, err := net.Listen("unix", stale)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	listener.Close()
+	if _, err := QueryDaemon(stale, DaemonRequest{Command: "status"}, time.Second); !errors.Is(err, ErrDaemonNotRunning) {
+		t.Errorf("QueryDaemon() on a stale socket = %v, want ErrDaemonNotRunning", err)
+	}
+}
+
+func TestQueryDaemonOtherUser(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("changing the socket owner needs root")
+	}
+	called := make(chan struct{}, 1)
+	path := startTestDaemon(t, func(ctx context.Context, request DaemonRequest) (string, error) {
+		called <- struct{}{}
+		return "", nil
+	})
+	if err := os.Chown(path, 12345, 12345); err != nil {
+		t.Fatal(err)
+	}
+
+	// The request would hand the caller's environment to another user
+	_, err := QueryDaemon(path, DaemonRequest{Command: "suggest", Suggest: &SuggestionRequest{Env: []string{"API_KEY=secret"}}}, time.Second)
+	if err == nil || !strings.Contains(err.Error(), "owned by another user") || errors.Is(err, ErrDaemonNotRunning) {
+		t.Errorf("QueryDaemon() = %v, want an owner error", err)
+	}
+	select {
+	case <-called:
+		t.Error("the request reached the daemon")
+	default:
+	}
+}
+
+func TestQueryDaemonTimeout(t *testing.T) {
+	canceled := make(chan struct{})
+	path := startTestDaemon(t, func(ctx context.Context, request DaemonRequest) (string, error) {
+		<-ctx.Done()
+		close(canceled)
+		return "", ctx.Err()
+	})
+
+	start := time.Now()
+	_, err := QueryDaemon(path, DaemonRequest{Command: "suggest", Suggest: &SuggestionRequest{}}, 200*time.Millisecond)
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Errorf("QueryDaemon() of a request that takes too long = %v, want a timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("QueryDaemon() returned after %v", elapsed)
+	}
+
+	// The daemon stops working on a request nobody waits for
+	select {
+	case <-canceled:
+	case <-time.After(2 * time.Second):
+		t.Error("the handler's context was not canceled")
+	}
+}
+
+func TestDaemonServesConcurrently(t *testing.T) {
+	var arrived sync.WaitGroup
+	arrived.Add(2)
+	path := startTestDaemon(t, func(ctx context.Context, request DaemonRequest) (string, error) {
+		// Each request waits for the other, so serving them one at a time
+		// would time out
+		arrived.Done()
+		arrived.Wait()
+		return request.Suggest.Input, nil
+	})
+
+	var wg sync.WaitGroup
+	for _, input := range []string{"a", "b"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			data, err := QueryDaemon(path, DaemonRequest{Command: "suggest", Suggest: &SuggestionRequest{Input: input}}, 2*time.Second)
+			if err != nil || data != input {
+				t.Errorf("QueryDaemon(%s) = %q, %v", input, data, err)
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,124 @@
+package pkg
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Diagnosis is the likely root cause of an error and the command to run next
+type Diagnosis struct {
+	Summary string
+	// Command is the next diagnostic command, or "" if there is none
+	Command string
+}
+
+// ParseDiagnosis extracts the diagnosis from a model response: the summary
+// lines, optionally prefixed with "Diagnosis:", and the command on a line
+// prefixed with an equal sign
+func ParseDiagnosis(response string) (*Diagnosis, error) {
+	var diagnosis Diagnosis
+	var summary []string
+	for _, line := range strings.Split(response, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "```") {
+			continue
+		}
+		if command, ok := strings.CutPrefix(line, "="); ok {
+			diagnosis.Command = strings.TrimSpace(command)
+			continue
+		}
+		if len(line) >= len("diagnosis:") && strings.EqualFold(line[:len("diagnosis:")], "diagnosis:") {
+			line = strings.TrimSpace(line[len("diagnosis:"):])
+		}
+		summary = append(summary, line)
+	}
+	diagnosis.Summary = strings.Join(summary, "\n")
+	if diagnosis.Summary == "" {
+		return nil, fmt.Errorf("response contains no diagnosis")
+	}
+	return &diagnosis, nil
+}
+
+// String formats the diagnosis for the plugin: the command prefixed with an
+// equal sign on the first line, then the summary
+func (d *Diagnosis) String() string {
+	return "=" + d.Command + "\n" + d.Summary
+}
+
+const (
+	// maxErrorRegionLines is the longest error region returned
+	maxErrorRegionLines = 60
+	// errorRegionContext is how many lines before the region are included
+	errorRegionContext = 3
+)
+
+var (
+	// errorLine matches lines that report an error
+	errorLine = regexp.MustCompile(`(?i)\b(error|errors|fatal|panic|exception|traceback|failed|failure|denied|refused|unauthorized|forbidden|timed? ?out)\b|` +
+		`\w+(Error|Exception):|` +
+		// Compiler and linter diagnostics, e.g. main.go:10:2: or src/app.ts(3,5):
+		`^\S+\.\w+(:\d+){1,2}:|^\S+\.\w+\(\d+,\d+\):|` +
+		// HTTP error statuses
+		`\b(HTTP/[\d.]+|status( code)?:?)\s+[45]\d\d\b|\b[45]\d\d (Bad Request|Unauthorized|Forbidden|Not Found|Method Not Allowed|Conflict|Too Many Requests|Internal Server Error|Bad Gateway|Service Unavailable|Gateway Timeout)\b`)
+	// stackFrameLine matches the frames of stack traces
+	stackFrameLine = regexp.MustCompile(`^\s+at \S|^\s+File ".*", line \d+|^goroutine \d+ \[|^\s+\S+\.go:\d+|^\s*\.\.\. \d+ more|^Caused by:|^\s+from \S+:\d+`)
+)
+
+// LatestErrorRegion returns the lines around the most recent error in
+// terminal output, such as a stack trace, compiler errors or a failed HTTP
+// request, or "" if the output contains no error
+func LatestErrorRegion(output string) string {
+	lines := strings.Split(strings.TrimRight(output, "\n"), "\n")
+
+	last := -1
+	for i := len(lines) - 1; i >= 0; i-- {
+		if isErrorLine(lines[i]) {
+			last = i
+			break
+		}
+	}
+	if last == -1 {
+		return ""
+	}
+
+	// Trailing frames and indented details belong to the same error
+	end := last
+	for end+1 < len(lines) && end+1-last < 10 && isErrorContinuation(lines[end+1]) {
+		end++
+	}
+
+	// Walk up through the error, allowing single blank lines inside it
+	start := last
+	for start > 0 && end-start+1 < maxErrorRegionLines {
+		previous := lines[start-1]
+		if isErrorLine(previous) || isErrorContinuation(previous) {
+			start--
+			continue
+		}
+		if strings.TrimSpace(previous) == "" && start > 1 && (isErrorLine(lines[start-2]) || isErrorContinuation(lines[start-2])) {
+			start--
+			continue
+		}
+		break
+	}
+	start = max(0, start-errorRegionContext)
+	if end-start+1 > maxErrorRegionLines {
+		start = end - maxErrorRegionLines + 1
+	}
+
+	return strings.TrimSpace(strings.Join(lines[start:end+1], "\n"))
+}
+
+func isErrorLine(line string) bool {
+	return errorLine.MatchString(line) || stackFrameLine.MatchString(line)
+}
+
+// isErrorContinuation reports whether a line continues an error message, such
+// as an indented detail or a source excerpt under a compiler error
+func isErrorContinuation(line string) bool {
+	if strings.TrimSpace(line) == "" {
+		return false
+	}
+	return stackFrameLine.MatchString(line) || line[0] == ' ' || line[0] == '\t' || strings.HasPrefix(strings.TrimSpace(line), "^")
+}
@@ -0,0 +1,143 @@
+package pkg
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLatestErrorRegion(t *testing.T) {
+	tests := []struct {
+		name      string
+		output    string
+		wantFirst string
+		wantLast  string
+	}{
+		{
+			name: "python traceback",
+			output: `$ python app.py
+Starting server
+Traceback (most recent call last):
+  File "app.py", line 10, in <module>
+    main()
+  File "app.py", line 6, in main
+    raise ValueError("bad config")
+ValueError: bad config
+$ `,
+			wantFirst: "$ python app.py",
+			wantLast:  "ValueError: bad config",
+		},
+		{
+			name: "go compile errors",
+			output: `$ git status
+nothing to commit
+$ go build ./...
+# example.com/app
+./main.go:10:2: undefined: foo
+./main.go:12:5: declared and not used: x
+$ ls
+README.md main.go`,
+			wantFirst: "nothing to commit",
+			wantLast:  "./main.go:12:5: declared and not used: x",
+		},
+		{
+			name: "http status",
+			output: `$ curl -i https://api.example.com/health
+HTTP/2 503
+content-type: text/plain`,
+			wantFirst: "$ curl -i https://api.example.com/health",
+			wantLast:  "HTTP/2 503",
+		},
+		{
+			name: "java stack trace",
+			output: `Exception in thread "main" java.lang.IllegalStateException: boom
+	at com.example.App.run(App.java:12)
+	at com.example.App.main(App.java:5)
+Caused by: java.io.IOException: disk full
+	at com.example.Store.save(Store.java:40)
+	... 2 more`,
+			wantFirst: `Exception in thread "main" java.lang.IllegalStateException: boom`,
+			wantLast:  "... 2 more",
+		},
+		{
+			name: "only the latest error",
+			output: `$ make
+error: first
+$ ls
+a
+b
+c
+d
+$ cat secret
+cat: secret: Permission denied`,
+			wantFirst: "c",
+			wantLast:  "cat: secret: Permission denied",
+		},
+		{
+			name:   "no error",
+			output: "$ ls\nfoo bar\n$ echo ok\nok\n",
+		},
+		{
+			name: "empty",
+		},
+	}
+	for _, tt := range tests {
+		region := LatestErrorRegion(tt.output)
+		if tt.wantLast == "" {
+			if region != "" {
+				t.Errorf("%s: LatestErrorRegion() = %q, want none", tt.name, region)
+			}
+			continue
+		}
+		lines := strings.Split(region, "\n")
+		first, last := strings.TrimSpace(lines[0]), strings.TrimSpace(lines[len(lines)-1])
+		if first != tt.wantFirst || last != tt.wantLast {
+			t.Errorf("%s: LatestErrorRegion() spans %q to %q, want %q to %q", tt.name, first, last, tt.wantFirst, tt.wantLast)
+		}
+	}
+}
+
+func TestLatestErrorRegionMaxLines(t *testing.T) {
+	var output []string
+	for range 100 {
+		output = append(output, "ERROR something failed")
+	}
+	output = append(output, "last error")
+	region := LatestErrorRegion(strings.Join(output, "\n"))
+	lines := strings.Split(region, "\n")
+	if len(lines) != maxErrorRegionLines || lines[len(lines)-1] != "last error" {
+		t.Errorf("LatestErrorRegion() has %d lines ending with %q, want %d ending with the last error", len(lines), lines[len(lines)-1], maxErrorRegionLines)
+	}
+}
+
+func TestParseDiagnosis(t *testing.T) {
+	tests := []struct {
+		response string
+		summary  string
+		command  string
+	}{
+		{"Diagnosis: Port 8080 is already in use.\n=lsof -i :8080", "Port 8080 is already in use.", "lsof -i :8080"},
+		{"```\n= docker ps -a\n```\nThe container exited.\nIt ran out of memory.", "The container exited.\nIt ran out of memory.", "docker ps -a"},
+		{"diagnosis: the config file is missing", "the config file is missing", ""},
+		{"\n  The build cache is stale.  \n\n", "The build cache is stale.", ""},
+	}
+	for _, tt := range tests {
+		diagnosis, err := ParseDiagnosis(tt.response)
+		if err != nil {
+			t.Errorf("ParseDiagnosis(%q) failed: %v", tt.response, err)
+			continue
+		}
+		if diagnosis.Summary != tt.summary || diagnosis.Command != tt.command {
+			t.Errorf("ParseDiagnosis(%q) = %+v, want summary %q and command %q", tt.response, diagnosis, tt.summary, tt.command)
+		}
+	}
+
+	for _, response := range []string{"", "=ls -la", "```\n```"} {
+		if diagnosis, err := ParseDiagnosis(response); err == nil {
+			t.Errorf("ParseDiagnosis(%q) = %+v, want an error", response, diagnosis)
+		}
+	}
+
+	if got := (&Diagnosis{Summary: "Disk full.", Command: "df -h"}).String(); got != "=df -h\nDisk full." {
+		t.Errorf("String() = %q", got)
+	}
+}
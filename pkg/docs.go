@@ -0,0 +1,336 @@
+package pkg
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// DocChunk is a section of a runbook file
+type DocChunk struct {
+	Path      string `json:"path"`
+	StartLine int    `json:"start_line"`
+	EndLine   int    `json:"end_line"`
+	Heading   string `json:"heading"`
+	Text      string `json:"text"`
+}
+
+// Reference returns the file reference of the chunk, e.g. "deploy.md:10-42"
+func (c *DocChunk) Reference() string {
+	return fmt.Sprintf("%s:%d-%d", c.Path, c.StartLine, c.EndLine)
+}
+
+// indexedDocFile holds the chunks of a file and the state they were built from
+type indexedDocFile struct {
+	Size    int64      `json:"size"`
+	ModTime int64      `json:"mod_time"`
+	Chunks  []DocChunk `json:"chunks"`
+}
+
+// DocsIndex is an on-disk, incrementally updated BM25 index over a directory of
+// markdown runbooks
+type DocsIndex struct {
+	Dir   string                     `json:"dir"`
+	Files map[string]*indexedDocFile `json:"files"`
+
+	chunks []*DocChunk
+	bm25   *BM25Index
+}
+
+const (
+	docsIndexVersion = 1
+	// maxDocChunkBytes is the size above which sections are split further
+	maxDocChunkBytes = 1500
+	// maxDocFileBytes is the size above which files are not indexed
+	maxDocFileBytes = 2 * 1024 * 1024
+)
+
+// loadedDocsIndexes keeps loaded indexes in memory by directory for
+// long-running processes such as the daemon
+var (
+	loadedDocsMutex   sync.Mutex
+	loadedDocsIndexes = make(map[string]*DocsIndex)
+)
+
+type docsIndexFile struct {
+	Version int        `json:"version"`
+	Index   *DocsIndex `json:"index"`
+}
+
+var docExtensions = map[string]bool{
+	".md":       true,
+	".markdown": true,
+	".txt":      true,
+	".rst":      true,
+}
+
+// LoadDocsIndex loads the index for dir from the cache directory and reindexes
+// the files that were added, changed or removed since it was last saved
+func LoadDocsIndex(dir string) (*DocsIndex, error) {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve docs directory: %w", err)
+	}
+	if info, err := os.Stat(absDir); err != nil || !info.IsDir() {
+		return nil, fmt.Errorf("docs directory %s does not exist", absDir)
+	}
+
+	cacheDir, err := CacheDir("docs")
+	if err != nil {
+		return nil, err
+	}
+	key := sha1.Sum([]byte(absDir))
+	indexPath := filepath.Join(cacheDir, hex.EncodeToString(key[:])+".json")
+
+	loadedDocsMutex.Lock()
+	defer loadedDocsMutex.Unlock()
+
+	// Requests of the daemon may still search the loaded index, so changes go
+	// into a copy that replaces it
+	loaded := loadedDocsIndexes[absDir]
+	var index *DocsIndex
+	if loaded != nil {
+		index = loaded.clone()
+	} else {
+		index = &DocsIndex{Dir: absDir, Files: make(map[string]*indexedDocFile)}
+		if data, err := os.ReadFile(indexPath); err == nil {
+			var file docsIndexFile
+			if err := json.Unmarshal(data, &file); err == nil && file.Version == docsIndexVersion && file.Index != nil && file.Index.Files != nil {
+				index = file.Index
+				index.Dir = absDir
+			}
+		}
+	}
+
+	changed, err := index.refresh()
+	if err != nil {
+		return nil, err
+	}
+	if !changed && loaded != nil {
+		return loaded, nil
+	}
+
+	if changed {
+		data, err := json.Marshal(docsIndexFile{Version: docsIndexVersion, Index: index})
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal docs index: %w", err)
+		}
+		tmpPath := indexPath + ".tmp"
+		if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+			return nil, fmt.Errorf("failed to write docs index: %w", err)
+		}
+		if err := os.Rename(tmpPath, indexPath); err != nil {
+			return nil, fmt.Errorf("failed to write docs index: %w", err)
+		}
+	}
+
+	index.buildBM25()
+	loadedDocsIndexes[absDir] = index
+	return index, nil
+}
+
+// clone returns a copy of the index with its own file map. Indexed files are
+// replaced rather than changed, so they are shared.
+func (d *DocsIndex) clone() *DocsIndex {
+	files := make(map[string]*indexedDocFile, len(d.Files))
+	maps.Copy(files, d.Files)
+	return &DocsIndex{Dir: d.Dir, Files: files}
+}
+
+// refresh walks the docs directory and rechunks files whose size or
+// modification time changed. It reports whether the index was modified.
+func (d *DocsIndex) refresh() (bool, error) {
+	changed := false
+	seen := make(map[string]bool)
+
+	err := filepath.WalkDir(d.Dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if entry.IsDir() {
+			if path != d.Dir && strings.HasPrefix(entry.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !docExtensions[strings.ToLower(filepath.Ext(path))] {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err != nil || info.Size() > maxDocFileBytes {
+			return nil
+		}
+
+		rel, err := filepath.Rel(d.Dir, path)
+		if err != nil {
+			return nil
+		}
+		seen[rel] = true
+
+		if existing, ok := d.Files[rel]; ok && existing.Size == info.Size() && existing.ModTime == info.ModTime().UnixNano() {
+			return nil
+		}
+
+		chunks, err := chunkDocFile(path, rel)
+		if err != nil {
+			return nil
+		}
+		d.Files[rel] = &indexedDocFile{
+			Size:    info.Size(),
+			ModTime: info.ModTime().UnixNano(),
+			Chunks:  chunks,
+		}
+		changed = true
+		return nil
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to walk docs directory: %w", err)
+	}
+
+	for rel := range d.Files {
+		if !seen[rel] {
+			delete(d.Files, rel)
+			changed = true
+		}
+	}
+
+	return changed, nil
+}
+
+func (d *DocsIndex) buildBM25() {
+	paths := make([]string, 0, len(d.Files))
+	for path := range d.Files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	d.chunks = nil
+	var docs []BM25Document
+	for _, path := range paths {
+		for i := range d.Files[path].Chunks {
+			chunk := &d.Files[path].Chunks[i]
+			d.chunks = append(d.chunks, chunk)
+			// Headings and file names are part of the searchable text
+			docs = append(docs, BM25Document{
+				ID:    chunk.Reference(),
+				Terms: Tokenize(chunk.Path + " " + chunk.Heading + " " + chunk.Text),
+			})
+		}
+	}
+	d.bm25 = NewBM25Index(docs)
+}
+
+// Len returns the number of indexed chunks
+func (d *DocsIndex) Len() int {
+	return len(d.chunks)
+}
+
+// Search returns up to k chunks most relevant to the query terms
+func (d *DocsIndex) Search(queryTerms []string, k int) []*DocChunk {
+	var chunks []*DocChunk
+	for _, result := range d.bm25.SearchTerms(queryTerms, k) {
+		chunks = append(chunks, d.chunks[result.Index])
+	}
+	return chunks
+}
+
+// chunkDocFile splits a markdown file into sections by heading, splitting
+// sections larger than maxDocChunkBytes at paragraph boundaries outside of
+// fenced code blocks
+func chunkDocFile(path, rel string) ([]DocChunk, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var chunks []DocChunk
+	var lines []string
+	heading := ""
+	startLine := 1
+	lineNo := 0
+	inFence := false
+
+	flush := func(endLine int) {
+		text := strings.TrimSpace(strings.Join(lines, "\n"))
+		if text != "" {
+			chunks = append(chunks, DocChunk{
+				Path:      rel,
+				StartLine: startLine,
+				EndLine:   endLine,
+				Heading:   heading,
+				Text:      text,
+			})
+		}
+		lines = nil
+		startLine = endLine + 1
+	}
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		lineNo++
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+
+		if strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~") {
+			inFence = !inFence
+		}
+
+		if !inFence && strings.HasPrefix(trimmed, "#") {
+			flush(lineNo - 1)
+			heading = strings.TrimSpace(strings.TrimLeft(trimmed, "#"))
+		} else if !inFence && trimmed == "" && chunkSize(lines) > maxDocChunkBytes {
+			flush(lineNo - 1)
+		}
+
+		lines = append(lines, line)
+	}
+	flush(lineNo)
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return chunks, nil
+}
+
+func chunkSize(lines []string) int {
+	size := 0
+	for _, line := range lines {
+		size += len(line) + 1
+	}
+	return size
+}
+
+// FormatDocChunks formats chunks with their file references, keeping the
+// total size under maxBytes
+func FormatDocChunks(chunks []*DocChunk, maxBytes int) string {
+	var parts []string
+	size := 0
+	for _, chunk := range chunks {
+		part := fmt.Sprintf("## %s", chunk.Reference())
+		if chunk.Heading != "" {
+			part += fmt.Sprintf(" (%s)", chunk.Heading)
+		}
+		part += "\n" + chunk.Text
+		if size+len(part) > maxBytes {
+			if size == 0 {
+				parts = append(parts, truncateString(part, maxBytes))
+			}
+			break
+		}
+		parts = append(parts, part)
+		size += len(part) + 2
+	}
+	return strings.Join(parts, "\n\n")
+}
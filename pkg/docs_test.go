@@ -0,0 +1,193 @@
+package pkg
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestChunkDocFile(t *testing.T) {
+	paragraph := strings.Repeat("x", 600)
+	tests := []struct {
+		name    string
+		content string
+		want    []DocChunk
+	}{
+		{
+			name:    "headings outside of code fences",
+			content: "# Deploy\nRun the deploy script.\n\n```sh\n# not a heading\n./deploy.sh\n```\n\n## Rollback\nUse the previous tag.\n",
+			want: []DocChunk{
+				{Path: "doc.md", StartLine: 1, EndLine: 8, Heading: "Deploy", Text: "# Deploy\nRun the deploy script.\n\n```sh\n# not a heading\n./deploy.sh\n```"},
+				{Path: "doc.md", StartLine: 9, EndLine: 10, Heading: "Rollback", Text: "## Rollback\nUse the previous tag."},
+			},
+		},
+		{
+			name:    "text before the first heading",
+			content: "Intro\n# Usage\nmake\n",
+			want: []DocChunk{
+				{Path: "doc.md", StartLine: 1, EndLine: 1, Text: "Intro"},
+				{Path: "doc.md", StartLine: 2, EndLine: 3, Heading: "Usage", Text: "# Usage\nmake"},
+			},
+		},
+		{
+			name:    "large sections split at paragraphs",
+			content: "# Big\n" + paragraph + "\n\n" + paragraph + "\n\n" + paragraph + "\n\n" + paragraph + "\n",
+			want: []DocChunk{
+				{Path: "doc.md", StartLine: 1, EndLine: 6, Heading: "Big", Text: "# Big\n" + paragraph + "\n\n" + paragraph + "\n\n" + paragraph},
+				{Path: "doc.md", StartLine: 7, EndLine: 8, Heading: "Big", Text: paragraph},
+			},
+		},
+		{
+			name:    "empty sections",
+			content: "# One\n\n# Two\n",
+			want: []DocChunk{
+				{Path: "doc.md", StartLine: 1, EndLine: 2, Heading: "One", Text: "# One"},
+				{Path: "doc.md", StartLine: 3, EndLine: 3, Heading: "Two", Text: "# Two"},
+			},
+		},
+		{
+			name: "empty file",
+		},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "doc.md")
+		if err := os.WriteFile(path, []byte(tt.content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		chunks, err := chunkDocFile(path, "doc.md")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(chunks) != len(tt.want) {
+			t.Errorf("%s: chunkDocFile() = %d chunks, want %d", tt.name, len(chunks), len(tt.want))
+			continue
+		}
+		for i := range chunks {
+			if chunks[i] != tt.want[i] {
+				t.Errorf("%s: chunk %d = %+v, want %+v", tt.name, i, chunks[i], tt.want[i])
+			}
+		}
+	}
+}
+
+func resetLoadedDocsIndexes(t *testing.T) {
+	t.Setenv("SMART_SUGGESTION_CACHE_DIR", t.TempDir())
+	loadedDocsIndexes = make(map[string]*DocsIndex)
+	t.Cleanup(func() { loadedDocsIndexes = make(map[string]*DocsIndex) })
+}
+
+func TestLoadDocsIndex(t *testing.T) {
+	resetLoadedDocsIndexes(t)
+	dir := t.TempDir()
+	write := func(name, content string) {
+		t.Helper()
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	search := func(index *DocsIndex, query string) []string {
+		var refs []string
+		for _, chunk := range index.Search(Tokenize(query), 5) {
+			refs = append(refs, chunk.Reference())
+		}
+		return refs
+	}
+	write("deploy.md", "# Deploy\nkubectl apply\n")
+	write("notes.txt", "rollback with helm rollback\n")
+	write(".private/secret.md", "# Rollback\nnot indexed\n")
+	write("diagram.png", "rollback")
+
+	index, err := LoadDocsIndex(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if index.Len() != 2 {
+		t.Errorf("Len() = %d, want 2", index.Len())
+	}
+	if got := search(index, "rollback"); len(got) != 1 || got[0] != "notes.txt:1-1" {
+		t.Errorf("Search(rollback) = %v, want notes.txt", got)
+	}
+
+	if again, err := LoadDocsIndex(dir); err != nil || again != index {
+		t.Errorf("LoadDocsIndex() without changes = %p, %v, want the loaded index %p", again, err, index)
+	}
+
+	// Changes replace the index; the one handed out before stays as it was
+	write("deploy.md", "# Deploy\nkubectl apply\n\n# Rollback\nkubectl rollout undo\n")
+	os.Remove(filepath.Join(dir, "notes.txt"))
+	updated, err := LoadDocsIndex(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := search(updated, "rollback"); len(got) != 1 || got[0] != "deploy.md:4-5" {
+		t.Errorf("Search(rollback) after the change = %v, want deploy.md:4-5", got)
+	}
+	if got := search(index, "rollback"); len(got) != 1 || got[0] != "notes.txt:1-1" {
+		t.Errorf("Search(rollback) on the previous index = %v, want notes.txt", got)
+	}
+
+	// A new process reads the saved index
+	loadedDocsIndexes = make(map[string]*DocsIndex)
+	reloaded, err := LoadDocsIndex(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reloaded.Len() != 2 || len(search(reloaded, "rollout")) != 1 {
+		t.Errorf("reloaded index has %d chunks, want 2", reloaded.Len())
+	}
+}
+
+func TestLoadDocsIndexConcurrent(t *testing.T) {
+	resetLoadedDocsIndexes(t)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "runbook.md")
+	write := func(sections int) {
+		var b strings.Builder
+		for i := range sections {
+			fmt.Fprintf(&b, "# Step %d\nrestart service %d\n\n", i, i)
+		}
+		if err := os.WriteFile(path, []byte(b.String()), 0600); err != nil {
+			t.Error(err)
+		}
+	}
+	write(10)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		// Shrink and grow the runbook while it is searched
+		for i := range 50 {
+			write(1 + i%10)
+			if _, err := LoadDocsIndex(dir); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 50 {
+				index, err := LoadDocsIndex(dir)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				for _, chunk := range index.Search(Tokenize("restart service"), 10) {
+					if !strings.HasPrefix(chunk.Heading, "Step") {
+						t.Errorf("Search() returned %+v", chunk)
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
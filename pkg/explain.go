@@ -0,0 +1,102 @@
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+)
+
+// CommandExplanation is a structured explanation of a shell command
+type CommandExplanation struct {
+	Command     string          `json:"command"`
+	Summary     string          `json:"summary"`
+	Parts       []ExplainedPart `json:"parts"`
+	SideEffects []string        `json:"side_effects"`
+	Risk        CommandRisk     `json:"risk"`
+}
+
+// ExplainedPart is a command, flag or argument and what it does
+type ExplainedPart struct {
+	Text        string `json:"text"`
+	Explanation string `json:"explanation"`
+}
+
+// CommandRisk summarizes what could go wrong when running a command
+type CommandRisk struct {
+	// Level is "low", "medium" or "high"
+	Level   string `json:"level"`
+	Summary string `json:"summary"`
+}
+
+// ParseCommandExplanation extracts the explanation from a model response,
+// which may wrap the JSON object in a code block or other text
+func ParseCommandExplanation(command, response string) (*CommandExplanation, error) {
+	var explanation *CommandExplanation
+	var err error
+	// Text around the object may contain braces too, e.g. "find -exec rm {}",
+	// so try each one that could start it
+	for start := strings.Index(response, "{"); start != -1; {
+		var candidate CommandExplanation
+		decoder := json.NewDecoder(strings.NewReader(response[start:]))
+		if err = decoder.Decode(&candidate); err == nil && (candidate.Summary != "" || len(candidate.Parts) > 0) {
+			explanation = &candidate
+			break
+		}
+		next := strings.Index(response[start+1:], "{")
+		if next == -1 {
+			break
+		}
+		start += next + 1
+	}
+	if explanation == nil {
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal explanation: %w", err)
+		}
+		return nil, fmt.Errorf("response contains no JSON object")
+	}
+
+	explanation.Command = command
+	explanation.Risk.Level = strings.ToLower(strings.TrimSpace(explanation.Risk.Level))
+	switch explanation.Risk.Level {
+	case "low", "medium", "high":
+	default:
+		explanation.Risk.Level = "unknown"
+	}
+	return explanation, nil
+}
+
+// WriteText writes the explanation for reading in a terminal
+func (e *CommandExplanation) WriteText(w io.Writer) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s\n", e.Command)
+	if e.Summary != "" {
+		fmt.Fprintf(&b, "  %s\n", e.Summary)
+	}
+
+	if len(e.Parts) > 0 {
+		b.WriteString("\nParts:\n")
+		table := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+		for _, part := range e.Parts {
+			fmt.Fprintf(table, "  %s\t%s\n", part.Text, part.Explanation)
+		}
+		table.Flush()
+	}
+
+	if len(e.SideEffects) > 0 {
+		b.WriteString("\nSide effects:\n")
+		for _, effect := range e.SideEffects {
+			fmt.Fprintf(&b, "  - %s\n", effect)
+		}
+	}
+
+	fmt.Fprintf(&b, "\nRisk: %s", e.Risk.Level)
+	if e.Risk.Summary != "" {
+		fmt.Fprintf(&b, " - %s", e.Risk.Summary)
+	}
+	b.WriteString("\n")
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
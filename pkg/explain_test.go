@@ -0,0 +1,72 @@
+package pkg
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseCommandExplanation(t *testing.T) {
+	const object = `{"summary": "Lists files", "parts": [{"text": "ls", "explanation": "Lists directory contents"}, {"text": "-la", "explanation": "All files, long format"}], "side_effects": [], "risk": {"level": " Low ", "summary": "Read-only"}}`
+	parts := []ExplainedPart{{Text: "ls", Explanation: "Lists directory contents"}, {Text: "-la", Explanation: "All files, long format"}}
+
+	tests := []struct {
+		name     string
+		response string
+		risk     string
+		parts    []ExplainedPart
+	}{
+		{"plain", object, "low", parts},
+		{"fenced", "```json\n" + object + "\n```", "low", parts},
+		{"text around", "Sure! Here is the explanation:\n" + object + "\nLet me know {if} you need more.", "low", parts},
+		{"braces before the object", "Like find -exec rm {} \\; this is safe:\n" + object, "low", parts},
+		{
+			name:     "unknown flags are kept as explained",
+			response: `{"summary": "Runs a tool", "parts": [{"text": "tool", "explanation": "A local program"}, {"text": "--frobnicate", "explanation": "Unknown flag, not documented"}], "risk": {"level": "medium"}, "confidence": 0.4}`,
+			risk:     "medium",
+			parts:    []ExplainedPart{{Text: "tool", Explanation: "A local program"}, {Text: "--frobnicate", Explanation: "Unknown flag, not documented"}},
+		},
+		{"missing risk", `{"summary": "Prints the date", "parts": [{"text": "date", "explanation": "Prints the date"}]}`, "unknown", []ExplainedPart{{Text: "date", Explanation: "Prints the date"}}},
+		{"unexpected risk", `{"summary": "Deletes files", "risk": {"level": "catastrophic"}}`, "unknown", nil},
+	}
+	for _, tt := range tests {
+		explanation, err := ParseCommandExplanation("ls -la", tt.response)
+		if err != nil {
+			t.Errorf("%s: ParseCommandExplanation() failed: %v", tt.name, err)
+			continue
+		}
+		if explanation.Command != "ls -la" || explanation.Risk.Level != tt.risk || !reflect.DeepEqual(explanation.Parts, tt.parts) {
+			t.Errorf("%s: ParseCommandExplanation() = %+v", tt.name, explanation)
+		}
+	}
+
+	for _, response := range []string{
+		"",
+		"I can't explain this command.",
+		"```json\n{\"summary\": \"Lists files\", \"parts\": [\n```",
+		`{"summary": 42}`,
+		"{}",
+	} {
+		if explanation, err := ParseCommandExplanation("ls", response); err == nil {
+			t.Errorf("ParseCommandExplanation(%q) = %+v, want an error", response, explanation)
+		}
+	}
+}
+
+func TestCommandExplanationWriteText(t *testing.T) {
+	explanation := &CommandExplanation{
+		Command:     "rm -rf build",
+		Summary:     "Deletes the build directory",
+		Parts:       []ExplainedPart{{Text: "rm", Explanation: "Removes files"}, {Text: "-rf", Explanation: "Recursively, without asking"}},
+		SideEffects: []string{"Deletes build/"},
+		Risk:        CommandRisk{Level: "medium", Summary: "Irreversible"},
+	}
+	var b strings.Builder
+	if err := explanation.WriteText(&b); err != nil {
+		t.Fatal(err)
+	}
+	want := "rm -rf build\n  Deletes the build directory\n\nParts:\n  rm   Removes files\n  -rf  Recursively, without asking\n\nSide effects:\n  - Deletes build/\n\nRisk: medium - Irreversible\n"
+	if b.String() != want {
+		t.Errorf("WriteText() = %q, want %q", b.String(), want)
+	}
+}
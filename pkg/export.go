@@ -0,0 +1,101 @@
+package pkg
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"strings"
+	"time"
+)
+
+// maxExportLines is how many rendered lines of output an export keeps
+const maxExportLines = 100000
+
+// SessionExport is a recorded session prepared for sharing
+type SessionExport struct {
+	Meta    SessionMeta
+	Records []CommandRecord
+	// Lines is the rendered terminal output
+	Lines []string
+}
+
+// NewSessionExport renders raw session output at the given terminal width
+func NewSessionExport(meta SessionMeta, records []CommandRecord, output []byte, width int) *SessionExport {
+	lines := RenderTerminalOutput(output, width, 50, maxExportLines)
+	// Drop the empty rows below the last output
+	for len(lines) > 0 && strings.TrimSpace(lines[len(lines)-1]) == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return &SessionExport{Meta: meta, Records: records, Lines: lines}
+}
+
+// WriteText writes the rendered output as plain text
+func (e *SessionExport) WriteText(w io.Writer) error {
+	_, err := io.WriteString(w, strings.Join(e.Lines, "\n")+"\n")
+	return err
+}
+
+var sessionHTMLTemplate = template.Must(template.New("session").Funcs(template.FuncMap{
+	"join": strings.Join,
+	"time": func(t time.Time) string { return t.Format("2006-01-02 15:04:05") },
+	"duration": func(r CommandRecord) string {
+		return r.Duration().Round(100 * time.Millisecond).String()
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Session {{.Meta.ID}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+dt { font-weight: bold; float: left; width: 6em; }
+dd { margin-left: 7em; }
+table { border-collapse: collapse; margin: 1em 0; }
+th, td { border: 1px solid #ccc; padding: 0.2em 0.6em; text-align: left; }
+td.command { font-family: monospace; }
+tr.failed td { background: #fdd; }
+pre { background: #111; color: #ddd; padding: 1em; overflow-x: auto; }
+</style>
+</head>
+<body>
+<h1>Session {{.Meta.ID}}</h1>
+<dl>
+{{- with .Meta.Command}}<dt>Command</dt><dd>{{join . " "}}</dd>{{end}}
+{{- with .Meta.TTY}}<dt>TTY</dt><dd>{{.}}</dd>{{end}}
+{{- with .Meta.Cwd}}<dt>Directory</dt><dd>{{.}}</dd>{{end}}
+{{- if not .Meta.StartTime.IsZero}}<dt>Started</dt><dd>{{time .Meta.StartTime}}</dd>{{end}}
+</dl>
+{{- if .Records}}
+<h2>Commands</h2>
+<table>
+<tr><th>Started</th><th>Command</th><th>Directory</th><th>Exit</th><th>Duration</th></tr>
+{{- range .Records}}
+<tr{{if .Failed}} class="failed"{{end}}><td>{{time .StartTime}}</td><td class="command">{{.Command}}</td><td>{{.Cwd}}</td><td>{{with .ExitCode}}{{.}}{{end}}</td><td>{{duration .}}</td></tr>
+{{- end}}
+</table>
+{{- end}}
+<h2>Output</h2>
+<pre>{{join .Lines "\n"}}</pre>
+</body>
+</html>
+`))
+
+// WriteHTML writes a standalone HTML page with the session details, its
+// commands and the rendered output
+func (e *SessionExport) WriteHTML(w io.Writer) error {
+	if err := sessionHTMLTemplate.Execute(w, e); err != nil {
+		return fmt.Errorf("failed to render session HTML: %w", err)
+	}
+	return nil
+}
+
+// WriteAsciicast writes the output as an asciicast recording without timing,
+// for sessions recorded before timestamps were kept
+func WriteAsciicast(w io.Writer, header AsciicastHeader, output []byte) error {
+	writer, err := NewAsciicastWriter(w, header, 0)
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write(output)
+	return err
+}
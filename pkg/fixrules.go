@@ -0,0 +1,282 @@
+package pkg
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// CommandFix is a correction of a failed command proposed by a local rule
+type CommandFix struct {
+	Command string
+	// Rule names the rule that matched, e.g. "sudo"
+	Rule string
+}
+
+// FixRules corrects common failures without asking the AI
+type FixRules struct {
+	// Commands are the executables available to the shell, used to correct typos
+	Commands []string
+	// Dir is the directory the command ran in, the current one if empty
+	Dir string
+}
+
+var (
+	zshCommandNotFound  = regexp.MustCompile(`command not found: (\S+)`)
+	bashCommandNotFound = regexp.MustCompile(`(\S+): command not found`)
+	gitUnknownCommand   = regexp.MustCompile(`git: '(\S+)' is not a git command`)
+	gitSimilarCommand   = regexp.MustCompile(`(?m)The most similar commands? (?:is|are)\s*\n\s+(\S+)`)
+	gitSetUpstream      = regexp.MustCompile(`(?m)^\s*(git push --set-upstream \S+ \S+)\s*$`)
+)
+
+// permissionErrors are output fragments that usually mean root is needed
+var permissionErrors = []string{
+	"permission denied",
+	"operation not permitted",
+	"are you root",
+	"must be root",
+	"must be run as root",
+	"requires superuser",
+	"superuser privileges",
+	"eacces",
+}
+
+// Fix returns the correction of the first rule matching a failed command and
+// its output
+func (r *FixRules) Fix(command string, exitCode int, output string) (*CommandFix, bool) {
+	command = strings.TrimSpace(command)
+	if command == "" {
+		return nil, false
+	}
+	for _, rule := range []func(string, int, string) *CommandFix{
+		r.gitUpstream,
+		r.gitTypo,
+		r.commandTypo,
+		r.executable,
+		r.sudo,
+	} {
+		if fix := rule(command, exitCode, output); fix != nil && fix.Command != command {
+			return fix, true
+		}
+	}
+	return nil, false
+}
+
+// gitUpstream runs the push git suggests for a branch without upstream
+func (r *FixRules) gitUpstream(command string, exitCode int, output string) *CommandFix {
+	if !strings.HasPrefix(command, "git push") || !strings.Contains(output, "has no upstream branch") {
+		return nil
+	}
+	match := gitSetUpstream.FindStringSubmatch(output)
+	if match == nil {
+		return nil
+	}
+	return &CommandFix{Command: match[1], Rule: "git upstream"}
+}
+
+// gitTypo replaces a mistyped git subcommand with the one git suggests
+func (r *FixRules) gitTypo(command string, exitCode int, output string) *CommandFix {
+	unknown := gitUnknownCommand.FindStringSubmatch(output)
+	similar := gitSimilarCommand.FindStringSubmatch(output)
+	if unknown == nil || similar == nil {
+		return nil
+	}
+	fixed, ok := replaceField(command, unknown[1], similar[1], 1)
+	if !ok {
+		return nil
+	}
+	return &CommandFix{Command: fixed, Rule: "git typo"}
+}
+
+// commandTypo replaces an unknown command with the closest available one
+func (r *FixRules) commandTypo(command string, exitCode int, output string) *CommandFix {
+	name, index := commandWord(command)
+	if name == "" {
+		return nil
+	}
+	notFound := exitCode == 127
+	for _, pattern := range []*regexp.Regexp{zshCommandNotFound, bashCommandNotFound} {
+		if match := pattern.FindStringSubmatch(output); match != nil && match[1] == name {
+			notFound = true
+		}
+	}
+	if !notFound {
+		return nil
+	}
+
+	best, bestDistance := "", maxTypoDistance(name)+1
+	for _, candidate := range r.Commands {
+		if distance := editDistance(name, candidate); distance < bestDistance {
+			best, bestDistance = candidate, distance
+		}
+	}
+	if best == "" {
+		return nil
+	}
+	fixed, _ := replaceField(command, name, best, index)
+	return &CommandFix{Command: fixed, Rule: "typo"}
+}
+
+// executable makes a script that could not be run for lack of an execute bit
+// executable before running it again
+func (r *FixRules) executable(command string, exitCode int, output string) *CommandFix {
+	name, _ := commandWord(command)
+	if exitCode == 0 || !r.isUnexecutableFile(name) || !hasPermissionError(output) {
+		return nil
+	}
+	return &CommandFix{Command: "chmod +x " + name + " && " + command, Rule: "chmod"}
+}
+
+// sudo reruns a command that failed for lack of permissions with sudo
+func (r *FixRules) sudo(command string, exitCode int, output string) *CommandFix {
+	name, _ := commandWord(command)
+	if name == "" || name == "sudo" || name == "cd" || exitCode == 0 {
+		return nil
+	}
+	// Root does not run a file without an execute bit either
+	if r.isUnexecutableFile(name) || !hasPermissionError(output) {
+		return nil
+	}
+	return &CommandFix{Command: "sudo " + command, Rule: "sudo"}
+}
+
+// hasPermissionError reports whether output looks like a lack of permissions
+func hasPermissionError(output string) bool {
+	lower := strings.ToLower(output)
+	// SSH authentication failures are not fixed by root
+	if strings.Contains(lower, "(publickey") {
+		return false
+	}
+	for _, fragment := range permissionErrors {
+		if strings.Contains(lower, fragment) {
+			return true
+		}
+	}
+	return false
+}
+
+// isUnexecutableFile reports whether name is a path to a regular file without
+// any execute bit
+func (r *FixRules) isUnexecutableFile(name string) bool {
+	if !strings.Contains(name, "/") {
+		return false
+	}
+	path := name
+	if strings.HasPrefix(path, "~/") {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return false
+		}
+		path = filepath.Join(home, path[2:])
+	} else if !filepath.IsAbs(path) && r.Dir != "" {
+		path = filepath.Join(r.Dir, path)
+	}
+	info, err := os.Stat(path)
+	return err == nil && info.Mode().IsRegular() && info.Mode()&0111 == 0
+}
+
+// commandWord returns the command name of a command line and its field index,
+// skipping leading VAR=value assignments
+func commandWord(command string) (string, int) {
+	for i, field := range strings.Fields(command) {
+		if !envAssignment.MatchString(field) {
+			return field, i
+		}
+	}
+	return "", 0
+}
+
+// replaceField replaces field index of command if it is old, keeping the rest
+// of the command line as typed
+func replaceField(command, old, new string, index int) (string, bool) {
+	rest := command
+	offset := 0
+	for i := 0; ; i++ {
+		trimmed := strings.TrimLeft(rest, " \t")
+		offset += len(rest) - len(trimmed)
+		rest = trimmed
+		end := strings.IndexAny(rest, " \t")
+		if end == -1 {
+			end = len(rest)
+		}
+		if end == 0 {
+			return command, false
+		}
+		if i == index {
+			if rest[:end] != old {
+				return command, false
+			}
+			return command[:offset] + new + command[offset+end:], true
+		}
+		offset += end
+		rest = rest[end:]
+	}
+}
+
+// maxTypoDistance is how many edits a command name may be away from a correction
+func maxTypoDistance(name string) int {
+	if len(name) <= 4 {
+		return 1
+	}
+	return 2
+}
+
+// editDistance is the number of insertions, deletions, substitutions and
+// transpositions of adjacent characters between a and b
+func editDistance(a, b string) int {
+	d := make([][]int, len(a)+1)
+	for i := range d {
+		d[i] = make([]int, len(b)+1)
+		d[i][0] = i
+	}
+	for j := range d[0] {
+		d[0][j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			d[i][j] = min(d[i-1][j]+1, d[i][j-1]+1, d[i-1][j-1]+cost)
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] {
+				d[i][j] = min(d[i][j], d[i-2][j-2]+1)
+			}
+		}
+	}
+	return d[len(a)][len(b)]
+}
+
+// PathCommands returns the names of the executables in $PATH, sorted
+func PathCommands() []string {
+	seen := make(map[string]bool)
+	for _, dir := range filepath.SplitList(os.Getenv("PATH")) {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			info, err := entry.Info()
+			if err != nil {
+				continue
+			}
+			// Follow symlinks, which most package managers install
+			if info.Mode()&os.ModeSymlink != 0 {
+				if info, err = os.Stat(filepath.Join(dir, entry.Name())); err != nil {
+					continue
+				}
+			}
+			if !info.IsDir() && info.Mode()&0111 != 0 {
+				seen[entry.Name()] = true
+			}
+		}
+	}
+	commands := make([]string, 0, len(seen))
+	for name := range seen {
+		commands = append(commands, name)
+	}
+	sort.Strings(commands)
+	return commands
+}
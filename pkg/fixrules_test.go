@@ -0,0 +1,188 @@
+package pkg
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFixRules(t *testing.T) {
+	dir := t.TempDir()
+	for name, mode := range map[string]os.FileMode{"script.sh": 0644, "run.sh": 0755} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("#!/bin/sh\n"), mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rules := &FixRules{Commands: []string{"docker", "git", "go", "grep", "ls", "make"}, Dir: dir}
+	tests := []struct {
+		name     string
+		command  string
+		exitCode int
+		output   string
+		want     string
+		rule     string
+	}{
+		{
+			name:     "git upstream",
+			command:  "git push",
+			exitCode: 128,
+			output:   "fatal: The current branch feature has no upstream branch.\nTo push the current branch and set the remote as upstream, use\n\n    git push --set-upstream origin feature\n",
+			want:     "git push --set-upstream origin feature",
+			rule:     "git upstream",
+		},
+		{
+			name:     "git typo keeps the rest of the line",
+			command:  "git  stauts -s",
+			exitCode: 1,
+			output:   "git: 'stauts' is not a git command. See 'git --help'.\n\nThe most similar command is\n\tstatus\n",
+			want:     "git  status -s",
+			rule:     "git typo",
+		},
+		{
+			name:     "zsh command not found",
+			command:  "gti status",
+			exitCode: 127,
+			output:   "zsh: command not found: gti",
+			want:     "git status",
+			rule:     "typo",
+		},
+		{
+			name:     "transposed letters",
+			command:  "dokcer ps -a",
+			exitCode: 127,
+			output:   "bash: dokcer: command not found",
+			want:     "docker ps -a",
+			rule:     "typo",
+		},
+		{
+			name:     "not found from the output alone",
+			command:  "sl -la",
+			exitCode: 1,
+			output:   "sl: command not found",
+			want:     "ls -la",
+			rule:     "typo",
+		},
+		{
+			name:     "environment assignments before the command",
+			command:  "CGO_ENABLED=0 GOOS=linux mkae build",
+			exitCode: 127,
+			output:   "zsh: command not found: mkae",
+			want:     "CGO_ENABLED=0 GOOS=linux make build",
+			rule:     "typo",
+		},
+		{
+			name:     "only assignments",
+			command:  "FOO=bar",
+			exitCode: 127,
+			output:   "zsh: command not found: FOO=bar",
+		},
+		{
+			name:     "no close command",
+			command:  "xyzzy",
+			exitCode: 127,
+			output:   "zsh: command not found: xyzzy",
+		},
+		{
+			name:     "permission denied",
+			command:  "apt install vim",
+			exitCode: 100,
+			output:   "E: Could not open lock file /var/lib/dpkg/lock-frontend - open (13: Permission denied)",
+			want:     "sudo apt install vim",
+			rule:     "sudo",
+		},
+		{
+			name:     "permission denied after assignments",
+			command:  "DEBIAN_FRONTEND=noninteractive apt install vim",
+			exitCode: 100,
+			output:   "E: Could not open lock file /var/lib/dpkg/lock-frontend - open (13: Permission denied)",
+			want:     "sudo DEBIAN_FRONTEND=noninteractive apt install vim",
+			rule:     "sudo",
+		},
+		{
+			name:     "script without execute bit",
+			command:  "./script.sh --all",
+			exitCode: 126,
+			output:   "zsh: permission denied: ./script.sh",
+			want:     "chmod +x ./script.sh && ./script.sh --all",
+			rule:     "chmod",
+		},
+		{
+			name:     "absolute path without execute bit",
+			command:  filepath.Join(dir, "script.sh"),
+			exitCode: 126,
+			output:   "bash: " + filepath.Join(dir, "script.sh") + ": Permission denied",
+			want:     "chmod +x " + filepath.Join(dir, "script.sh") + " && " + filepath.Join(dir, "script.sh"),
+			rule:     "chmod",
+		},
+		{
+			name:     "executable script denied access",
+			command:  "./run.sh",
+			exitCode: 1,
+			output:   "./run.sh: line 2: /etc/shadow: Permission denied",
+			want:     "sudo ./run.sh",
+			rule:     "sudo",
+		},
+		{
+			name:     "ssh key rejected",
+			command:  "ssh deploy@host",
+			exitCode: 255,
+			output:   "deploy@host: Permission denied (publickey).",
+		},
+		{
+			name:     "already sudo",
+			command:  "sudo rm /etc/motd",
+			exitCode: 1,
+			output:   "rm: cannot remove '/etc/motd': Operation not permitted",
+		},
+		{
+			name:     "cd is a builtin",
+			command:  "cd /root",
+			exitCode: 1,
+			output:   "cd: permission denied: /root",
+		},
+		{
+			name:    "succeeded",
+			command: "cat notes",
+			output:  "permission denied is mentioned in the notes",
+		},
+		{
+			name:     "empty command",
+			command:  "  ",
+			exitCode: 1,
+			output:   "permission denied",
+		},
+	}
+	for _, tt := range tests {
+		fix, ok := rules.Fix(tt.command, tt.exitCode, tt.output)
+		if tt.want == "" {
+			if ok {
+				t.Errorf("%s: Fix() = %+v, want no fix", tt.name, fix)
+			}
+			continue
+		}
+		if !ok || fix.Command != tt.want || fix.Rule != tt.rule {
+			t.Errorf("%s: Fix() = %+v, %v, want %q by %s", tt.name, fix, ok, tt.want, tt.rule)
+		}
+	}
+}
+
+func TestEditDistance(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"git", "git", 0},
+		{"gti", "git", 1},
+		{"gitt", "git", 1},
+		{"gt", "git", 1},
+		{"dokcer", "docker", 1},
+		{"kubeclt", "kubectl", 1},
+		{"", "ls", 2},
+		{"make", "cargo", 4},
+	}
+	for _, tt := range tests {
+		if got := editDistance(tt.a, tt.b); got != tt.want {
+			t.Errorf("editDistance(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
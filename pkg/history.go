@@ -0,0 +1,560 @@
+package pkg
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// HistoryEntry is a unique command seen in the shell history or proxy logs
+type HistoryEntry struct {
+	Command string `json:"command"`
+	// LastUsed is the unix time the command was last run (0 if unknown)
+	LastUsed int64 `json:"last_used"`
+	// Count is how many times the command was run
+	Count int `json:"count"`
+}
+
+// HistorySource records the state of an indexed file so changes can be detected
+type HistorySource struct {
+	Path    string `json:"path"`
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"mod_time"`
+	// Offset is how far a history file has been indexed and Tail a hash of
+	// the bytes before it, which tells appends from rewrites
+	Offset int64  `json:"offset,omitempty"`
+	Tail   string `json:"tail,omitempty"`
+}
+
+// HistoryIndex is an on-disk BM25 index over the full shell history
+type HistoryIndex struct {
+	Sources []HistorySource `json:"sources"`
+	Entries []HistoryEntry  `json:"entries"`
+	Docs    []BM25Document  `json:"docs"`
+
+	bm25 *BM25Index
+}
+
+const historyIndexVersion = 2
+
+type historyIndexFile struct {
+	Version int           `json:"version"`
+	Index   *HistoryIndex `json:"index"`
+}
+
+// DefaultHistoryFiles returns the shell history files that exist for the
+// current user. histFile is the shell's $HISTFILE, if set.
+func DefaultHistoryFiles(histFile string) []string {
+	var candidates []string
+	if histFile != "" {
+		candidates = append(candidates, histFile)
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		candidates = append(candidates,
+			filepath.Join(home, ".zsh_history"),
+			filepath.Join(home, ".zhistory"),
+			filepath.Join(home, ".bash_history"),
+		)
+	}
+
+	seen := make(map[string]bool)
+	var files []string
+	for _, file := range candidates {
+		if seen[file] {
+			continue
+		}
+		seen[file] = true
+		if info, err := os.Stat(file); err == nil && !info.IsDir() {
+			files = append(files, file)
+		}
+	}
+	return files
+}
+
+// rotatedLogSuffix matches the timestamp LogRotator appends to rotated files
+var rotatedLogSuffix = regexp.MustCompile(`-\d{8}-\d{6}$`)
+
+// RotatedProxyLogFiles returns the rotated (and possibly compressed) proxy logs
+// of the current user for the base proxy log path, including those of
+// per-session logs
+func RotatedProxyLogFiles(baseLogPath string) []string {
+	if baseLogPath == "" {
+		return nil
+	}
+	dir := filepath.Dir(baseLogPath)
+	base := filepath.Base(baseLogPath)
+	ext := filepath.Ext(base)
+	name := strings.TrimSuffix(base, ext)
+
+	matches, err := filepath.Glob(filepath.Join(dir, name+"*-*"+ext+"*"))
+	if err != nil {
+		return nil
+	}
+
+	var files []string
+	for _, match := range matches {
+		stem := strings.TrimSuffix(strings.TrimSuffix(filepath.Base(match), ".gz"), ext)
+		if rotatedLogSuffix.MatchString(stem) && isOwnFile(match) {
+			files = append(files, match)
+		}
+	}
+	sort.Strings(files)
+	return files
+}
+
+// isOwnFile reports whether the file at path belongs to the current user.
+// The proxy logs of all users share a directory such as /tmp.
+func isOwnFile(path string) bool {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return false
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	return !ok || int(stat.Uid) == os.Getuid()
+}
+
+// loadedHistoryIndex keeps the last loaded index in memory for long-running
+// processes such as the daemon
+var (
+	loadedHistoryMutex sync.Mutex
+	loadedHistoryIndex *HistoryIndex
+)
+
+// LoadHistoryIndex loads the history index from the cache directory and
+// brings it up to date: commands appended to the history files and new proxy
+// logs are added to it, and it is rebuilt only when a history file was
+// rewritten or an indexed proxy log changed
+func LoadHistoryIndex(historyFiles, proxyLogs []string) (*HistoryIndex, error) {
+	sources := statHistorySources(append(append([]string{}, historyFiles...), proxyLogs...))
+
+	loadedHistoryMutex.Lock()
+	defer loadedHistoryMutex.Unlock()
+	if loadedHistoryIndex != nil && sameHistorySources(loadedHistoryIndex.Sources, sources) {
+		return loadedHistoryIndex, nil
+	}
+
+	dir, err := CacheDir("history")
+	if err != nil {
+		return nil, err
+	}
+	indexPath := filepath.Join(dir, "index.json")
+
+	index := loadedHistoryIndex
+	if index == nil {
+		if data, err := os.ReadFile(indexPath); err == nil {
+			var file historyIndexFile
+			if err := json.Unmarshal(data, &file); err == nil && file.Version == historyIndexVersion && file.Index != nil {
+				index = file.Index
+			}
+		}
+	}
+	if index != nil && sameHistorySources(index.Sources, sources) {
+		index.bm25 = NewBM25Index(index.Docs)
+		loadedHistoryIndex = index
+		return index, nil
+	}
+
+	// Requests of the daemon may still search the loaded index
+	if index != nil {
+		index = index.clone()
+	}
+	if index == nil || !index.update(historyFiles, proxyLogs) {
+		if index, err = BuildHistoryIndex(historyFiles, proxyLogs); err != nil {
+			return nil, err
+		}
+	}
+
+	data, err := json.Marshal(historyIndexFile{Version: historyIndexVersion, Index: index})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal history index: %w", err)
+	}
+	tmpPath := indexPath + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return nil, fmt.Errorf("failed to write history index: %w", err)
+	}
+	if err := os.Rename(tmpPath, indexPath); err != nil {
+		return nil, fmt.Errorf("failed to write history index: %w", err)
+	}
+
+	loadedHistoryIndex = index
+	return index, nil
+}
+
+// BuildHistoryIndex reads all history files and proxy logs and indexes the
+// unique commands found in them
+func BuildHistoryIndex(historyFiles, proxyLogs []string) (*HistoryIndex, error) {
+	index := &HistoryIndex{}
+	index.update(historyFiles, proxyLogs)
+	return index, nil
+}
+
+// update adds the commands appended to the history files since they were
+// indexed and those of new proxy logs. It returns false, leaving the index
+// partly updated, when it has to be rebuilt instead: a history file was
+// rewritten, e.g. when the shell trimmed it, or an indexed proxy log changed.
+func (h *HistoryIndex) update(historyFiles, proxyLogs []string) bool {
+	indexed := make(map[string]HistorySource)
+	for _, source := range h.Sources {
+		indexed[source.Path] = source
+	}
+	byCommand := make(map[string]int)
+	for i, entry := range h.Entries {
+		byCommand[entry.Command] = i
+	}
+
+	add := func(command string, timestamp int64) {
+		command = strings.TrimSpace(command)
+		if command == "" {
+			return
+		}
+		i, ok := byCommand[command]
+		if !ok {
+			i = len(h.Entries)
+			byCommand[command] = i
+			h.Entries = append(h.Entries, HistoryEntry{Command: command})
+			h.Docs = append(h.Docs, BM25Document{ID: command, Terms: Tokenize(command)})
+		}
+		h.Entries[i].Count++
+		if timestamp > h.Entries[i].LastUsed {
+			h.Entries[i].LastUsed = timestamp
+		}
+	}
+
+	var sources []HistorySource
+	for _, file := range historyFiles {
+		stat := statHistorySources([]string{file})
+		if len(stat) == 0 {
+			continue
+		}
+		source := stat[0]
+		previous, ok := indexed[file]
+		if ok && previous.Size == source.Size && previous.ModTime == source.ModTime {
+			sources = append(sources, previous)
+			continue
+		}
+
+		entries, offset, tail, err := readHistoryFrom(file, previous.Offset, previous.Tail)
+		if err == errHistoryRewritten {
+			return false
+		}
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			add(entry.Command, entry.LastUsed)
+		}
+		source.Offset, source.Tail = offset, tail
+		sources = append(sources, source)
+	}
+
+	for _, file := range proxyLogs {
+		stat := statHistorySources([]string{file})
+		if len(stat) == 0 {
+			continue
+		}
+		source := stat[0]
+		// Rotated logs don't change, so only new ones have to be read
+		if previous, ok := indexed[file]; ok {
+			if previous != source {
+				return false
+			}
+			sources = append(sources, source)
+			continue
+		}
+
+		content, err := readPossiblyCompressed(file)
+		if err != nil {
+			continue
+		}
+		modTime := time.Unix(0, source.ModTime).Unix()
+		for _, command := range ExtractPromptCommands(content) {
+			add(command, modTime)
+		}
+		sources = append(sources, source)
+	}
+
+	// The commands of files that are gone can't be taken out again
+	for _, source := range sources {
+		delete(indexed, source.Path)
+	}
+	if len(indexed) > 0 {
+		return false
+	}
+
+	h.Sources = sources
+	h.bm25 = NewBM25Index(h.Docs)
+	return true
+}
+
+func (h *HistoryIndex) clone() *HistoryIndex {
+	return &HistoryIndex{
+		Sources: append([]HistorySource{}, h.Sources...),
+		Entries: append([]HistoryEntry{}, h.Entries...),
+		Docs:    append([]BM25Document{}, h.Docs...),
+	}
+}
+
+// historyTailSize is how many bytes before the indexed offset are hashed
+const historyTailSize = 256
+
+var errHistoryRewritten = errors.New("history file was rewritten")
+
+// readHistoryFrom parses the complete lines of a history file after offset.
+// It returns the entries, the offset after the last complete line and the
+// tail hash there, or errHistoryRewritten if the bytes before offset no
+// longer hash to tail.
+func readHistoryFrom(path string, offset int64, tail string) ([]HistoryEntry, int64, string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, 0, "", fmt.Errorf("failed to open history file: %w", err)
+	}
+	defer file.Close()
+
+	if offset > 0 {
+		if current, err := historyTail(file, offset); err != nil || current != tail {
+			return nil, 0, "", errHistoryRewritten
+		}
+	}
+
+	data, err := io.ReadAll(io.NewSectionReader(file, offset, math.MaxInt64-offset))
+	if err != nil {
+		return nil, 0, "", fmt.Errorf("failed to read history file: %w", err)
+	}
+	// A line being written is indexed once it is complete
+	end := bytes.LastIndexByte(data, '\n') + 1
+	entries, err := parseHistory(bytes.NewReader(data[:end]))
+	if err != nil {
+		return nil, 0, "", err
+	}
+
+	offset += int64(end)
+	newTail, err := historyTail(file, offset)
+	if err != nil {
+		return nil, 0, "", err
+	}
+	return entries, offset, newTail, nil
+}
+
+// historyTail hashes the bytes of file before offset
+func historyTail(file *os.File, offset int64) (string, error) {
+	start := max(0, offset-historyTailSize)
+	buf := make([]byte, offset-start)
+	if _, err := file.ReadAt(buf, start); err != nil && err != io.EOF {
+		return "", fmt.Errorf("failed to read history file: %w", err)
+	}
+	sum := sha256.Sum256(buf)
+	return hex.EncodeToString(sum[:8]), nil
+}
+
+// Search returns up to k past commands most relevant to the query terms
+func (h *HistoryIndex) Search(queryTerms []string, k int) []HistoryEntry {
+	if h.bm25 == nil {
+		h.bm25 = NewBM25Index(h.Docs)
+	}
+
+	var entries []HistoryEntry
+	for _, result := range h.bm25.SearchTerms(queryTerms, k) {
+		entries = append(entries, h.Entries[result.Index])
+	}
+	return entries
+}
+
+// extendedHistoryLine matches zsh EXTENDED_HISTORY lines like ": 1700000000:0;ls -la"
+var extendedHistoryLine = regexp.MustCompile(`^: *(\d+):\d+;(.*)$`)
+
+// ReadHistoryFile parses a zsh (plain or extended) or bash history file
+func ReadHistoryFile(path string) ([]HistoryEntry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open history file: %w", err)
+	}
+	defer file.Close()
+	return parseHistory(file)
+}
+
+func parseHistory(r io.Reader) ([]HistoryEntry, error) {
+	var entries []HistoryEntry
+	var pending []string
+	var pendingTime int64
+	var bashTime int64
+
+	flush := func() {
+		if len(pending) > 0 {
+			entries = append(entries, HistoryEntry{Command: strings.Join(pending, "\n"), LastUsed: pendingTime, Count: 1})
+			pending = nil
+			pendingTime = 0
+		}
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		// zsh stores non-ASCII bytes in a "metafied" form
+		line := unmetafy(scanner.Text())
+
+		if len(pending) == 0 {
+			if m := extendedHistoryLine.FindStringSubmatch(line); m != nil {
+				pendingTime, _ = strconv.ParseInt(m[1], 10, 64)
+				line = m[2]
+			} else if strings.HasPrefix(line, "#") && len(line) > 1 {
+				// bash HISTTIMEFORMAT comment line
+				if ts, err := strconv.ParseInt(line[1:], 10, 64); err == nil {
+					bashTime = ts
+					continue
+				}
+			} else {
+				pendingTime = bashTime
+				bashTime = 0
+			}
+		}
+
+		// Multi-line commands end each continued line with a backslash
+		if strings.HasSuffix(line, "\\") {
+			pending = append(pending, strings.TrimSuffix(line, "\\"))
+			continue
+		}
+		pending = append(pending, line)
+		flush()
+	}
+	flush()
+
+	if err := scanner.Err(); err != nil {
+		return entries, fmt.Errorf("failed to read history file: %w", err)
+	}
+	return entries, nil
+}
+
+func unmetafy(line string) string {
+	if !strings.ContainsRune(line, 0x83) {
+		return line
+	}
+	b := []byte(line)
+	out := make([]byte, 0, len(b))
+	for i := 0; i < len(b); i++ {
+		if b[i] == 0x83 && i+1 < len(b) {
+			i++
+			out = append(out, b[i]^32)
+			continue
+		}
+		out = append(out, b[i])
+	}
+	return string(out)
+}
+
+// promptLine matches a rendered prompt line followed by the command typed, e.g.
+// "user@host:~/src$ make test", "[user@host src]# ls", "$ ls" or "❯ git status".
+// A "$", "%" or "#" after other text only counts after user@host or a
+// bracketed prompt, so output like "100% done" or "# heading" isn't taken for
+// a command.
+var promptLine = regexp.MustCompile(`^(?:\(\S+\) )?(?:(?:\S+@\S+|\[[^\]]+\])\s?[$%#]|[$%]|[❯➜»]) +(\S.*)$`)
+
+// ExtractPromptCommands returns the commands typed after a prompt in raw
+// terminal output, such as the proxy logs
+func ExtractPromptCommands(content string) []string {
+	var commands []string
+	for _, line := range strings.Split(StripANSI(content), "\n") {
+		line = strings.TrimSpace(line)
+		if m := promptLine.FindStringSubmatch(line); m != nil {
+			commands = append(commands, strings.TrimSpace(m[1]))
+		}
+	}
+	return commands
+}
+
+func readPossiblyCompressed(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	var reader io.Reader = file
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			return "", err
+		}
+		defer gz.Close()
+		reader = gz
+	}
+
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func statHistorySources(paths []string) []HistorySource {
+	var sources []HistorySource
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		sources = append(sources, HistorySource{
+			Path:    path,
+			Size:    info.Size(),
+			ModTime: info.ModTime().UnixNano(),
+		})
+	}
+	return sources
+}
+
+// sameHistorySources reports whether the files are unchanged since a and b
+// were taken
+func sameHistorySources(a, b []HistorySource) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Path != b[i].Path || a[i].Size != b[i].Size || a[i].ModTime != b[i].ModTime {
+			return false
+		}
+	}
+	return true
+}
+
+// FormatHistoryEntries formats entries one per line with how long ago they were used
+func FormatHistoryEntries(entries []HistoryEntry, now time.Time) string {
+	var lines []string
+	for _, entry := range entries {
+		command := strings.ReplaceAll(entry.Command, "\n", "\\n")
+		if entry.LastUsed > 0 {
+			lines = append(lines, fmt.Sprintf("%s  (used %d times, last %s ago)", command, entry.Count, FormatAge(now.Sub(time.Unix(entry.LastUsed, 0)))))
+		} else {
+			lines = append(lines, fmt.Sprintf("%s  (used %d times)", command, entry.Count))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// FormatAge formats a duration in a coarse, human readable way like "3d" or "5h"
+func FormatAge(d time.Duration) string {
+	switch {
+	case d < time.Minute:
+		return fmt.Sprintf("%ds", int(d.Seconds()))
+	case d < time.Hour:
+		return fmt.Sprintf("%dm", int(d.Minutes()))
+	case d < 48*time.Hour:
+		return fmt.Sprintf("%dh", int(d.Hours()))
+	default:
+		return fmt.Sprintf("%dd", int(d.Hours()/24))
+	}
+}
@@ -0,0 +1,167 @@
+package pkg
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestExtractPromptCommands(t *testing.T) {
+	tests := []struct {
+		line string
+		want string
+	}{
+		{"user@host:~/src$ make test", "make test"},
+		{"root@host:/etc# systemctl restart nginx", "systemctl restart nginx"},
+		{"[user@host src]$ ls -la", "ls -la"},
+		{"(venv) user@host:~$ pip install -e .", "pip install -e ."},
+		{"$ go build ./...", "go build ./..."},
+		{"❯ git status", "git status"},
+		{"\x1b[32muser@host\x1b[0m:~$ echo hi", "echo hi"},
+		{"100% done", ""},
+		{"# Heading", ""},
+		{"> quoted text", ""},
+		{"result> value", ""},
+		{"downloading 42% complete", ""},
+		{"user@host:~$ ", ""},
+	}
+	for _, tt := range tests {
+		var want []string
+		if tt.want != "" {
+			want = []string{tt.want}
+		}
+		if got := ExtractPromptCommands(tt.line); !reflect.DeepEqual(got, want) {
+			t.Errorf("ExtractPromptCommands(%q) = %q, want %q", tt.line, got, want)
+		}
+	}
+}
+
+func TestReadHistoryFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []HistoryEntry
+	}{
+		{
+			name:    "plain",
+			content: "ls\ngit status\n",
+			want:    []HistoryEntry{{Command: "ls", Count: 1}, {Command: "git status", Count: 1}},
+		},
+		{
+			name:    "zsh extended",
+			content: ": 1700000000:0;make\n: 1700000100:3;echo a\\\nb\n",
+			want:    []HistoryEntry{{Command: "make", LastUsed: 1700000000, Count: 1}, {Command: "echo a\nb", LastUsed: 1700000100, Count: 1}},
+		},
+		{
+			name:    "bash timestamps",
+			content: "#1700000000\nls\npwd\n",
+			want:    []HistoryEntry{{Command: "ls", LastUsed: 1700000000, Count: 1}, {Command: "pwd", Count: 1}},
+		},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "history")
+		if err := os.WriteFile(path, []byte(tt.content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		got, err := ReadHistoryFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: ReadHistoryFile() = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRotatedProxyLogFiles(t *testing.T) {
+	if files := RotatedProxyLogFiles(""); files != nil {
+		t.Errorf("RotatedProxyLogFiles(\"\") = %v, want nil", files)
+	}
+
+	dir := t.TempDir()
+	for _, name := range []string{"proxy.log", "proxy.abc.log", "proxy-20240101-120000.log.gz", "proxy.abc-20240102-120000.log", "other-20240101-120000.log"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Other users' logs in the shared directory are left out
+	if os.Getuid() == 0 {
+		other := filepath.Join(dir, "proxy.other-20240103-120000.log")
+		if err := os.WriteFile(other, nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chown(other, 12345, 12345); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []string{filepath.Join(dir, "proxy-20240101-120000.log.gz"), filepath.Join(dir, "proxy.abc-20240102-120000.log")}
+	if got := RotatedProxyLogFiles(filepath.Join(dir, "proxy.log")); !reflect.DeepEqual(got, want) {
+		t.Errorf("RotatedProxyLogFiles() = %v, want %v", got, want)
+	}
+}
+
+func TestLoadHistoryIndexIncremental(t *testing.T) {
+	t.Setenv("SMART_SUGGESTION_CACHE_DIR", t.TempDir())
+	loadedHistoryIndex = nil
+	t.Cleanup(func() { loadedHistoryIndex = nil })
+
+	dir := t.TempDir()
+	history := filepath.Join(dir, "history")
+	write := func(content string, flags int) {
+		t.Helper()
+		file, err := os.OpenFile(history, flags|os.O_WRONLY|os.O_CREATE, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := file.WriteString(content); err != nil {
+			t.Fatal(err)
+		}
+		file.Close()
+	}
+	counts := func(index *HistoryIndex) map[string]int {
+		counts := make(map[string]int)
+		for _, entry := range index.Entries {
+			counts[entry.Command] = entry.Count
+		}
+		return counts
+	}
+
+	write("kubectl get pods\ngit status\n", os.O_TRUNC)
+	index, err := LoadHistoryIndex([]string{history}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := counts(index); !reflect.DeepEqual(got, map[string]int{"kubectl get pods": 1, "git status": 1}) {
+		t.Fatalf("counts = %v", got)
+	}
+
+	// Appended commands are added; a partial line waits until it is complete
+	write("kubectl get pods\ndocker p", os.O_APPEND)
+	if index, err = LoadHistoryIndex([]string{history}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := counts(index); !reflect.DeepEqual(got, map[string]int{"kubectl get pods": 2, "git status": 1}) {
+		t.Fatalf("counts after append = %v", got)
+	}
+	write("s\n", os.O_APPEND)
+	if index, err = LoadHistoryIndex([]string{history}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := counts(index); !reflect.DeepEqual(got, map[string]int{"kubectl get pods": 2, "git status": 1, "docker ps": 1}) {
+		t.Fatalf("counts after completing the line = %v", got)
+	}
+	if results := index.Search(Tokenize("docker"), 1); len(results) != 1 || results[0].Command != "docker ps" {
+		t.Errorf("Search(docker) = %v", results)
+	}
+
+	// A rewritten file is indexed from scratch, also after a restart
+	loadedHistoryIndex = nil
+	write("make build\nmake build\nmake test\n", os.O_TRUNC)
+	if index, err = LoadHistoryIndex([]string{history}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := counts(index); !reflect.DeepEqual(got, map[string]int{"make build": 2, "make test": 1}) {
+		t.Fatalf("counts after rewrite = %v", got)
+	}
+}
@@ -0,0 +1,117 @@
+package pkg
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+type proxyEnvKey struct{}
+
+// WithProxyEnv returns a context under which ProxyFromContext picks the proxy
+// from getenv instead of the process environment. The daemon uses it to send
+// each request through the calling shell's proxy.
+func WithProxyEnv(ctx context.Context, getenv func(string) string) context.Context {
+	return context.WithValue(ctx, proxyEnvKey{}, getenv)
+}
+
+// ProxyFromContext is an http.Transport Proxy function. It reads
+// HTTP_PROXY, HTTPS_PROXY and NO_PROXY (or their lowercase forms) from the
+// environment set with WithProxyEnv, and is http.ProxyFromEnvironment
+// otherwise.
+func ProxyFromContext(req *http.Request) (*url.URL, error) {
+	getenv, ok := req.Context().Value(proxyEnvKey{}).(func(string) string)
+	if !ok {
+		return http.ProxyFromEnvironment(req)
+	}
+	return proxyFromEnv(getenv, req.URL)
+}
+
+func proxyFromEnv(getenv func(string) string, target *url.URL) (*url.URL, error) {
+	lookup := func(name string) string {
+		if value := getenv(name); value != "" {
+			return value
+		}
+		return getenv(strings.ToLower(name))
+	}
+
+	var proxy string
+	switch target.Scheme {
+	case "https":
+		proxy = lookup("HTTPS_PROXY")
+	case "http":
+		proxy = lookup("HTTP_PROXY")
+	}
+	if proxy == "" || !useProxy(target, lookup("NO_PROXY")) {
+		return nil, nil
+	}
+
+	proxyURL, err := url.Parse(proxy)
+	if err != nil || proxyURL.Scheme == "" || proxyURL.Host == "" {
+		// Like curl, a bare host:port is an HTTP proxy
+		if proxyURL, err := url.Parse("http://" + proxy); err == nil {
+			return proxyURL, nil
+		}
+	}
+	return proxyURL, err
+}
+
+// useProxy reports whether a request to target should go through the proxy,
+// given the comma-separated NO_PROXY list. Entries are hosts, which also
+// match their subdomains, ".domain" suffixes, optionally with a port, IP
+// addresses, CIDR ranges, or "*" for all hosts. Loopback hosts are never
+// proxied.
+func useProxy(target *url.URL, noProxy string) bool {
+	host, port := target.Hostname(), target.Port()
+	if host == "localhost" {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip != nil && ip.IsLoopback() {
+		return false
+	}
+
+	for _, entry := range strings.Split(noProxy, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		switch {
+		case entry == "":
+			continue
+		case entry == "*":
+			return false
+		}
+		if _, network, err := net.ParseCIDR(entry); err == nil {
+			if ip != nil && network.Contains(ip) {
+				return false
+			}
+			continue
+		}
+
+		entryHost, entryPort := entry, ""
+		if h, p, err := net.SplitHostPort(entry); err == nil {
+			entryHost, entryPort = h, p
+		}
+		if entryPort != "" && entryPort != port {
+			continue
+		}
+		if entryIP := net.ParseIP(entryHost); entryIP != nil {
+			if ip != nil && entryIP.Equal(ip) {
+				return false
+			}
+			continue
+		}
+		host := strings.ToLower(host)
+		entryHost = strings.TrimPrefix(entryHost, "*")
+		if strings.HasPrefix(entryHost, ".") {
+			if strings.HasSuffix(host, entryHost) {
+				return false
+			}
+			continue
+		}
+		if host == entryHost || strings.HasSuffix(host, "."+entryHost) {
+			return false
+		}
+	}
+	return true
+}
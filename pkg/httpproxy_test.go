@@ -0,0 +1,70 @@
+package pkg
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+func TestProxyFromContext(t *testing.T) {
+	env := map[string]string{
+		"HTTPS_PROXY": "proxy.corp:3128",
+		"http_proxy":  "http://plain.corp:8080",
+		"NO_PROXY":    "internal.corp, .svc, 10.0.0.0/8, 192.168.1.5, example.org:8443",
+	}
+	ctx := WithProxyEnv(context.Background(), func(key string) string { return env[key] })
+
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{"https://api.openai.com/v1/chat/completions", "http://proxy.corp:3128"},
+		{"http://api.example.com/", "http://plain.corp:8080"},
+		{"https://internal.corp/", ""},
+		{"https://llm.internal.corp/", ""},
+		{"https://notinternal.corp/", "http://proxy.corp:3128"},
+		{"https://model.svc/", ""},
+		{"https://10.1.2.3/", ""},
+		{"https://192.168.1.5/", ""},
+		{"https://192.168.1.6/", "http://proxy.corp:3128"},
+		{"https://example.org:8443/", ""},
+		{"https://example.org/", "http://proxy.corp:3128"},
+		{"http://localhost:11434/", ""},
+		{"http://127.0.0.1:8080/", ""},
+	}
+	for _, tt := range tests {
+		req, err := http.NewRequestWithContext(ctx, "GET", tt.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		proxy, err := ProxyFromContext(req)
+		if err != nil {
+			t.Errorf("ProxyFromContext(%s) failed: %v", tt.url, err)
+			continue
+		}
+		got := ""
+		if proxy != nil {
+			got = proxy.String()
+		}
+		if got != tt.want {
+			t.Errorf("ProxyFromContext(%s) = %q, want %q", tt.url, got, tt.want)
+		}
+	}
+}
+
+func TestProxyFromContextWildcard(t *testing.T) {
+	env := map[string]string{"HTTPS_PROXY": "http://proxy.corp:3128", "no_proxy": "*"}
+	ctx := WithProxyEnv(context.Background(), func(key string) string { return env[key] })
+	req, _ := http.NewRequestWithContext(ctx, "GET", "https://api.anthropic.com/", nil)
+	if proxy, err := ProxyFromContext(req); err != nil || proxy != nil {
+		t.Errorf("ProxyFromContext() = %v, %v, want no proxy", proxy, err)
+	}
+
+	// Without an environment in the context, the process's own applies
+	t.Setenv("HTTPS_PROXY", "")
+	t.Setenv("https_proxy", "")
+	req, _ = http.NewRequest("GET", "https://api.anthropic.com/", nil)
+	if proxy, err := ProxyFromContext(req); err != nil || proxy != nil {
+		t.Errorf("ProxyFromContext() without an environment = %v, %v, want no proxy", proxy, err)
+	}
+}
@@ -0,0 +1,340 @@
+package pkg
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// CommandEvent is a single command run, in history order
+type CommandEvent struct {
+	Command string
+	// Cwd is the directory the command was run in, empty if unknown
+	Cwd string
+	// Time is the unix time the command was run, 0 if unknown
+	Time int64
+}
+
+// LocalEngineConfig holds configuration for the local suggestion engine
+type LocalEngineConfig struct {
+	// HalfLife is the number of commands after which a command's frecency
+	// weight is halved (default: 500)
+	HalfLife float64
+	// CwdBoost multiplies the weight of commands run in the current directory (default: 3)
+	CwdBoost float64
+	// MinScore is the score below which no suggestion is returned (default: 0.05)
+	MinScore float64
+}
+
+// DefaultLocalEngineConfig returns default configuration
+func DefaultLocalEngineConfig() *LocalEngineConfig {
+	return &LocalEngineConfig{
+		HalfLife: 500,
+		CwdBoost: 3,
+		MinScore: 0.05,
+	}
+}
+
+// LocalEngine predicts the next command from history without calling an AI
+// provider, using an n-gram transition model over command sequences,
+// cwd-conditioned frecency and prefix completion
+type LocalEngine struct {
+	config *LocalEngineConfig
+	events []CommandEvent
+
+	// bigrams and trigrams map previous command(s) to next-command weights
+	bigrams  map[string]map[string]float64
+	trigrams map[string]map[string]float64
+}
+
+// LocalSuggestion is a suggestion from the local engine
+type LocalSuggestion struct {
+	// Command is the full suggested command
+	Command string
+	// Completion is the rest of the command after the input, empty for new commands
+	Completion string
+	// IsCompletion reports whether the suggestion completes the input (+) or replaces it (=)
+	IsCompletion bool
+	// Reason describes which model produced the suggestion, for debug logs
+	Reason string
+	Score  float64
+}
+
+// Format returns the suggestion in the "+completion" / "=command" output format
+func (s *LocalSuggestion) Format() string {
+	if s.IsCompletion {
+		return "+" + s.Completion
+	}
+	return "=" + s.Command
+}
+
+// NewLocalEngine builds the models from command events in history order
+func NewLocalEngine(events []CommandEvent, config *LocalEngineConfig) *LocalEngine {
+	if config == nil {
+		config = DefaultLocalEngineConfig()
+	}
+
+	engine := &LocalEngine{
+		config:   config,
+		bigrams:  make(map[string]map[string]float64),
+		trigrams: make(map[string]map[string]float64),
+	}
+	for _, event := range events {
+		command := strings.TrimSpace(event.Command)
+		if command == "" {
+			continue
+		}
+		event.Command = command
+		engine.events = append(engine.events, event)
+	}
+
+	for i := 1; i < len(engine.events); i++ {
+		weight := engine.weight(i)
+		next := engine.events[i].Command
+		addTransition(engine.bigrams, engine.events[i-1].Command, next, weight)
+		if i >= 2 {
+			addTransition(engine.trigrams, engine.events[i-2].Command+"\x00"+engine.events[i-1].Command, next, weight)
+		}
+	}
+
+	return engine
+}
+
+// loadedHistoryEvents and loadedLoggedEvents keep the events read from the
+// history files and proxy logs in memory for long-running processes such as
+// the daemon
+var (
+	loadedLocalMutex    sync.Mutex
+	loadedLocalSources  []HistorySource
+	loadedHistoryEvents []CommandEvent
+	loadedLoggedEvents  []CommandEvent
+)
+
+// LoadLocalEngine builds a local engine from the shell history files and proxy
+// logs, plus recorded events such as the commands of proxy sessions
+func LoadLocalEngine(historyFiles, proxyLogs []string, recorded []CommandEvent, config *LocalEngineConfig) *LocalEngine {
+	sources := statHistorySources(append(append([]string{}, historyFiles...), proxyLogs...))
+
+	loadedLocalMutex.Lock()
+	if loadedHistoryEvents == nil || !sameHistorySources(loadedLocalSources, sources) {
+		loadedHistoryEvents, loadedLoggedEvents = readCommandEvents(historyFiles, proxyLogs)
+		loadedLocalSources = sources
+	}
+	events := mergeCommandEvents(loadedHistoryEvents, loadedLoggedEvents, recorded)
+	loadedLocalMutex.Unlock()
+
+	return NewLocalEngine(events, config)
+}
+
+// readCommandEvents reads the commands of the history files and of the proxy
+// logs. Commands in proxy logs get the time of the log file, as the log
+// doesn't say when they ran.
+func readCommandEvents(historyFiles, proxyLogs []string) (history, logged []CommandEvent) {
+	history = []CommandEvent{}
+	for _, file := range historyFiles {
+		entries, err := ReadHistoryFile(file)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			history = append(history, CommandEvent{Command: entry.Command, Time: entry.LastUsed})
+		}
+	}
+	for _, file := range proxyLogs {
+		info, err := os.Stat(file)
+		if err != nil || !isOwnFile(file) {
+			continue
+		}
+		content, err := readPossiblyCompressed(file)
+		if err != nil {
+			continue
+		}
+		for _, command := range ExtractPromptCommands(content) {
+			logged = append(logged, CommandEvent{Command: command, Time: info.ModTime().Unix()})
+		}
+	}
+	return history, logged
+}
+
+// sameRunWindow is how far apart in seconds two sources may date the same run
+// of a command
+const sameRunWindow = 2
+
+// mergeCommandEvents orders the events of all sources by time, so the last
+// event is the most recent command, and drops the runs several sources saw:
+// history entries the proxy recorded too, and proxy log commands that are in
+// the history or records, whose exact time is unknown. Events without a time
+// keep their order before the others.
+func mergeCommandEvents(history, logged, recorded []CommandEvent) []CommandEvent {
+	known := make(map[string]bool)
+	recordedTimes := make(map[string][]int64)
+	for _, event := range recorded {
+		known[event.Command] = true
+		recordedTimes[event.Command] = append(recordedTimes[event.Command], event.Time)
+	}
+
+	events := make([]CommandEvent, 0, len(history)+len(logged)+len(recorded))
+	for _, event := range history {
+		known[event.Command] = true
+		duplicate := false
+		if event.Time != 0 {
+			for _, t := range recordedTimes[event.Command] {
+				if t-event.Time <= sameRunWindow && event.Time-t <= sameRunWindow {
+					duplicate = true
+					break
+				}
+			}
+		}
+		// The record has the directory, so it is the one kept
+		if !duplicate {
+			events = append(events, event)
+		}
+	}
+	for _, event := range logged {
+		if !known[event.Command] {
+			events = append(events, event)
+		}
+	}
+	events = append(events, recorded...)
+
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Time < events[j].Time
+	})
+	return events
+}
+
+func addTransition(model map[string]map[string]float64, prev, next string, weight float64) {
+	if model[prev] == nil {
+		model[prev] = make(map[string]float64)
+	}
+	model[prev][next] += weight
+}
+
+// weight decays exponentially with how many commands ago event i was run
+func (e *LocalEngine) weight(i int) float64 {
+	age := float64(len(e.events) - 1 - i)
+	return math.Pow(0.5, age/e.config.HalfLife)
+}
+
+// Len returns the number of commands the engine was built from
+func (e *LocalEngine) Len() int {
+	return len(e.events)
+}
+
+// Suggest predicts the command for the current input and directory. With an
+// empty input it predicts the next command from the last commands run; with
+// a partial command it completes it from the most frecent matching commands.
+func (e *LocalEngine) Suggest(input, cwd string) (*LocalSuggestion, error) {
+	if len(e.events) == 0 {
+		return nil, fmt.Errorf("no history available for local suggestions")
+	}
+
+	scores := make(map[string]float64)
+	// reasons records the model with the largest contribution to each score
+	reasons := make(map[string]string)
+	contributions := make(map[string]float64)
+	add := func(command string, score float64, reason string) {
+		if score <= 0 {
+			return
+		}
+		scores[command] += score
+		if score > contributions[command] {
+			contributions[command] = score
+			reasons[command] = reason
+		}
+	}
+
+	// Transition model: what usually follows the last one or two commands
+	n := len(e.events)
+	last := e.events[n-1].Command
+	if n >= 2 {
+		key := e.events[n-2].Command + "\x00" + last
+		addNormalized(e.trigrams[key], 3, "trigram", add)
+	}
+	addNormalized(e.bigrams[last], 2, "bigram", add)
+
+	// Frecency model, boosted for commands previously run in this directory
+	frecency := make(map[string]float64)
+	total := 0.0
+	for i, event := range e.events {
+		w := e.weight(i)
+		if cwd != "" && event.Cwd == cwd {
+			w *= e.config.CwdBoost
+		}
+		frecency[event.Command] += w
+		total += w
+	}
+	for command, w := range frecency {
+		add(command, w/total, "frecency")
+	}
+
+	prefix := strings.TrimLeft(input, " ")
+	type candidate struct {
+		command string
+		score   float64
+	}
+	var candidates []candidate
+	for command, score := range scores {
+		if prefix != "" {
+			if !strings.HasPrefix(command, prefix) || command == prefix {
+				continue
+			}
+		} else if command == last {
+			// Re-running the very same command is rarely what's wanted
+			score /= 2
+		}
+		candidates = append(candidates, candidate{command, score})
+	}
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("no local suggestion for input %q", input)
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].score != candidates[j].score {
+			return candidates[i].score > candidates[j].score
+		}
+		return candidates[i].command < candidates[j].command
+	})
+	best := candidates[0]
+
+	// For completions the score is relative to the other matching commands
+	score := best.score
+	if prefix != "" {
+		sum := 0.0
+		for _, c := range candidates {
+			sum += c.score
+		}
+		score = best.score / sum
+	}
+	if score < e.config.MinScore {
+		return nil, fmt.Errorf("no confident local suggestion (score %.3f)", score)
+	}
+
+	suggestion := &LocalSuggestion{
+		Command: best.command,
+		Reason:  reasons[best.command],
+		Score:   score,
+	}
+	if prefix != "" {
+		suggestion.IsCompletion = true
+		suggestion.Completion = strings.TrimPrefix(best.command, prefix)
+	}
+	return suggestion, nil
+}
+
+// addNormalized adds the transition weights as probabilities scaled by factor
+func addNormalized(next map[string]float64, factor float64, reason string, add func(string, float64, string)) {
+	total := 0.0
+	for _, w := range next {
+		total += w
+	}
+	if total == 0 {
+		return
+	}
+	for command, w := range next {
+		add(command, factor*w/total, reason)
+	}
+}
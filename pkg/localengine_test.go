@@ -0,0 +1,90 @@
+package pkg
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMergeCommandEvents(t *testing.T) {
+	history := []CommandEvent{
+		{Command: "make build", Time: 100},
+		{Command: "git status", Time: 200},
+		{Command: "make test", Time: 300},
+	}
+	logged := []CommandEvent{
+		// Also in the history
+		{Command: "git status", Time: 50},
+		// Only in the proxy log
+		{Command: "htop", Time: 50},
+	}
+	recorded := []CommandEvent{
+		// The same run of make test as in the history
+		{Command: "make test", Cwd: "/src", Time: 301},
+		{Command: "git push", Cwd: "/src", Time: 400},
+	}
+
+	got := mergeCommandEvents(history, logged, recorded)
+	want := []CommandEvent{
+		{Command: "htop", Time: 50},
+		{Command: "make build", Time: 100},
+		{Command: "git status", Time: 200},
+		{Command: "make test", Cwd: "/src", Time: 301},
+		{Command: "git push", Cwd: "/src", Time: 400},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("mergeCommandEvents() =\n%v\nwant\n%v", got, want)
+	}
+}
+
+func TestMergeCommandEventsKeepsUntimedOrder(t *testing.T) {
+	history := []CommandEvent{{Command: "a"}, {Command: "b"}, {Command: "c"}}
+	got := mergeCommandEvents(history, nil, []CommandEvent{{Command: "d", Time: 10}})
+	var commands []string
+	for _, event := range got {
+		commands = append(commands, event.Command)
+	}
+	if want := []string{"a", "b", "c", "d"}; !reflect.DeepEqual(commands, want) {
+		t.Errorf("commands = %v, want %v", commands, want)
+	}
+}
+
+func TestLocalEngineSuggest(t *testing.T) {
+	var events []CommandEvent
+	for i := 0; i < 5; i++ {
+		events = append(events,
+			CommandEvent{Command: "git add -A"},
+			CommandEvent{Command: "git commit"},
+			CommandEvent{Command: "git push"},
+		)
+	}
+	events = append(events, CommandEvent{Command: "docker ps", Cwd: "/srv"}, CommandEvent{Command: "git add -A"})
+	engine := NewLocalEngine(events, nil)
+
+	tests := []struct {
+		name  string
+		input string
+		cwd   string
+		want  string
+	}{
+		{"next command from transitions", "", "", "=git commit"},
+		{"completion of a prefix", "git pu", "", "+sh"},
+		{"completion in the directory it ran in", "d", "/srv", "+ocker ps"},
+	}
+	for _, tt := range tests {
+		suggestion, err := engine.Suggest(tt.input, tt.cwd)
+		if err != nil {
+			t.Errorf("%s: Suggest(%q) failed: %v", tt.name, tt.input, err)
+			continue
+		}
+		if got := suggestion.Format(); got != tt.want {
+			t.Errorf("%s: Suggest(%q) = %q, want %q", tt.name, tt.input, got, tt.want)
+		}
+	}
+
+	if _, err := engine.Suggest("zzz", ""); err == nil {
+		t.Error("Suggest() for an unknown prefix succeeded")
+	}
+	if _, err := NewLocalEngine(nil, nil).Suggest("", ""); err == nil {
+		t.Error("Suggest() without history succeeded")
+	}
+}
@@ -0,0 +1,26 @@
+package pkg
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// CacheDir returns the directory used for smart-suggestion's on-disk caches,
+// creating the given subdirectory if necessary
+func CacheDir(sub string) (string, error) {
+	base := os.Getenv("SMART_SUGGESTION_CACHE_DIR")
+	if base == "" {
+		userCache, err := os.UserCacheDir()
+		if err != nil {
+			userCache = os.TempDir()
+		}
+		base = filepath.Join(userCache, "smart-suggestion")
+	}
+
+	dir := filepath.Join(base, sub)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", fmt.Errorf("failed to create cache directory %s: %w", dir, err)
+	}
+	return dir, nil
+}
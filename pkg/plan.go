@@ -0,0 +1,57 @@
+package pkg
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// planListMarker matches the number or bullet of a list item, e.g. "1. " or "- "
+var planListMarker = regexp.MustCompile(`^(\d+[.)]|[-*•])\s+`)
+
+// FormatPlan turns the steps of a natural language answer, one "=" line
+// each, into a command line for the plugin that runs them in order and stops
+// at the first failure, e.g. "=git pull &&\nmake"
+func FormatPlan(response string) (string, error) {
+	var steps, lines []string
+	for _, line := range strings.Split(response, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "```") {
+			continue
+		}
+		line = planListMarker.ReplaceAllString(line, "")
+		if step, ok := strings.CutPrefix(line, "="); ok {
+			if step = planStep(step); step != "" {
+				steps = append(steps, step)
+			}
+			continue
+		}
+		if line = planStep(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	// Models occasionally drop the prefix
+	if len(steps) == 0 {
+		steps = lines
+	}
+	if len(steps) == 0 {
+		return "", fmt.Errorf("empty response")
+	}
+	return "=" + strings.Join(steps, " &&\n"), nil
+}
+
+// planStep returns the command of a step without a prompt sign or inline
+// code quotes, or "" if it isn't a command. A step that still starts with a
+// plugin prefix is a completion or a garbled line, which would change the
+// meaning of the result.
+func planStep(step string) string {
+	step = strings.TrimSpace(planListMarker.ReplaceAllString(strings.TrimSpace(step), ""))
+	step = strings.TrimPrefix(step, "$ ")
+	if len(step) > 1 && strings.HasPrefix(step, "`") && strings.HasSuffix(step, "`") {
+		step = strings.TrimSpace(step[1 : len(step)-1])
+	}
+	if strings.HasPrefix(step, "+") || strings.HasPrefix(step, "=") {
+		return ""
+	}
+	return step
+}
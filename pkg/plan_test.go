@@ -0,0 +1,37 @@
+package pkg
+
+import "testing"
+
+func TestFormatPlan(t *testing.T) {
+	tests := []struct {
+		name     string
+		response string
+		want     string
+	}{
+		{"single step", "=git pull", "=git pull"},
+		{"several steps", "=git pull\n=make build\n", "=git pull &&\nmake build"},
+		{"numbered", "1. =git fetch\n2) =git rebase origin/main", "=git fetch &&\ngit rebase origin/main"},
+		{"bulleted", "- =docker compose down\n* = docker compose up -d", "=docker compose down &&\ndocker compose up -d"},
+		{"numbered without prefix", "1. `git stash`\n2. $ git pull", "=git stash &&\ngit pull"},
+		{"fenced", "```sh\n=npm ci\n=npm test\n```", "=npm ci &&\nnpm test"},
+		{"fenced without prefix", "```bash\nnpm ci\nnpm test\n```", "=npm ci &&\nnpm test"},
+		{"text around steps", "Here is the plan:\n=make clean\n=make", "=make clean &&\nmake"},
+		{"already prefixed completion", "+ --force", ""},
+		{"double prefix", "==git pull\n=+x\n=make", "=make"},
+		{"completion next to steps", "+ -v\n=go test ./...", "=go test ./..."},
+		{"empty", "", ""},
+		{"only a fence", "```\n```", ""},
+	}
+	for _, tt := range tests {
+		got, err := FormatPlan(tt.response)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("%s: FormatPlan() = %q, want an error", tt.name, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%s: FormatPlan() = %q, %v, want %q", tt.name, got, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package pkg
+
+import (
+	"io"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// SensitiveInput reports whether the terminal on fd reads input with echo
+// disabled in canonical mode, as password prompts (sudo, ssh, gpg) do.
+// Full-screen programs and line editors turn off canonical mode as well, so
+// they aren't mistaken for password prompts.
+func SensitiveInput(fd int) bool {
+	termios, err := unix.IoctlGetTermios(fd, ioctlReadTermios)
+	if err != nil {
+		return false
+	}
+	return termios.Lflag&unix.ECHO == 0 && termios.Lflag&unix.ICANON != 0
+}
+
+// pausedNote is recorded in place of the output hidden while paused
+const pausedNote = "\r\n[recording paused]\r\n"
+
+// RecordingGate is an io.Writer that stops passing session output to the
+// recording writers while recording is paused, either explicitly or because
+// the terminal is reading sensitive input
+type RecordingGate struct {
+	mutex     sync.Mutex
+	w         io.Writer
+	recorder  *SessionRecorder
+	manual    bool
+	sensitive bool
+}
+
+// NewRecordingGate creates a gate writing to w and pausing recorder along with it
+func NewRecordingGate(w io.Writer, recorder *SessionRecorder) *RecordingGate {
+	return &RecordingGate{w: w, recorder: recorder}
+}
+
+// Write implements io.Writer, dropping output while paused
+func (g *RecordingGate) Write(p []byte) (int, error) {
+	g.mutex.Lock()
+	paused := g.manual || g.sensitive
+	g.mutex.Unlock()
+	if paused {
+		return len(p), nil
+	}
+	return g.w.Write(p)
+}
+
+// Wrap returns a writer passing output to w only while recording is not paused
+func (g *RecordingGate) Wrap(w io.Writer) io.Writer {
+	return &gatedWriter{gate: g, w: w}
+}
+
+type gatedWriter struct {
+	gate *RecordingGate
+	w    io.Writer
+}
+
+func (gw *gatedWriter) Write(p []byte) (int, error) {
+	if gw.gate.Paused() {
+		return len(p), nil
+	}
+	return gw.w.Write(p)
+}
+
+// SetPaused explicitly pauses or resumes recording
+func (g *RecordingGate) SetPaused(paused bool) {
+	g.update(func() { g.manual = paused })
+}
+
+// SetSensitive marks whether sensitive input is being read
+func (g *RecordingGate) SetSensitive(sensitive bool) {
+	g.update(func() { g.sensitive = sensitive })
+}
+
+// Paused reports whether recording is paused for any reason
+func (g *RecordingGate) Paused() bool {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return g.manual || g.sensitive
+}
+
+// Status describes the recording state, e.g. "paused (sensitive input)"
+func (g *RecordingGate) Status() string {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	switch {
+	case g.manual:
+		return "paused"
+	case g.sensitive:
+		return "paused (sensitive input)"
+	default:
+		return "recording"
+	}
+}
+
+func (g *RecordingGate) update(change func()) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	wasPaused := g.manual || g.sensitive
+	change()
+	paused := g.manual || g.sensitive
+	if paused == wasPaused {
+		return
+	}
+	if paused {
+		// Leave a note so readers of the log know output is missing
+		_, _ = g.w.Write([]byte(pausedNote))
+	}
+	if g.recorder != nil {
+		g.recorder.SetPaused(paused)
+	}
+}
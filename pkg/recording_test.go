@@ -0,0 +1,124 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/creack/pty"
+)
+
+func TestRecordingGate(t *testing.T) {
+	var log, cast, records bytes.Buffer
+	recorder := NewSessionRecorder(&records)
+	gate := NewRecordingGate(&log, recorder)
+	castWriter := gate.Wrap(&cast)
+	recorder.Marker("633;E;sudo true")
+	recorder.Marker("133;C")
+
+	steps := []struct {
+		name   string
+		change func()
+		write  string
+		status string
+	}{
+		{"recording", nil, "a", "recording"},
+		{"paused", func() { gate.SetPaused(true) }, "b", "paused"},
+		{"sensitive while paused", func() { gate.SetSensitive(true) }, "c", "paused"},
+		{"resumed during sensitive input", func() { gate.SetPaused(false) }, "password", "paused (sensitive input)"},
+		{"sensitive input over", func() { gate.SetSensitive(false) }, "d", "recording"},
+		{"sensitive input", func() { gate.SetSensitive(true) }, "secret", "paused (sensitive input)"},
+		{"echo back on", func() { gate.SetSensitive(false) }, "e", "recording"},
+	}
+	for _, step := range steps {
+		if step.change != nil {
+			step.change()
+		}
+		if got := gate.Status(); got != step.status {
+			t.Errorf("%s: Status() = %q, want %q", step.name, got, step.status)
+		}
+		if gate.Paused() != (step.status != "recording") {
+			t.Errorf("%s: Paused() = %v", step.name, gate.Paused())
+		}
+		// The recorder is fed before the gate, as by the marker filter
+		recorder.Output([]byte(step.write))
+		for _, w := range []io.Writer{gate, castWriter} {
+			if n, err := w.Write([]byte(step.write)); n != len(step.write) || err != nil {
+				t.Errorf("%s: Write() = %d, %v", step.name, n, err)
+			}
+		}
+	}
+
+	// A note marks each pause, however many reasons it had
+	if want := "a" + pausedNote + "d" + pausedNote + "e"; log.String() != want {
+		t.Errorf("log = %q, want %q", log.String(), want)
+	}
+	if cast.String() != "ade" {
+		t.Errorf("cast = %q, want %q", cast.String(), "ade")
+	}
+
+	recorder.Marker("133;D;0")
+	var record CommandRecord
+	if err := json.Unmarshal(records.Bytes(), &record); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(record.Output, "password") || strings.Contains(record.Output, "secret") || !strings.Contains(record.Output, "[recording paused]") {
+		t.Errorf("record output = %q", record.Output)
+	}
+}
+
+func TestSensitiveInput(t *testing.T) {
+	if _, err := exec.LookPath("stty"); err != nil {
+		t.Skip("stty not found")
+	}
+	master, slave, err := pty.Open()
+	if err != nil {
+		t.Skipf("no pty: %v", err)
+	}
+	defer master.Close()
+	defer slave.Close()
+
+	stty := func(args ...string) {
+		t.Helper()
+		cmd := exec.Command("stty", args...)
+		cmd.Stdin = slave
+		if output, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("stty %v: %v: %s", args, err, output)
+		}
+	}
+
+	tests := []struct {
+		name string
+		mode []string
+		want bool
+	}{
+		{"echo on", []string{"sane"}, false},
+		{"password prompt", []string{"sane", "-echo"}, true},
+		{"line editor", []string{"sane", "-echo", "-icanon"}, false},
+		{"raw full-screen program", []string{"raw", "-echo"}, false},
+		{"echo back on", []string{"sane"}, false},
+	}
+	for _, tt := range tests {
+		stty(tt.mode...)
+		// The proxy checks the master side
+		if got := SensitiveInput(int(master.Fd())); got != tt.want {
+			t.Errorf("%s: SensitiveInput(master) = %v, want %v", tt.name, got, tt.want)
+		}
+		if got := SensitiveInput(int(slave.Fd())); got != tt.want {
+			t.Errorf("%s: SensitiveInput(slave) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	file, err := os.CreateTemp(t.TempDir(), "not-a-tty")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if SensitiveInput(int(file.Fd())) {
+		t.Error("SensitiveInput() of a regular file = true")
+	}
+}
@@ -0,0 +1,73 @@
+package pkg
+
+import "sync"
+
+// RingBuffer is a fixed-size, thread-safe buffer that keeps the most recent
+// bytes written to it
+type RingBuffer struct {
+	mutex sync.Mutex
+	data  []byte
+	start int
+	size  int
+	total int64
+}
+
+// NewRingBuffer creates a ring buffer holding up to capacity bytes
+func NewRingBuffer(capacity int) *RingBuffer {
+	if capacity <= 0 {
+		capacity = 256 * 1024
+	}
+	return &RingBuffer{data: make([]byte, capacity)}
+}
+
+// Write implements io.Writer, overwriting the oldest bytes when full
+func (rb *RingBuffer) Write(p []byte) (int, error) {
+	rb.mutex.Lock()
+	defer rb.mutex.Unlock()
+
+	n := len(p)
+	rb.total += int64(n)
+	capacity := len(rb.data)
+	if n >= capacity {
+		copy(rb.data, p[n-capacity:])
+		rb.start = 0
+		rb.size = capacity
+		return n, nil
+	}
+
+	end := (rb.start + rb.size) % capacity
+	first := copy(rb.data[end:], p)
+	copy(rb.data, p[first:])
+
+	rb.size += n
+	if rb.size > capacity {
+		rb.start = (rb.start + rb.size - capacity) % capacity
+		rb.size = capacity
+	}
+	return n, nil
+}
+
+// Bytes returns a copy of the buffered bytes, oldest first
+func (rb *RingBuffer) Bytes() []byte {
+	rb.mutex.Lock()
+	defer rb.mutex.Unlock()
+
+	out := make([]byte, rb.size)
+	first := copy(out, rb.data[rb.start:min(rb.start+rb.size, len(rb.data))])
+	copy(out[first:], rb.data[:rb.size-first])
+	return out
+}
+
+// Len returns the number of buffered bytes
+func (rb *RingBuffer) Len() int {
+	rb.mutex.Lock()
+	defer rb.mutex.Unlock()
+	return rb.size
+}
+
+// Total returns the number of bytes written since the buffer was created
+func (rb *RingBuffer) Total() int64 {
+	rb.mutex.Lock()
+	defer rb.mutex.Unlock()
+	return rb.total
+}
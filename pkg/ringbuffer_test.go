@@ -0,0 +1,49 @@
+package pkg
+
+import "testing"
+
+func TestRingBuffer(t *testing.T) {
+	tests := []struct {
+		name     string
+		capacity int
+		writes   []string
+		want     string
+	}{
+		{"empty", 4, nil, ""},
+		{"partial", 8, []string{"abc"}, "abc"},
+		{"exactly full", 4, []string{"ab", "cd"}, "abcd"},
+		{"overwrites oldest", 4, []string{"abc", "def"}, "cdef"},
+		{"wraps repeatedly", 3, []string{"ab", "cd", "ef", "g"}, "efg"},
+		{"write larger than capacity", 4, []string{"xy", "abcdefgh"}, "efgh"},
+		{"write of capacity after wrap", 4, []string{"abc", "defg"}, "defg"},
+		{"empty writes", 4, []string{"", "ab", ""}, "ab"},
+	}
+	for _, tt := range tests {
+		rb := NewRingBuffer(tt.capacity)
+		var total int64
+		for _, w := range tt.writes {
+			n, err := rb.Write([]byte(w))
+			if err != nil || n != len(w) {
+				t.Fatalf("%s: Write(%q) = %d, %v", tt.name, w, n, err)
+			}
+			total += int64(len(w))
+		}
+		if got := string(rb.Bytes()); got != tt.want {
+			t.Errorf("%s: Bytes() = %q, want %q", tt.name, got, tt.want)
+		}
+		if rb.Len() != len(tt.want) {
+			t.Errorf("%s: Len() = %d, want %d", tt.name, rb.Len(), len(tt.want))
+		}
+		if rb.Total() != total {
+			t.Errorf("%s: Total() = %d, want %d", tt.name, rb.Total(), total)
+		}
+	}
+}
+
+func TestRingBufferDefaultCapacity(t *testing.T) {
+	rb := NewRingBuffer(0)
+	rb.Write(make([]byte, 300*1024))
+	if rb.Len() != 256*1024 {
+		t.Errorf("Len() = %d, want %d", rb.Len(), 256*1024)
+	}
+}
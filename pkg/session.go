@@ -0,0 +1,449 @@
+package pkg
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CommandRecord is a single command recorded from the shell integration markers
+type CommandRecord struct {
+	Command   string    `json:"command"`
+	Cwd       string    `json:"cwd,omitempty"`
+	StartTime time.Time `json:"start_time"`
+	EndTime   time.Time `json:"end_time"`
+	// ExitCode is nil if the shell did not report one
+	ExitCode *int   `json:"exit_code,omitempty"`
+	Output   string `json:"output,omitempty"`
+}
+
+// Duration returns how long the command ran
+func (r *CommandRecord) Duration() time.Duration {
+	return r.EndTime.Sub(r.StartTime)
+}
+
+// Failed reports whether the command exited with a non-zero status
+func (r *CommandRecord) Failed() bool {
+	return r.ExitCode != nil && *r.ExitCode != 0
+}
+
+const (
+	// maxRecordedOutputBytes is how much raw output of a command is kept for rendering
+	maxRecordedOutputBytes = 64 * 1024
+	// maxRecordedOutputLines is how many rendered output lines are stored per command
+	maxRecordedOutputLines = 100
+	// maxMarkerBytes is the longest OSC sequence the filter buffers before giving up
+	maxMarkerBytes = 8192
+)
+
+// SessionRecorder turns shell integration markers and terminal output into
+// CommandRecords written as JSONL
+type SessionRecorder struct {
+	mutex   sync.Mutex
+	w       io.Writer
+	width   int
+	cwd     string
+	pending string
+	current *CommandRecord
+	output  []byte
+	paused  bool
+	// prompts counts the prompts shown; atPrompt is set from a prompt
+	// until the next command starts
+	prompts  int
+	atPrompt bool
+}
+
+// NewSessionRecorder creates a recorder writing records to w
+func NewSessionRecorder(w io.Writer) *SessionRecorder {
+	return &SessionRecorder{w: w, width: 120}
+}
+
+// SetWidth sets the terminal width used to render command output
+func (r *SessionRecorder) SetWidth(width int) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if width > 0 {
+		r.width = width
+	}
+}
+
+// CurrentCommand returns the command line of the running command, if known
+func (r *SessionRecorder) CurrentCommand() string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.current == nil {
+		return ""
+	}
+	return r.current.Command
+}
+
+// PromptState returns the number of prompts the shell has shown and whether
+// it is at a prompt, waiting for a command
+func (r *SessionRecorder) PromptState() (int, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.prompts, r.atPrompt
+}
+
+// SetPaused stops or resumes recording command output
+func (r *SessionRecorder) SetPaused(paused bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if paused && !r.paused && r.current != nil {
+		r.output = append(r.output, pausedNote...)
+	}
+	r.paused = paused
+}
+
+// Output records terminal output of the running command
+func (r *SessionRecorder) Output(p []byte) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.current == nil || r.paused {
+		return
+	}
+	r.output = append(r.output, p...)
+	if len(r.output) > maxRecordedOutputBytes {
+		r.output = r.output[len(r.output)-maxRecordedOutputBytes:]
+	}
+}
+
+// Marker handles a shell integration OSC sequence payload, e.g. "133;D;1"
+func (r *SessionRecorder) Marker(payload string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	code, rest, _ := strings.Cut(payload, ";")
+	switch code {
+	case "7":
+		r.cwd = parseOSC7(rest)
+	case "633":
+		// VS Code style "633;E;<command>" carries the command line
+		if kind, value, ok := strings.Cut(rest, ";"); ok && kind == "E" {
+			r.pending = unescapeMarkerValue(value)
+		}
+	case "133":
+		kind, args, _ := strings.Cut(rest, ";")
+		switch kind {
+		case "A":
+			// Prompt starts
+			r.prompts++
+			r.atPrompt = true
+		case "C":
+			// Command output starts
+			r.atPrompt = false
+			r.current = &CommandRecord{
+				Command:   r.pending,
+				Cwd:       r.cwd,
+				StartTime: time.Now(),
+			}
+			r.pending = ""
+			r.output = nil
+		case "D":
+			// Command finished, with an optional exit code
+			if r.current == nil {
+				return
+			}
+			r.current.EndTime = time.Now()
+			if exitCode, err := strconv.Atoi(strings.SplitN(args, ";", 2)[0]); err == nil {
+				r.current.ExitCode = &exitCode
+			}
+			lines := RenderTerminalOutput(r.output, r.width, 50, maxRecordedOutputLines)
+			if len(lines) > maxRecordedOutputLines {
+				lines = lines[len(lines)-maxRecordedOutputLines:]
+			}
+			r.current.Output = strings.Join(lines, "\n")
+			r.writeRecord(r.current)
+			r.current = nil
+			r.output = nil
+		}
+	}
+}
+
+func (r *SessionRecorder) writeRecord(record *CommandRecord) {
+	if r.w == nil {
+		return
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return
+	}
+	_, _ = r.w.Write(append(data, '\n'))
+}
+
+// parseOSC7 extracts the path from an OSC 7 "file://host/path" payload
+func parseOSC7(value string) string {
+	if !strings.HasPrefix(value, "file://") {
+		return value
+	}
+	rest := strings.TrimPrefix(value, "file://")
+	if slash := strings.IndexByte(rest, '/'); slash != -1 {
+		rest = rest[slash:]
+	}
+	if unescaped, err := url.PathUnescape(rest); err == nil {
+		return unescaped
+	}
+	return rest
+}
+
+// unescapeMarkerValue decodes the \\ and \xHH escapes used in marker values
+func unescapeMarkerValue(value string) string {
+	var out strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] != '\\' || i+1 >= len(value) {
+			out.WriteByte(value[i])
+			continue
+		}
+		if value[i+1] == '\\' {
+			out.WriteByte('\\')
+			i++
+			continue
+		}
+		if value[i+1] == 'x' && i+3 < len(value) {
+			if b, err := strconv.ParseUint(value[i+2:i+4], 16, 8); err == nil {
+				out.WriteByte(byte(b))
+				i += 3
+				continue
+			}
+		}
+		out.WriteByte(value[i])
+	}
+	return out.String()
+}
+
+// EscapeMarkerValue encodes a marker value so it can't end the OSC sequence,
+// escaping backslashes, semicolons and control characters
+func EscapeMarkerValue(value string) string {
+	var out strings.Builder
+	for i := 0; i < len(value); i++ {
+		b := value[i]
+		switch {
+		case b == '\\':
+			out.WriteString(`\\`)
+		case b == ';' || b < 0x20 || b == 0x7f:
+			fmt.Fprintf(&out, `\x%02x`, b)
+		default:
+			out.WriteByte(b)
+		}
+	}
+	return out.String()
+}
+
+// MarkerNonceEnv is the environment variable that passes the nonce the plugin
+// tags its markers with to the shell
+const MarkerNonceEnv = "SMART_SUGGESTION_PROXY_NONCE"
+
+// markerTag is the last parameter of the plugin's markers, followed by the
+// nonce, e.g. "133;D;0;smart-suggestion=<nonce>"
+const markerTag = ";smart-suggestion="
+
+// MarkerFilter is an io.Writer that removes the plugin's shell integration
+// markers (OSC 133, OSC 633 and OSC 7 tagged with its nonce) from terminal
+// output, passing them to a SessionRecorder, and forwards everything else to
+// the underlying writer. Markers of the user's own terminal integration are
+// passed through.
+type MarkerFilter struct {
+	out      io.Writer
+	recorder *SessionRecorder
+	tag      string
+	pending  []byte
+}
+
+// NewMarkerFilter creates a marker filter for the markers tagged with nonce,
+// writing the remaining output to out
+func NewMarkerFilter(out io.Writer, recorder *SessionRecorder, nonce string) *MarkerFilter {
+	return &MarkerFilter{out: out, recorder: recorder, tag: markerTag + nonce}
+}
+
+// Write implements io.Writer. Markers split across writes are buffered until complete.
+func (f *MarkerFilter) Write(p []byte) (int, error) {
+	n := len(p)
+	data := p
+	if len(f.pending) > 0 {
+		data = append(f.pending, p...)
+		f.pending = nil
+	}
+
+	var passthrough bytes.Buffer
+	for len(data) > 0 {
+		start := bytes.Index(data, []byte("\x1b]"))
+		if start == -1 {
+			// Keep a trailing ESC in case it starts a marker
+			if data[len(data)-1] == 0x1b {
+				passthrough.Write(data[:len(data)-1])
+				f.pending = []byte{0x1b}
+			} else {
+				passthrough.Write(data)
+			}
+			break
+		}
+		passthrough.Write(data[:start])
+		data = data[start:]
+
+		end, termLen := findOSCTerminator(data[2:])
+		if end == -1 {
+			if len(data) > maxMarkerBytes {
+				// Not a sequence we can handle, pass it through
+				passthrough.Write(data)
+			} else {
+				f.pending = append([]byte{}, data...)
+			}
+			break
+		}
+
+		payload := string(data[2 : 2+end])
+		sequence := data[:2+end+termLen]
+		data = data[2+end+termLen:]
+
+		if marker, ok := strings.CutSuffix(payload, f.tag); ok && isShellMarker(marker) {
+			// Flush output that precedes the marker so it's attributed correctly
+			f.flush(&passthrough)
+			if f.recorder != nil {
+				f.recorder.Marker(marker)
+			}
+			continue
+		}
+		passthrough.Write(sequence)
+	}
+
+	f.flush(&passthrough)
+	return n, nil
+}
+
+func (f *MarkerFilter) flush(buf *bytes.Buffer) {
+	if buf.Len() == 0 {
+		return
+	}
+	if f.recorder != nil {
+		f.recorder.Output(buf.Bytes())
+	}
+	if f.out != nil {
+		_, _ = f.out.Write(buf.Bytes())
+	}
+	buf.Reset()
+}
+
+// findOSCTerminator returns the index of the BEL or ST ending an OSC payload
+// and the terminator length, or -1 if the payload is incomplete
+func findOSCTerminator(data []byte) (int, int) {
+	for i := 0; i < len(data); i++ {
+		switch data[i] {
+		case 0x07:
+			return i, 1
+		case 0x1b:
+			if i+1 < len(data) {
+				if data[i+1] == '\\' {
+					return i, 2
+				}
+				// A new escape sequence ends the OSC without a terminator
+				return i, 0
+			}
+			return -1, 0
+		}
+	}
+	return -1, 0
+}
+
+func isShellMarker(payload string) bool {
+	return strings.HasPrefix(payload, "133;") || strings.HasPrefix(payload, "633;") || strings.HasPrefix(payload, "7;")
+}
+
+// GetSessionRecordFile returns the JSONL command record file for a session log file
+func GetSessionRecordFile(sessionLogFile string) string {
+	return strings.TrimSuffix(sessionLogFile, filepath.Ext(sessionLogFile)) + ".jsonl"
+}
+
+// ReadCommandRecords reads all command records from a JSONL session record file
+func ReadCommandRecords(path string) ([]CommandRecord, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open session records: %w", err)
+	}
+	defer file.Close()
+
+	var records []CommandRecord
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		var record CommandRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err == nil {
+			records = append(records, record)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return records, fmt.Errorf("failed to read session records: %w", err)
+	}
+	return records, nil
+}
+
+// ReadAllCommandRecords reads the command records of the current user's
+// sessions for the base proxy log path, ordered by start time
+func ReadAllCommandRecords(baseLogPath string) []CommandRecord {
+	// An empty path would glob the working directory
+	if baseLogPath == "" {
+		return nil
+	}
+	dir := filepath.Dir(baseLogPath)
+	base := filepath.Base(baseLogPath)
+	name := strings.TrimSuffix(base, filepath.Ext(base))
+
+	matches, _ := filepath.Glob(filepath.Join(dir, name+".*.jsonl"))
+	var records []CommandRecord
+	for _, match := range matches {
+		// Other users' sessions share the directory
+		if !isOwnFile(match) {
+			continue
+		}
+		fileRecords, _ := ReadCommandRecords(match)
+		records = append(records, fileRecords...)
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].StartTime.Before(records[j].StartTime)
+	})
+	return records
+}
+
+// CommandEventsFromRecords converts command records to local engine events
+func CommandEventsFromRecords(records []CommandRecord) []CommandEvent {
+	events := make([]CommandEvent, 0, len(records))
+	for _, record := range records {
+		events = append(events, CommandEvent{
+			Command: record.Command,
+			Cwd:     record.Cwd,
+			Time:    record.StartTime.Unix(),
+		})
+	}
+	return events
+}
+
+// FormatCommandRecords summarizes records one per line, e.g.
+// "make test  (in /src, exit 2 after 3s)"
+func FormatCommandRecords(records []CommandRecord) string {
+	var lines []string
+	for _, record := range records {
+		var details []string
+		if record.Cwd != "" {
+			details = append(details, "in "+record.Cwd)
+		}
+		if record.ExitCode != nil {
+			if *record.ExitCode == 0 {
+				details = append(details, "succeeded")
+			} else {
+				details = append(details, fmt.Sprintf("FAILED with exit %d", *record.ExitCode))
+			}
+		}
+		details = append(details, "after "+record.Duration().Round(time.Millisecond*100).String())
+		lines = append(lines, fmt.Sprintf("%s  (%s)", strings.ReplaceAll(record.Command, "\n", "\\n"), strings.Join(details, ", ")))
+	}
+	return strings.Join(lines, "\n")
+}
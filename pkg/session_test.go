@@ -0,0 +1,122 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestMarkerFilter(t *testing.T) {
+	const tag = ";smart-suggestion=abc123"
+	var out, records bytes.Buffer
+	filter := NewMarkerFilter(&out, NewSessionRecorder(&records), "abc123")
+
+	writes := []string{
+		// The terminal's own integration passes through
+		"\x1b]7;file://host/home/me\x07\x1b]133;A\x07$ ",
+		"\x1b]7;file://host/tmp/a%25b%20c" + tag + "\x07",
+		"\x1b]633;E;echo hi\\x3b ls" + tag + "\x1b\\",
+		// A marker split across writes
+		"\x1b]133;C" + tag[:5],
+		tag[5:] + "\x07hi\r\n",
+		"\x1b]133;C;smart-suggestion=other\x07",
+		"\x1b]133;D;2" + tag + "\x07\x1b]133;A" + tag + "\x07$ ",
+	}
+	for _, w := range writes {
+		if n, err := filter.Write([]byte(w)); n != len(w) || err != nil {
+			t.Fatalf("Write(%q) = %d, %v", w, n, err)
+		}
+	}
+
+	want := "\x1b]7;file://host/home/me\x07\x1b]133;A\x07$ hi\r\n\x1b]133;C;smart-suggestion=other\x07$ "
+	if out.String() != want {
+		t.Errorf("output = %q, want %q", out.String(), want)
+	}
+
+	var record CommandRecord
+	if err := json.Unmarshal(records.Bytes(), &record); err != nil {
+		t.Fatalf("record %q: %v", records.String(), err)
+	}
+	if record.Command != "echo hi; ls" || record.Cwd != "/tmp/a%b c" || record.ExitCode == nil || *record.ExitCode != 2 || record.Output != "hi" {
+		t.Errorf("record = %+v", record)
+	}
+}
+
+func TestParseOSC7(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"file://host/home/me", "/home/me"},
+		{"file:///srv/my%20app", "/srv/my app"},
+		{"file://host/tmp/100%25", "/tmp/100%"},
+		{"file://host/bad%zz", "/bad%zz"},
+		{"/plain/path", "/plain/path"},
+	}
+	for _, tt := range tests {
+		if got := parseOSC7(tt.value); got != tt.want {
+			t.Errorf("parseOSC7(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestReadAllCommandRecords(t *testing.T) {
+	if records := ReadAllCommandRecords(""); records != nil {
+		t.Errorf("ReadAllCommandRecords(\"\") = %v, want nil", records)
+	}
+
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		t.Helper()
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	write("proxy.b.jsonl", `{"command":"make test","start_time":"2024-01-02T00:00:00Z"}`+"\n")
+	write("proxy.a.jsonl", `{"command":"git pull","start_time":"2024-01-01T00:00:00Z"}`+"\nnot json\n")
+	write("other.c.jsonl", `{"command":"ls","start_time":"2024-01-03T00:00:00Z"}`+"\n")
+	// Other users' sessions in the shared directory are left out
+	if os.Getuid() == 0 {
+		other := write("proxy.d.jsonl", `{"command":"cat ~/.secret","start_time":"2024-01-04T00:00:00Z"}`+"\n")
+		if err := os.Chown(other, 12345, 12345); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var commands []string
+	for _, record := range ReadAllCommandRecords(filepath.Join(dir, "proxy.log")) {
+		commands = append(commands, record.Command)
+	}
+	if want := []string{"git pull", "make test"}; !reflect.DeepEqual(commands, want) {
+		t.Errorf("ReadAllCommandRecords() = %q, want %q", commands, want)
+	}
+}
+
+func TestSessionRecorderPromptState(t *testing.T) {
+	recorder := NewSessionRecorder(nil)
+	steps := []struct {
+		marker   string
+		prompts  int
+		atPrompt bool
+	}{
+		{"", 0, false},
+		{"133;A", 1, true},
+		{"633;E;sleep 5", 1, true},
+		{"133;C", 1, false},
+		{"133;D;0", 1, false},
+		{"133;A", 2, true},
+	}
+	for _, step := range steps {
+		if step.marker != "" {
+			recorder.Marker(step.marker)
+		}
+		if prompts, atPrompt := recorder.PromptState(); prompts != step.prompts || atPrompt != step.atPrompt {
+			t.Errorf("after %q: PromptState() = %d, %v, want %d, %v", step.marker, prompts, atPrompt, step.prompts, step.atPrompt)
+		}
+	}
+}
@@ -0,0 +1,339 @@
+package pkg
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// SessionMeta describes a proxy session, written by the proxy when it starts
+type SessionMeta struct {
+	ID        string    `json:"id"`
+	PID       int       `json:"pid"`
+	TTY       string    `json:"tty,omitempty"`
+	Command   []string  `json:"command,omitempty"`
+	Cwd       string    `json:"cwd,omitempty"`
+	StartTime time.Time `json:"start_time"`
+}
+
+// GetSessionMetaFile returns the metadata file for a session log file
+func GetSessionMetaFile(sessionLogFile string) string {
+	return strings.TrimSuffix(sessionLogFile, filepath.Ext(sessionLogFile)) + ".session.json"
+}
+
+// WriteSessionMeta writes session metadata to path
+func WriteSessionMeta(path string, meta SessionMeta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return fmt.Errorf("failed to marshal session metadata: %w", err)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("failed to write session metadata: %w", err)
+	}
+	return nil
+}
+
+// ReadSessionMeta reads session metadata from path
+func ReadSessionMeta(path string) (*SessionMeta, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read session metadata: %w", err)
+	}
+	var meta SessionMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal session metadata: %w", err)
+	}
+	return &meta, nil
+}
+
+// TerminalName returns the device path of the terminal open on f, or "" if
+// it can't be determined
+func TerminalName(f *os.File) string {
+	for _, link := range []string{"/proc/self/fd/", "/dev/fd/"} {
+		if name, err := os.Readlink(link + strconv.Itoa(int(f.Fd()))); err == nil && strings.HasPrefix(name, "/dev/") {
+			return name
+		}
+	}
+	return ""
+}
+
+// SessionFile returns the per-session variant of a base path, e.g.
+// /tmp/name.<id>.log for /tmp/name.log
+func SessionFile(basePath, sessionID string) string {
+	ext := filepath.Ext(basePath)
+	return strings.TrimSuffix(basePath, ext) + "." + sessionID + ext
+}
+
+// SessionLayout holds the base paths proxy session files are derived from
+type SessionLayout struct {
+	LogFile    string
+	LockFile   string
+	SocketFile string
+}
+
+// SessionFiles are the files belonging to one proxy session
+type SessionFiles struct {
+	Log     string
+	Records string
+	Meta    string
+	Cast    string
+	Lock    string
+	Socket  string
+	// Backups are rotated copies of the session log
+	Backups []string
+}
+
+// Files returns the paths of the files of a session
+func (l SessionLayout) Files(sessionID string) SessionFiles {
+	log := SessionFile(l.LogFile, sessionID)
+	ext := filepath.Ext(log)
+	backups, _ := filepath.Glob(strings.TrimSuffix(log, ext) + "-*" + ext + "*")
+	return SessionFiles{
+		Log:     log,
+		Records: GetSessionRecordFile(log),
+		Meta:    GetSessionMetaFile(log),
+		Cast:    GetSessionCastFile(log),
+		Lock:    SessionFile(l.LockFile, sessionID),
+		Socket:  SessionFile(l.SocketFile, sessionID),
+		Backups: backups,
+	}
+}
+
+// all returns every path, existing or not
+func (f SessionFiles) all() []string {
+	return append([]string{f.Log, f.Records, f.Meta, f.Cast, f.Lock, f.Socket}, f.Backups...)
+}
+
+// SessionInfo is the state of a proxy session found on disk
+type SessionInfo struct {
+	SessionMeta
+	// Active is true while the proxy holding the session lock is running
+	Active bool
+	// UID is the owner of the session files, or -1 if unknown
+	UID          int
+	Files        SessionFiles
+	Size         int64
+	LastActivity time.Time
+}
+
+// List returns all sessions with files on disk, most recently active first
+func (l SessionLayout) List() ([]SessionInfo, error) {
+	ids := make(map[string]bool)
+	for _, base := range []string{l.LogFile, l.LockFile} {
+		dir := filepath.Dir(base)
+		name := filepath.Base(base)
+		prefix := strings.TrimSuffix(name, filepath.Ext(name)) + "."
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read session directory %s: %w", dir, err)
+		}
+		for _, entry := range entries {
+			if id := sessionIDFromFile(entry.Name(), prefix); id != "" {
+				ids[id] = true
+			}
+		}
+	}
+
+	var sessions []SessionInfo
+	for id := range ids {
+		sessions = append(sessions, l.Session(id))
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].LastActivity.After(sessions[j].LastActivity)
+	})
+	return sessions, nil
+}
+
+// sessionIDFromFile extracts the session ID from a session file name such as
+// prefix<id>.log, prefix<id>.session.json or prefix<id>-20240101-120000.log.gz
+func sessionIDFromFile(name, prefix string) string {
+	if !strings.HasPrefix(name, prefix) {
+		return ""
+	}
+	rest := strings.TrimPrefix(name, prefix)
+	// Rotated session logs, compressed or not, before they pass for a .log
+	stem := strings.TrimSuffix(strings.TrimSuffix(rest, ".gz"), ".log")
+	if match := rotatedLogSuffix.FindStringIndex(stem); match != nil && stem != rest {
+		return stem[:match[0]]
+	}
+	for _, suffix := range []string{".session.json", ".jsonl", ".cast", ".log", ".lock", ".sock"} {
+		if strings.HasSuffix(rest, suffix) {
+			return strings.TrimSuffix(rest, suffix)
+		}
+	}
+	return ""
+}
+
+// Session returns the state of the session with the given ID
+func (l SessionLayout) Session(sessionID string) SessionInfo {
+	info := SessionInfo{
+		SessionMeta: SessionMeta{ID: sessionID},
+		UID:         -1,
+		Files:       l.Files(sessionID),
+	}
+	if meta, err := ReadSessionMeta(info.Files.Meta); err == nil {
+		info.SessionMeta = *meta
+		info.ID = sessionID
+	}
+
+	var earliest time.Time
+	for _, path := range info.Files.all() {
+		stat, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		info.Size += stat.Size()
+		if stat.ModTime().After(info.LastActivity) {
+			info.LastActivity = stat.ModTime()
+		}
+		if earliest.IsZero() || stat.ModTime().Before(earliest) {
+			earliest = stat.ModTime()
+		}
+		if sys, ok := stat.Sys().(*syscall.Stat_t); ok && info.UID == -1 {
+			info.UID = int(sys.Uid)
+		}
+	}
+	// Sessions started before metadata was written have to be estimated
+	if info.StartTime.IsZero() {
+		info.StartTime = earliest
+	}
+
+	if pid := lockPID(info.Files.Lock); pid > 0 {
+		info.PID = pid
+		// EPERM means the process exists but belongs to another user
+		err := syscall.Kill(pid, 0)
+		info.Active = err == nil || errors.Is(err, syscall.EPERM)
+	}
+	return info
+}
+
+// lockPID returns the PID stored in the first line of a lock file
+func lockPID(path string) int {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	line, _, _ := strings.Cut(string(data), "\n")
+	pid, err := strconv.Atoi(strings.TrimSpace(line))
+	if err != nil {
+		return 0
+	}
+	return pid
+}
+
+// Find returns the session whose ID is id or starts with it
+func (l SessionLayout) Find(id string) (*SessionInfo, error) {
+	sessions, err := l.List()
+	if err != nil {
+		return nil, err
+	}
+	var matches []SessionInfo
+	for _, session := range sessions {
+		if session.ID == id {
+			return &session, nil
+		}
+		if strings.HasPrefix(session.ID, id) {
+			matches = append(matches, session)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return nil, fmt.Errorf("no session matches %q", id)
+	case 1:
+		return &matches[0], nil
+	default:
+		return nil, fmt.Errorf("%d sessions match %q, use a longer prefix", len(matches), id)
+	}
+}
+
+// Remove deletes all files of the session
+func (s *SessionInfo) Remove() error {
+	var firstErr error
+	for _, path := range s.Files.all() {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) && firstErr == nil {
+			firstErr = fmt.Errorf("failed to remove %s: %w", path, err)
+		}
+	}
+	return firstErr
+}
+
+// SessionPrunePolicy decides which inactive sessions are removed. Zero values
+// disable a limit.
+type SessionPrunePolicy struct {
+	// MaxAge removes sessions without activity for longer than this
+	MaxAge time.Duration
+	// MaxSize removes the oldest sessions until all sessions together use
+	// at most this many bytes
+	MaxSize int64
+}
+
+// Prune removes inactive sessions of the current user according to policy and
+// returns them. Active sessions are never removed. With dryRun nothing is
+// deleted. A session that can't be removed doesn't stop the others from
+// being pruned; the first such error is returned along with the pruned ones.
+func (l SessionLayout) Prune(policy SessionPrunePolicy, dryRun bool) ([]SessionInfo, error) {
+	all, err := l.List()
+	if err != nil {
+		return nil, err
+	}
+
+	// Other users' sessions in a shared directory can't be removed anyway
+	uid := os.Getuid()
+	var sessions []SessionInfo
+	var total int64
+	for _, session := range all {
+		if session.UID != uid {
+			continue
+		}
+		sessions = append(sessions, session)
+		total += session.Size
+	}
+
+	var pruned []SessionInfo
+	var firstErr error
+	now := time.Now()
+	// Oldest first, so the size limit removes the least recently used sessions
+	for i := len(sessions) - 1; i >= 0; i-- {
+		session := sessions[i]
+		if session.Active {
+			continue
+		}
+		expired := policy.MaxAge > 0 && now.Sub(session.LastActivity) > policy.MaxAge
+		oversized := policy.MaxSize > 0 && total > policy.MaxSize
+		if !expired && !oversized {
+			continue
+		}
+		if !dryRun {
+			if err := session.Remove(); err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				continue
+			}
+		}
+		total -= session.Size
+		pruned = append(pruned, session)
+	}
+	return pruned, firstErr
+}
+
+// FormatSize formats a byte count for humans, e.g. "1.5MB"
+func FormatSize(size int64) string {
+	switch {
+	case size < 1024:
+		return fmt.Sprintf("%dB", size)
+	case size < 1024*1024:
+		return fmt.Sprintf("%.1fKB", float64(size)/1024)
+	case size < 1024*1024*1024:
+		return fmt.Sprintf("%.1fMB", float64(size)/(1024*1024))
+	default:
+		return fmt.Sprintf("%.1fGB", float64(size)/(1024*1024*1024))
+	}
+}
@@ -0,0 +1,85 @@
+package pkg
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSessionIDFromFile(t *testing.T) {
+	prefix := "smart_suggestion_proxy."
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"smart_suggestion_proxy.abc_1.log", "abc_1"},
+		{"smart_suggestion_proxy.abc_1.jsonl", "abc_1"},
+		{"smart_suggestion_proxy.abc_1.session.json", "abc_1"},
+		{"smart_suggestion_proxy.abc_1.cast", "abc_1"},
+		{"smart_suggestion_proxy.abc_1.sock", "abc_1"},
+		{"smart_suggestion_proxy.abc_1-20240101-120000.log", "abc_1"},
+		{"smart_suggestion_proxy.abc_1-20240101-120000.log.gz", "abc_1"},
+		{"smart_suggestion_proxy.log", ""},
+		{"other.abc_1.log", ""},
+		{"smart_suggestion_proxy.abc_1.txt", ""},
+	}
+	for _, tt := range tests {
+		if got := sessionIDFromFile(tt.name, prefix); got != tt.want {
+			t.Errorf("sessionIDFromFile(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPrune(t *testing.T) {
+	dir := t.TempDir()
+	layout := SessionLayout{
+		LogFile:    filepath.Join(dir, "proxy.log"),
+		LockFile:   filepath.Join(dir, "proxy.lock"),
+		SocketFile: filepath.Join(dir, "proxy.sock"),
+	}
+	old := time.Now().Add(-48 * time.Hour)
+	write := func(path, content string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// An ended session, a rotated backup of it, and a running one
+	ended := layout.Files("ended")
+	write(ended.Log, "output")
+	write(filepath.Join(dir, "proxy.ended-20240101-120000.log"), "rotated")
+	running := layout.Files("running")
+	write(running.Log, "output")
+	write(running.Lock, strconv.Itoa(os.Getpid())+"\n")
+
+	sessions, err := layout.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 2 {
+		t.Fatalf("List() found %d sessions, want 2", len(sessions))
+	}
+
+	pruned, err := layout.Prune(SessionPrunePolicy{MaxAge: 24 * time.Hour}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pruned) != 1 || pruned[0].ID != "ended" {
+		t.Fatalf("Prune() removed %v, want only the ended session", pruned)
+	}
+	if _, err := os.Stat(ended.Log); !os.IsNotExist(err) {
+		t.Errorf("ended session log still exists")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "proxy.ended-20240101-120000.log")); !os.IsNotExist(err) {
+		t.Errorf("rotated backup of the ended session still exists")
+	}
+	if _, err := os.Stat(running.Log); err != nil {
+		t.Errorf("running session was removed: %v", err)
+	}
+}
@@ -0,0 +1,181 @@
+package pkg
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SessionRequest is a request sent to a proxy session socket, one JSON object per line
+type SessionRequest struct {
+	Command string   `json:"command"`
+	Args    []string `json:"args,omitempty"`
+}
+
+// SessionResponse is the reply to a SessionRequest
+type SessionResponse struct {
+	OK    bool   `json:"ok"`
+	Data  string `json:"data,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// SessionHandler handles a session socket command and returns its data
+type SessionHandler func(args []string) (string, error)
+
+// SessionServer serves a proxy session's state over a Unix socket
+type SessionServer struct {
+	path     string
+	listener net.Listener
+	mutex    sync.RWMutex
+	handlers map[string]SessionHandler
+}
+
+// NewSessionServer listens on the Unix socket at path, readable only by the current user
+func NewSessionServer(path string) (*SessionServer, error) {
+	listener, err := listenUnixSocket(path, "session")
+	if err != nil {
+		return nil, err
+	}
+
+	return &SessionServer{
+		path:     path,
+		listener: listener,
+		handlers: make(map[string]SessionHandler),
+	}, nil
+}
+
+// listenUnixSocket listens on path, readable only by the current user. A
+// stale socket left behind by a crashed process is replaced.
+func listenUnixSocket(path, kind string) (net.Listener, error) {
+	if _, err := os.Stat(path); err == nil {
+		if conn, err := net.DialTimeout("unix", path, 100*time.Millisecond); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s socket %s is already in use", kind, path)
+		}
+		os.Remove(path)
+	}
+
+	// Bind in a private directory and move the socket into place once its
+	// permissions are set, so other users can never connect in between
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".smart-suggestion-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s socket: %w", kind, err)
+	}
+	defer os.RemoveAll(dir)
+
+	tmpPath := filepath.Join(dir, "sock")
+	listener, err := net.Listen("unix", tmpPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s socket: %w", kind, err)
+	}
+	// The socket is removed from its final path on Close
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	if err := os.Chmod(tmpPath, 0600); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to set %s socket permissions: %w", kind, err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to listen on %s socket: %w", kind, err)
+	}
+	return listener, nil
+}
+
+// Handle registers the handler for a command
+func (s *SessionServer) Handle(command string, handler SessionHandler) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.handlers[command] = handler
+}
+
+// Serve accepts connections until the server is closed
+func (s *SessionServer) Serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.serveConn(conn)
+	}
+}
+
+func (s *SessionServer) serveConn(conn net.Conn) {
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	reader := bufio.NewReader(conn)
+	line, err := reader.ReadBytes('\n')
+	if err != nil && len(line) == 0 {
+		return
+	}
+
+	var request SessionRequest
+	var response SessionResponse
+	if err := json.Unmarshal(line, &request); err != nil {
+		response.Error = fmt.Sprintf("invalid request: %v", err)
+	} else {
+		s.mutex.RLock()
+		handler, ok := s.handlers[request.Command]
+		s.mutex.RUnlock()
+		if !ok {
+			response.Error = fmt.Sprintf("unknown command: %s", request.Command)
+		} else if data, err := handler(request.Args); err != nil {
+			response.Error = err.Error()
+		} else {
+			response.OK = true
+			response.Data = data
+		}
+	}
+
+	data, err := json.Marshal(response)
+	if err != nil {
+		return
+	}
+	_, _ = conn.Write(append(data, '\n'))
+}
+
+// Close stops the server and removes the socket
+func (s *SessionServer) Close() error {
+	err := s.listener.Close()
+	os.Remove(s.path)
+	return err
+}
+
+// QuerySession sends a command to a proxy session socket and returns its data
+func QuerySession(path, command string, args []string, timeout time.Duration) (string, error) {
+	conn, err := net.DialTimeout("unix", path, timeout)
+	if err != nil {
+		return "", fmt.Errorf("failed to connect to session socket: %w", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+
+	request, err := json.Marshal(SessionRequest{Command: command, Args: args})
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal request: %w", err)
+	}
+	if _, err := conn.Write(append(request, '\n')); err != nil {
+		return "", fmt.Errorf("failed to send request: %w", err)
+	}
+
+	reader := bufio.NewReaderSize(conn, 64*1024)
+	line, err := reader.ReadBytes('\n')
+	if err != nil && len(line) == 0 {
+		return "", fmt.Errorf("failed to read response: %w", err)
+	}
+
+	var response SessionResponse
+	if err := json.Unmarshal(line, &response); err != nil {
+		return "", fmt.Errorf("failed to unmarshal response: %w", err)
+	}
+	if !response.OK {
+		return "", fmt.Errorf("session error: %s", strings.TrimSpace(response.Error))
+	}
+	return response.Data, nil
+}
@@ -0,0 +1,47 @@
+package pkg
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSessionServer(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "session.sock")
+	// A stale socket of a crashed process is replaced
+	if err := os.WriteFile(path, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := NewSessionServer(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Handle("echo", func(args []string) (string, error) { return args[0], nil })
+	go server.Serve()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode()&os.ModeSocket == 0 || info.Mode().Perm() != 0600 {
+		t.Errorf("socket mode = %v, want a socket with 0600", info.Mode())
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("socket directory has %d entries, want only the socket", len(entries))
+	}
+
+	if got, err := QuerySession(path, "echo", []string{"hi"}, time.Second); err != nil || got != "hi" {
+		t.Errorf("QuerySession() = %q, %v, want hi", got, err)
+	}
+	if _, err := NewSessionServer(path); err == nil {
+		t.Error("NewSessionServer() on a socket in use succeeded")
+	}
+
+	server.Close()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("socket still exists after Close: %v", err)
+	}
+}
@@ -0,0 +1,540 @@
+package pkg
+
+import (
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Screen is a minimal VT100/xterm screen model. Raw terminal output written to
+// it is interpreted (cursor movement, erasing, scrolling, carriage returns,
+// alternate screen) so the rendered lines match what the user saw.
+type Screen struct {
+	width  int
+	height int
+
+	main      [][]rune
+	alt       [][]rune
+	altActive bool
+
+	cursorX, cursorY int
+	savedX, savedY   int
+	// wrapPending is set after writing to the last column (deferred autowrap)
+	wrapPending bool
+
+	scrollTop, scrollBottom int
+
+	scrollback    []string
+	maxScrollback int
+
+	// parser state
+	state   vtState
+	params  []byte
+	partial []byte
+
+	// OnAltScreen is called when an application enters or leaves the alternate screen
+	OnAltScreen func(active bool)
+}
+
+type vtState int
+
+const (
+	stateGround vtState = iota
+	stateEscape
+	stateCSI
+	stateOSC
+	stateOSCEscape
+	stateString
+	stateStringEscape
+	stateCharset
+)
+
+// NewScreen creates a screen of the given size keeping up to maxScrollback
+// lines that scrolled off the top
+func NewScreen(width, height, maxScrollback int) *Screen {
+	if width <= 0 {
+		width = 80
+	}
+	if height <= 0 {
+		height = 24
+	}
+	return &Screen{
+		width:         width,
+		height:        height,
+		main:          newGrid(width, height),
+		alt:           newGrid(width, height),
+		maxScrollback: maxScrollback,
+		scrollBottom:  height - 1,
+	}
+}
+
+func newGrid(width, height int) [][]rune {
+	grid := make([][]rune, height)
+	for i := range grid {
+		grid[i] = newRow(width)
+	}
+	return grid
+}
+
+func newRow(width int) []rune {
+	row := make([]rune, width)
+	for i := range row {
+		row[i] = ' '
+	}
+	return row
+}
+
+func (s *Screen) grid() [][]rune {
+	if s.altActive {
+		return s.alt
+	}
+	return s.main
+}
+
+// Resize changes the screen size, keeping the bottom rows that still fit
+func (s *Screen) Resize(width, height int) {
+	if width <= 0 || height <= 0 || (width == s.width && height == s.height) {
+		return
+	}
+
+	for len(s.main) > height {
+		s.pushScrollback(s.main[0])
+		s.main = s.main[1:]
+		s.cursorY--
+	}
+	for len(s.main) < height {
+		s.main = append(s.main, newRow(width))
+	}
+	s.alt = newGrid(width, height)
+	for i, row := range s.main {
+		if len(row) > width {
+			s.main[i] = row[:width]
+		}
+		for len(s.main[i]) < width {
+			s.main[i] = append(s.main[i], ' ')
+		}
+	}
+
+	s.width, s.height = width, height
+	s.scrollTop, s.scrollBottom = 0, height-1
+	s.clampCursor()
+}
+
+// Write feeds raw terminal output to the screen
+func (s *Screen) Write(data []byte) (int, error) {
+	n := len(data)
+	if len(s.partial) > 0 {
+		data = append(s.partial, data...)
+		s.partial = nil
+	}
+
+	for len(data) > 0 {
+		r, size := utf8.DecodeRune(data)
+		if r == utf8.RuneError && size <= 1 && !utf8.FullRune(data) {
+			// Keep an incomplete UTF-8 sequence for the next write
+			s.partial = append([]byte{}, data...)
+			break
+		}
+		data = data[size:]
+		s.feed(r)
+	}
+
+	return n, nil
+}
+
+// WriteString feeds raw terminal output to the screen
+func (s *Screen) WriteString(data string) {
+	_, _ = s.Write([]byte(data))
+}
+
+func (s *Screen) feed(r rune) {
+	switch s.state {
+	case stateEscape:
+		s.handleEscape(r)
+		return
+	case stateCSI:
+		if r >= 0x40 && r <= 0x7e {
+			s.state = stateGround
+			s.handleCSI(r)
+		} else if len(s.params) < 64 {
+			s.params = append(s.params, byte(r))
+		}
+		return
+	case stateOSC:
+		switch r {
+		case 0x07:
+			s.state = stateGround
+		case 0x1b:
+			s.state = stateOSCEscape
+		}
+		return
+	case stateOSCEscape:
+		// ESC \ terminates the string; anything else restarts escape parsing
+		if r == '\\' {
+			s.state = stateGround
+		} else {
+			s.state = stateEscape
+			s.handleEscape(r)
+		}
+		return
+	case stateString:
+		if r == 0x1b {
+			s.state = stateStringEscape
+		}
+		return
+	case stateStringEscape:
+		if r == '\\' {
+			s.state = stateGround
+		} else {
+			s.state = stateString
+		}
+		return
+	case stateCharset:
+		s.state = stateGround
+		return
+	}
+
+	switch r {
+	case 0x1b:
+		s.state = stateEscape
+	case '\r':
+		s.cursorX = 0
+		s.wrapPending = false
+	case '\n', 0x0b, 0x0c:
+		s.lineFeed()
+	case '\b':
+		if s.cursorX > 0 {
+			s.cursorX--
+		}
+		s.wrapPending = false
+	case '\t':
+		next := (s.cursorX/8 + 1) * 8
+		if next >= s.width {
+			next = s.width - 1
+		}
+		s.cursorX = next
+	default:
+		if r < 0x20 || r == 0x7f {
+			return
+		}
+		s.put(r)
+	}
+}
+
+func (s *Screen) put(r rune) {
+	if s.wrapPending {
+		s.cursorX = 0
+		s.lineFeed()
+	}
+	s.grid()[s.cursorY][s.cursorX] = r
+	if s.cursorX == s.width-1 {
+		s.wrapPending = true
+	} else {
+		s.cursorX++
+	}
+}
+
+func (s *Screen) lineFeed() {
+	s.wrapPending = false
+	if s.cursorY == s.scrollBottom {
+		s.scrollUp(1)
+	} else if s.cursorY < s.height-1 {
+		s.cursorY++
+	}
+}
+
+func (s *Screen) reverseLineFeed() {
+	if s.cursorY == s.scrollTop {
+		s.scrollDown(1)
+	} else if s.cursorY > 0 {
+		s.cursorY--
+	}
+}
+
+// scrollUp scrolls the scroll region up, moving lines off the top of a
+// full-screen region of the main screen into the scrollback
+func (s *Screen) scrollUp(n int) {
+	grid := s.grid()
+	// Scrolling by more than the region only blanks it
+	n = min(n, s.scrollBottom-s.scrollTop+1)
+	for i := 0; i < n; i++ {
+		if !s.altActive && s.scrollTop == 0 {
+			s.pushScrollback(grid[0])
+		}
+		copy(grid[s.scrollTop:s.scrollBottom], grid[s.scrollTop+1:s.scrollBottom+1])
+		grid[s.scrollBottom] = newRow(s.width)
+	}
+}
+
+func (s *Screen) scrollDown(n int) {
+	grid := s.grid()
+	n = min(n, s.scrollBottom-s.scrollTop+1)
+	for i := 0; i < n; i++ {
+		copy(grid[s.scrollTop+1:s.scrollBottom+1], grid[s.scrollTop:s.scrollBottom])
+		grid[s.scrollTop] = newRow(s.width)
+	}
+}
+
+func (s *Screen) pushScrollback(row []rune) {
+	if s.maxScrollback <= 0 {
+		return
+	}
+	s.scrollback = append(s.scrollback, strings.TrimRight(string(row), " "))
+	if len(s.scrollback) > s.maxScrollback {
+		s.scrollback = s.scrollback[len(s.scrollback)-s.maxScrollback:]
+	}
+}
+
+func (s *Screen) handleEscape(r rune) {
+	s.state = stateGround
+	switch r {
+	case '[':
+		s.state = stateCSI
+		s.params = s.params[:0]
+	case ']':
+		s.state = stateOSC
+	case 'P', 'X', '^', '_':
+		s.state = stateString
+	case '(', ')', '*', '+', '#', '%':
+		s.state = stateCharset
+	case '7':
+		s.savedX, s.savedY = s.cursorX, s.cursorY
+	case '8':
+		s.cursorX, s.cursorY = s.savedX, s.savedY
+		s.clampCursor()
+	case 'D':
+		s.lineFeed()
+	case 'E':
+		s.cursorX = 0
+		s.lineFeed()
+	case 'M':
+		s.reverseLineFeed()
+	case 'c':
+		s.reset()
+	}
+}
+
+func (s *Screen) reset() {
+	if s.altActive {
+		s.setAltScreen(false)
+	}
+	for i := range s.main {
+		s.main[i] = newRow(s.width)
+	}
+	s.cursorX, s.cursorY = 0, 0
+	s.scrollTop, s.scrollBottom = 0, s.height-1
+	s.wrapPending = false
+}
+
+func (s *Screen) handleCSI(final rune) {
+	raw := string(s.params)
+	private := strings.HasPrefix(raw, "?")
+	raw = strings.TrimLeft(raw, "?<>=!")
+	// Ignore intermediate bytes such as the space in "CSI 2 q"
+	raw = strings.TrimRight(raw, " !\"#$%&'()*+,-./")
+
+	var params []int
+	for _, field := range strings.Split(raw, ";") {
+		if colon := strings.IndexByte(field, ':'); colon != -1 {
+			field = field[:colon]
+		}
+		value, _ := strconv.Atoi(field)
+		params = append(params, value)
+	}
+	param := func(i, def int) int {
+		if i < len(params) && params[i] > 0 {
+			return params[i]
+		}
+		return def
+	}
+
+	if private {
+		if final == 'h' || final == 'l' {
+			for _, mode := range params {
+				if mode == 47 || mode == 1047 || mode == 1049 {
+					if mode == 1049 && final == 'h' {
+						s.savedX, s.savedY = s.cursorX, s.cursorY
+					}
+					s.setAltScreen(final == 'h')
+					if mode == 1049 && final == 'l' {
+						s.cursorX, s.cursorY = s.savedX, s.savedY
+						s.clampCursor()
+					}
+				}
+			}
+		}
+		return
+	}
+
+	s.wrapPending = false
+	grid := s.grid()
+	switch final {
+	case 'A':
+		s.cursorY -= param(0, 1)
+	case 'B', 'e':
+		s.cursorY += param(0, 1)
+	case 'C', 'a':
+		s.cursorX += param(0, 1)
+	case 'D':
+		s.cursorX -= param(0, 1)
+	case 'E':
+		s.cursorY += param(0, 1)
+		s.cursorX = 0
+	case 'F':
+		s.cursorY -= param(0, 1)
+		s.cursorX = 0
+	case 'G', '`':
+		s.cursorX = param(0, 1) - 1
+	case 'd':
+		s.cursorY = param(0, 1) - 1
+	case 'H', 'f':
+		s.cursorY = param(0, 1) - 1
+		s.cursorX = param(1, 1) - 1
+	case 'J':
+		s.clampCursor()
+		switch param(0, 0) {
+		case 0:
+			s.clearRow(s.cursorY, s.cursorX, s.width)
+			for y := s.cursorY + 1; y < s.height; y++ {
+				grid[y] = newRow(s.width)
+			}
+		case 1:
+			s.clearRow(s.cursorY, 0, s.cursorX+1)
+			for y := 0; y < s.cursorY; y++ {
+				grid[y] = newRow(s.width)
+			}
+		case 2, 3:
+			// Clearing the whole screen keeps its content in the scrollback
+			if !s.altActive {
+				lastUsed := -1
+				for y := range grid {
+					if strings.TrimSpace(string(grid[y])) != "" {
+						lastUsed = y
+					}
+				}
+				for y := 0; y <= lastUsed; y++ {
+					s.pushScrollback(grid[y])
+				}
+			}
+			for y := range grid {
+				grid[y] = newRow(s.width)
+			}
+		}
+	case 'K':
+		s.clampCursor()
+		switch param(0, 0) {
+		case 0:
+			s.clearRow(s.cursorY, s.cursorX, s.width)
+		case 1:
+			s.clearRow(s.cursorY, 0, s.cursorX+1)
+		case 2:
+			s.clearRow(s.cursorY, 0, s.width)
+		}
+	case 'X':
+		s.clampCursor()
+		s.clearRow(s.cursorY, s.cursorX, s.cursorX+param(0, 1))
+	case '@':
+		s.clampCursor()
+		row := grid[s.cursorY]
+		n := min(param(0, 1), s.width-s.cursorX)
+		copy(row[s.cursorX+n:], row[s.cursorX:s.width-n])
+		s.clearRow(s.cursorY, s.cursorX, s.cursorX+n)
+	case 'P':
+		s.clampCursor()
+		row := grid[s.cursorY]
+		n := min(param(0, 1), s.width-s.cursorX)
+		copy(row[s.cursorX:], row[s.cursorX+n:])
+		s.clearRow(s.cursorY, s.width-n, s.width)
+	case 'L', 'M':
+		s.clampCursor()
+		if s.cursorY < s.scrollTop || s.cursorY > s.scrollBottom {
+			return
+		}
+		top := s.scrollTop
+		s.scrollTop = s.cursorY
+		if final == 'L' {
+			s.scrollDown(param(0, 1))
+		} else {
+			// Deleted lines don't go to the scrollback
+			saved := s.maxScrollback
+			s.maxScrollback = 0
+			s.scrollUp(param(0, 1))
+			s.maxScrollback = saved
+		}
+		s.scrollTop = top
+	case 'S':
+		s.scrollUp(param(0, 1))
+	case 'T':
+		s.scrollDown(param(0, 1))
+	case 'r':
+		top, bottom := param(0, 1)-1, param(1, s.height)-1
+		if top < bottom && bottom < s.height {
+			s.scrollTop, s.scrollBottom = top, bottom
+			s.cursorX, s.cursorY = 0, 0
+		}
+	case 's':
+		s.savedX, s.savedY = s.cursorX, s.cursorY
+	case 'u':
+		s.cursorX, s.cursorY = s.savedX, s.savedY
+	}
+	s.clampCursor()
+}
+
+func (s *Screen) setAltScreen(active bool) {
+	if active == s.altActive {
+		return
+	}
+	s.altActive = active
+	if active {
+		s.alt = newGrid(s.width, s.height)
+	}
+	if s.OnAltScreen != nil {
+		s.OnAltScreen(active)
+	}
+}
+
+// AltScreenActive reports whether a full-screen application is using the alternate screen
+func (s *Screen) AltScreenActive() bool {
+	return s.altActive
+}
+
+func (s *Screen) clearRow(y, from, to int) {
+	row := s.grid()[y]
+	if from < 0 {
+		from = 0
+	}
+	if to > s.width {
+		to = s.width
+	}
+	for x := from; x < to; x++ {
+		row[x] = ' '
+	}
+}
+
+func (s *Screen) clampCursor() {
+	s.cursorX = max(0, min(s.cursorX, s.width-1))
+	s.cursorY = max(0, min(s.cursorY, s.height-1))
+}
+
+// Lines returns the scrollback followed by the rendered main screen, with
+// trailing blank lines removed. Content of the alternate screen is not
+// included, as it disappears when the application exits.
+func (s *Screen) Lines() []string {
+	lines := make([]string, 0, len(s.scrollback)+s.height)
+	lines = append(lines, s.scrollback...)
+	for _, row := range s.main {
+		lines = append(lines, strings.TrimRight(string(row), " "))
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// RenderTerminalOutput renders raw terminal output on a screen of the given
+// size and returns the resulting lines, including scrollback
+func RenderTerminalOutput(data []byte, width, height, maxScrollback int) []string {
+	screen := NewScreen(width, height, maxScrollback)
+	_, _ = screen.Write(data)
+	return screen.Lines()
+}
@@ -0,0 +1,197 @@
+package pkg
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRenderTerminalOutput(t *testing.T) {
+	tests := []struct {
+		name   string
+		input  string
+		width  int
+		height int
+		want   []string
+	}{
+		{
+			name:  "plain lines",
+			input: "one\r\ntwo\r\n",
+			want:  []string{"one", "two"},
+		},
+		{
+			name:  "carriage return overwrites",
+			input: "progress 10%\rprogress 100%\r\n",
+			want:  []string{"progress 100%"},
+		},
+		{
+			name:  "backspace",
+			input: "abc\b\bX\r\n",
+			want:  []string{"aXc"},
+		},
+		{
+			name:  "cursor position",
+			input: "\x1b[2;3Hx\x1b[1;1Hy",
+			want:  []string{"y", "  x"},
+		},
+		{
+			name:  "cursor up, down, forward and back",
+			input: "aaaa\r\nbbbb\x1b[A\x1b[2Dx\x1b[Bz\x1b[3Cq",
+			want:  []string{"aaxa", "bbbz   q"},
+		},
+		{
+			name:  "cursor moves are clamped to the screen",
+			input: "\x1b[99;99Hx\x1b[99A\x1b[99Dy",
+			width: 10, height: 3,
+			want: []string{"y", "", "         x"},
+		},
+		{
+			name:  "erase to end of line",
+			input: "hello world\x1b[6G\x1b[K",
+			want:  []string{"hello"},
+		},
+		{
+			name:  "erase to start of line",
+			input: "hello world\x1b[6G\x1b[1K",
+			want:  []string{"      world"},
+		},
+		{
+			name:  "erase line",
+			input: "hello\r\nworld\x1b[2K\r\nend",
+			want:  []string{"hello", "", "end"},
+		},
+		{
+			name:  "erase below",
+			input: "one\r\ntwo\r\nthree\x1b[2;2H\x1b[J",
+			want:  []string{"one", "t"},
+		},
+		{
+			name:  "clearing the screen keeps it in the scrollback",
+			input: "old\x1b[2J\x1b[Hnew",
+			want:  []string{"old", "new"},
+		},
+		{
+			name:  "erase characters",
+			input: "abcdef\x1b[2G\x1b[3X",
+			want:  []string{"a   ef"},
+		},
+		{
+			name:  "insert and delete characters",
+			input: "abcdef\x1b[2G\x1b[2P\x1b[1G\x1b[@",
+			want:  []string{" adef"},
+		},
+		{
+			name:  "wrap at the last column",
+			input: "abcdefgh",
+			width: 5, height: 3,
+			want: []string{"abcde", "fgh"},
+		},
+		{
+			name:  "writing to the last column defers the wrap",
+			input: "abcde\r\nx",
+			width: 5, height: 3,
+			want: []string{"abcde", "x"},
+		},
+		{
+			name:  "lines scroll into the scrollback",
+			input: "1\r\n2\r\n3\r\n4\r\n5",
+			width: 10, height: 3,
+			want: []string{"1", "2", "3", "4", "5"},
+		},
+		{
+			name:  "scroll region",
+			input: "top\r\na\r\nb\r\nbottom\x1b[2;3r\x1b[3;1H\nc",
+			width: 10, height: 4,
+			want: []string{"top", "b", "c", "bottom"},
+		},
+		{
+			name:  "scroll up",
+			input: "a\r\nb\r\nc\x1b[S",
+			width: 10, height: 3,
+			want: []string{"a", "b", "c"},
+		},
+		{
+			name:  "scroll down",
+			input: "a\r\nb\r\nc\x1b[T",
+			width: 10, height: 3,
+			want: []string{"", "a", "b"},
+		},
+		{
+			name:  "insert and delete lines",
+			input: "a\r\nb\r\nc\x1b[2;1H\x1b[L\x1b[1;1H\x1b[M",
+			width: 10, height: 4,
+			want: []string{"", "b", "c"},
+		},
+		{
+			name:  "alternate screen is not kept",
+			input: "before\r\n\x1b[?1049hfull screen app\x1b[?1049lafter",
+			want:  []string{"before", "after"},
+		},
+		{
+			name:  "alternate screen restores the cursor",
+			input: "ab\x1b[?1049h\x1b[5;5Hx\x1b[?1049lc",
+			want:  []string{"abc"},
+		},
+		{
+			name:  "OSC and charset sequences are ignored",
+			input: "\x1b]0;title\x07\x1b(Bok\x1b]8;;url\x1b\\",
+			want:  []string{"ok"},
+		},
+		{
+			name:  "colors are ignored",
+			input: "\x1b[1;31mred\x1b[0m",
+			want:  []string{"red"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			width, height := tt.width, tt.height
+			if width == 0 {
+				width, height = 20, 5
+			}
+			got := RenderTerminalOutput([]byte(tt.input), width, height, 100)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("RenderTerminalOutput(%q) = %q, want %q", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestScreenHugeScrollCount(t *testing.T) {
+	for _, sequence := range []string{"\x1b[999999999S", "\x1b[999999999T", "\x1b[999999999L", "\x1b[999999999M"} {
+		start := time.Now()
+		got := RenderTerminalOutput([]byte("a\r\nb"+sequence+"c"), 10, 3, 100)
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("%q took %s", sequence, elapsed)
+		}
+		if len(got) > 5 {
+			t.Errorf("%q rendered %d lines", sequence, len(got))
+		}
+	}
+}
+
+func TestScreenSplitUTF8(t *testing.T) {
+	screen := NewScreen(20, 3, 10)
+	data := []byte("héllo")
+	screen.Write(data[:2])
+	screen.Write(data[2:])
+	if got := strings.Join(screen.Lines(), "\n"); got != "héllo" {
+		t.Errorf("Lines() = %q, want %q", got, "héllo")
+	}
+}
+
+func TestScreenOnAltScreen(t *testing.T) {
+	var events []bool
+	screen := NewScreen(20, 3, 10)
+	screen.OnAltScreen = func(active bool) { events = append(events, active) }
+	screen.WriteString("\x1b[?1049h")
+	if !screen.AltScreenActive() {
+		t.Error("AltScreenActive() = false after entering the alternate screen")
+	}
+	screen.WriteString("\x1b[?1049l")
+	if !reflect.DeepEqual(events, []bool{true, false}) {
+		t.Errorf("OnAltScreen events = %v, want [true false]", events)
+	}
+}